@@ -7,6 +7,7 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"strings"
 
@@ -154,6 +155,17 @@ type Config struct {
 
 	// openai compatibility behavior: "legacy" or "strict_openai"
 	CompatibilityMode string `yaml:"compatibilityMode"`
+
+	// default model for llm_assisted prompt summarization
+	SummarizerModel string `yaml:"summarizerModel"`
+
+	// API keys allowed to pick a prompt optimization policy per request.
+	// Empty lets every authenticated request override the policy.
+	PromptOptimizationOverrideKeys []string `yaml:"promptOptimizationOverrideKeys"`
+
+	// let the tool runtime start stdio MCP servers. Off by default since a
+	// stdio tool runs its command on this host.
+	AllowStdioTools bool `yaml:"allowStdioTools"`
 }
 
 func (c *Config) RealModelName(search string) (string, bool) {
@@ -305,6 +317,10 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 			modelConfig.Proxy = strings.ReplaceAll(modelConfig.Proxy, macroSlug, macroStr)
 			modelConfig.CheckEndpoint = strings.ReplaceAll(modelConfig.CheckEndpoint, macroSlug, macroStr)
 			modelConfig.Filters.StripParams = strings.ReplaceAll(modelConfig.Filters.StripParams, macroSlug, macroStr)
+			modelConfig.PromptOptimization.Policy = strings.ReplaceAll(modelConfig.PromptOptimization.Policy, macroSlug, macroStr)
+			modelConfig.PromptOptimization.SummaryPrompt = strings.ReplaceAll(modelConfig.PromptOptimization.SummaryPrompt, macroSlug, macroStr)
+			modelConfig.PromptOptimization.SummarizerModel = strings.ReplaceAll(modelConfig.PromptOptimization.SummarizerModel, macroSlug, macroStr)
+			modelConfig.PromptOptimization.OverflowTarget = strings.ReplaceAll(modelConfig.PromptOptimization.OverflowTarget, macroSlug, macroStr)
 
 			// Substitute in metadata (type-preserving)
 			if len(modelConfig.Metadata) > 0 {
@@ -349,6 +365,11 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 			"proxy":               modelConfig.Proxy,
 			"checkEndpoint":       modelConfig.CheckEndpoint,
 			"filters.stripParams": modelConfig.Filters.StripParams,
+
+			"promptOptimization.policy":          modelConfig.PromptOptimization.Policy,
+			"promptOptimization.summaryPrompt":   modelConfig.PromptOptimization.SummaryPrompt,
+			"promptOptimization.summarizerModel": modelConfig.PromptOptimization.SummarizerModel,
+			"promptOptimization.overflowTarget":  modelConfig.PromptOptimization.OverflowTarget,
 		}
 
 		for fieldName, fieldValue := range fieldMap {
@@ -371,6 +392,16 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 			}
 		}
 
+		modelConfig.PromptOptimization.Policy = strings.ToLower(strings.TrimSpace(modelConfig.PromptOptimization.Policy))
+		modelConfig.PromptOptimization.SummarizerModel = strings.TrimSpace(modelConfig.PromptOptimization.SummarizerModel)
+		modelConfig.PromptOptimization.OverflowTarget = strings.TrimSpace(modelConfig.PromptOptimization.OverflowTarget)
+		for i, policy := range modelConfig.PromptOptimization.AllowedOverrides {
+			modelConfig.PromptOptimization.AllowedOverrides[i] = strings.ToLower(strings.TrimSpace(policy))
+		}
+		if err := modelConfig.PromptOptimization.Validate(); err != nil {
+			return Config{}, fmt.Errorf("model %s: %s", modelId, err.Error())
+		}
+
 		if _, err := url.Parse(modelConfig.Proxy); err != nil {
 			return Config{}, fmt.Errorf("model %s: invalid proxy URL: %w", modelId, err)
 		}
@@ -428,6 +459,13 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 		config.RequiredAPIKeys[i] = apikey
 	}
 
+	// Override keys must be among the keys that can authenticate at all
+	for _, key := range config.PromptOptimizationOverrideKeys {
+		if !slices.Contains(config.RequiredAPIKeys, key) {
+			return Config{}, fmt.Errorf("promptOptimizationOverrideKeys contains a key that is not listed in apiKeys")
+		}
+	}
+
 	// Process peers with global macro substitution
 	for peerName, peerConfig := range config.Peers {
 		// Substitute global macros (LIFO order)
@@ -464,9 +502,47 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 		config.Peers[peerName] = peerConfig
 	}
 
+	// Validate summarizer models now that models and peers are known
+	config.SummarizerModel = strings.TrimSpace(config.SummarizerModel)
+	if config.SummarizerModel != "" && !config.isKnownInferenceModel(config.SummarizerModel) {
+		return Config{}, fmt.Errorf("summarizerModel %s is not a configured, peer or ollama/ model", config.SummarizerModel)
+	}
+	for _, modelId := range modelIds {
+		summarizer := config.Models[modelId].PromptOptimization.SummarizerModel
+		if summarizer != "" && !config.isKnownInferenceModel(summarizer) {
+			return Config{}, fmt.Errorf("model %s: promptOptimization.summarizerModel %s is not a configured, peer or ollama/ model", modelId, summarizer)
+		}
+		target := config.Models[modelId].PromptOptimization.OverflowTarget
+		if target != "" && !config.isKnownInferenceModel(target) {
+			return Config{}, fmt.Errorf("model %s: promptOptimization.overflowTarget %s is not a configured, peer or ollama/ model", modelId, target)
+		}
+		if realName, found := config.RealModelName(target); found && realName == modelId {
+			return Config{}, fmt.Errorf("model %s: promptOptimization.overflowTarget must be a different model", modelId)
+		}
+	}
+
 	return config, nil
 }
 
+// isKnownInferenceModel reports whether a model name can be served: a local
+// model or alias, a peer model, or a dynamically discovered ollama/ model
+func (c *Config) isKnownInferenceModel(name string) bool {
+	if _, found := c.RealModelName(name); found {
+		return true
+	}
+	if strings.HasPrefix(name, "ollama/") {
+		return true
+	}
+	for _, peer := range c.Peers {
+		for _, model := range peer.Models {
+			if model == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // rewrites the yaml to include a default group with any orphaned models
 func AddDefaultGroupToConfig(config Config) Config {
 
@@ -39,6 +39,9 @@ type ModelConfig struct {
 
 	// Truncation mode for context overflow handling
 	TruncationMode string `yaml:"truncationMode"`
+
+	// Prompt optimization defaults, overridable at runtime
+	PromptOptimization PromptOptimizationConfig `yaml:"promptOptimization"`
 }
 
 func (m *ModelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -104,3 +104,188 @@ models:
 	assert.Equal(t, 0.7, setParams["temperature"])
 	assert.Equal(t, 0.9, setParams["top_p"])
 }
+
+func TestConfig_ModelPromptOptimization(t *testing.T) {
+	content := `
+macros:
+  opt_policy: llm_assisted
+  project: llama-swap
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    promptOptimization:
+      policy: ${opt_policy}
+      keepTail: 6
+      safetyMargin: 64
+      reservedOutputTokens: 2048
+      summaryPrompt: "Summarize the ${project} session for ${MODEL_ID}"
+  model2:
+    cmd: path/to/cmd --port ${PORT}
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	opt := config.Models["model1"].PromptOptimization
+	assert.Equal(t, "llm_assisted", opt.Policy)
+	assert.Equal(t, 6, opt.EffectiveKeepTail())
+	assert.Equal(t, 64, opt.SafetyMargin)
+	assert.Equal(t, 2048, opt.ReservedOutputTokens)
+	assert.Equal(t, "Summarize the llama-swap session for model1", opt.EffectiveSummaryPrompt())
+
+	defaults := config.Models["model2"].PromptOptimization
+	assert.Equal(t, "", defaults.Policy)
+	assert.Equal(t, 4, defaults.EffectiveKeepTail())
+	assert.Equal(t, 12000, defaults.EffectiveSummaryMaxInputChars())
+	assert.Equal(t, 512, defaults.EffectiveSummaryMaxTokens())
+	assert.Equal(t, DefaultSummaryPrompt, defaults.EffectiveSummaryPrompt())
+}
+
+func TestConfig_ModelPromptOptimizationValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		block   string
+		wantErr string
+	}{
+		{"invalid policy", "policy: smart", "promptOptimization.policy must be one of"},
+		{"negative keepTail", "keepTail: -1", "promptOptimization.keepTail must be >= 0"},
+		{"negative reserved", "reservedOutputTokens: -5", "promptOptimization.reservedOutputTokens must be >= 0"},
+		{"negative tool result cap", "toolResultMaxTokens: -1", "promptOptimization.toolResultMaxTokens must be >= 0"},
+		{"invalid pin pattern", "pinPatterns: ['IMPORTANT:(']", "promptOptimization.pinPatterns: error parsing regexp"},
+		{"unknown macro", "summaryPrompt: ${nope}", "unknown macro '${nope}'"},
+		{"invalid override", "allowedOverrides: [off, smart]", "promptOptimization.allowedOverrides: \"smart\" must be one of"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := fmt.Sprintf(`
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    promptOptimization:
+      %s
+`, tt.block)
+			_, err := LoadConfigFromReader(strings.NewReader(content))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_ModelPromptOptimizationSummarizerModel(t *testing.T) {
+	content := `
+summarizerModel: ollama/qwen3:4b
+peers:
+  peer1:
+    proxy: http://peer1:8080
+    models:
+      - peer-summarizer
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    promptOptimization:
+      summarizerModel: peer-summarizer
+  model2:
+    cmd: path/to/cmd --port ${PORT}
+    aliases: [small]
+  model3:
+    cmd: path/to/cmd --port ${PORT}
+    promptOptimization:
+      summarizerModel: small
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ollama/qwen3:4b", config.SummarizerModel)
+		assert.Equal(t, "peer-summarizer", config.Models["model1"].PromptOptimization.SummarizerModel)
+		assert.Equal(t, "small", config.Models["model3"].PromptOptimization.SummarizerModel)
+	}
+
+	_, err = LoadConfigFromReader(strings.NewReader(`
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    promptOptimization:
+      summarizerModel: missing-model
+`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "promptOptimization.summarizerModel missing-model")
+	}
+}
+
+func TestConfig_ModelPromptOptimizationOverflowTarget(t *testing.T) {
+	content := `
+models:
+  small:
+    cmd: path/to/cmd --port ${PORT}
+    promptOptimization:
+      overflowTarget: big
+  large:
+    cmd: path/to/cmd --port ${PORT}
+    aliases: [big]
+    promptOptimization:
+      overflowTarget: ollama/qwen3:32b
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "big", config.Models["small"].PromptOptimization.OverflowTarget)
+		assert.Equal(t, "ollama/qwen3:32b", config.Models["large"].PromptOptimization.OverflowTarget)
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		wantErr string
+	}{
+		{"unknown model", "missing-model", "promptOptimization.overflowTarget missing-model is not a configured"},
+		{"itself by alias", "tiny", "promptOptimization.overflowTarget must be a different model"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFromReader(strings.NewReader(`
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    aliases: [tiny]
+    promptOptimization:
+      overflowTarget: ` + tt.target + `
+`))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_PromptOptimizationOverrides(t *testing.T) {
+	content := `
+apiKeys: [trusted, other]
+promptOptimizationOverrideKeys: [trusted]
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    promptOptimization:
+      allowedOverrides: [" OFF ", limit_only]
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	opt := config.Models["model1"].PromptOptimization
+	assert.Equal(t, []string{"off", "limit_only"}, opt.AllowedOverrides)
+	assert.True(t, opt.AllowsOverride("off"))
+	assert.False(t, opt.AllowsOverride("llm_assisted"))
+	assert.True(t, PromptOptimizationConfig{}.AllowsOverride("llm_assisted"))
+
+	_, err = LoadConfigFromReader(strings.NewReader(`
+apiKeys: [trusted]
+promptOptimizationOverrideKeys: [unknown]
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "promptOptimizationOverrideKeys")
+	}
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PromptOptimizationPolicies lists the accepted values for PromptOptimizationConfig.Policy
+var PromptOptimizationPolicies = []string{"off", "limit_only", "always", "llm_assisted", "prefix_stable"}
+
+// DefaultSummaryPrompt is the system prompt used by llm_assisted summarization
+const DefaultSummaryPrompt = "Summarize the following chat history for coding continuity. Keep requirements, constraints, file paths, decisions, TODOs, open questions. Be concise. Do not add new facts."
+
+// PromptOptimizationConfig holds per-model prompt optimization defaults.
+// Zero values mean "use the built-in default". Runtime overrides set through
+// /api/model/:model/prompt-optimization take precedence over Policy.
+type PromptOptimizationConfig struct {
+	// Policy is the default policy: off, limit_only, always, llm_assisted,
+	// prefix_stable
+	Policy string `yaml:"policy"`
+
+	// KeepTail is the number of most recent messages never summarized
+	KeepTail int `yaml:"keepTail"`
+
+	// SafetyMargin is the number of tokens kept free below ctx-size
+	SafetyMargin int `yaml:"safetyMargin"`
+
+	// ReservedOutputTokens is reserved for the completion when the request
+	// does not set max_tokens
+	ReservedOutputTokens int `yaml:"reservedOutputTokens"`
+
+	// CropExchanges makes cropping drop whole user->assistant exchanges
+	// instead of single messages. Tool calls always stay with their results.
+	CropExchanges bool `yaml:"cropExchanges"`
+
+	// PinFirstUserMessages protects the first N user messages, usually the
+	// task statement, from cropping
+	PinFirstUserMessages int `yaml:"pinFirstUserMessages"`
+
+	// PinPatterns protects messages whose text matches any of these
+	// regular expressions from cropping
+	PinPatterns []string `yaml:"pinPatterns"`
+
+	// PinLastExchanges protects the last K user->assistant exchanges from
+	// cropping
+	PinLastExchanges int `yaml:"pinLastExchanges"`
+
+	// ToolResultMaxTokens caps older tool results: longer ones keep their
+	// head and tail around an elision marker. 0 disables the cap.
+	ToolResultMaxTokens int `yaml:"toolResultMaxTokens"`
+
+	// ToolResultKeepRecent is the number of most recent tool results left
+	// untouched by ToolResultMaxTokens
+	ToolResultKeepRecent int `yaml:"toolResultKeepRecent"`
+
+	// ClampMaxTokens lowers max_tokens/max_completion_tokens to what the
+	// context leaves next to the prompt instead of rejecting the request
+	ClampMaxTokens bool `yaml:"clampMaxTokens"`
+
+	// MinOutputTokens is the smallest output limit ClampMaxTokens clamps
+	// to; the prompt is cropped to keep this much room
+	MinOutputTokens int `yaml:"minOutputTokens"`
+
+	// ImageTokens is the prompt cost of one image used for budgeting
+	ImageTokens int `yaml:"imageTokens"`
+
+	// ImageTileTokens, when set, prices inline images per tile of
+	// ImageTileSize pixels instead of the fixed ImageTokens
+	ImageTileTokens int `yaml:"imageTileTokens"`
+
+	// ImageTileSize is the tile edge in pixels for ImageTileTokens
+	ImageTileSize int `yaml:"imageTileSize"`
+
+	// StripReasoning removes reasoning (reasoning_content, <think> blocks,
+	// the gpt-oss analysis channel, thinking blocks) from assistant
+	// messages before the current turn
+	StripReasoning bool `yaml:"stripReasoning"`
+
+	// CheckpointPercent is the share of the context a prefix_stable
+	// checkpoint compacts the prompt to. Lower values leave more room
+	// before the next checkpoint.
+	CheckpointPercent int `yaml:"checkpointPercent"`
+
+	// SummaryPrompt is the system prompt sent to the summarizer
+	SummaryPrompt string `yaml:"summaryPrompt"`
+
+	// SummaryMaxInputChars caps the history text sent to the summarizer
+	SummaryMaxInputChars int `yaml:"summaryMaxInputChars"`
+
+	// SummaryMaxTokens is the max_tokens for the summarization request
+	SummaryMaxTokens int `yaml:"summaryMaxTokens"`
+
+	// AllowedOverrides lists the policies a request may pick for itself with
+	// the X-LlamaSwap-Prompt-Optimization header. Empty allows every policy.
+	AllowedOverrides []string `yaml:"allowedOverrides"`
+
+	// SummarizerModel is the model used for llm_assisted summarization: a
+	// configured model, a peer model or an ollama/ model. Empty falls back to
+	// the global summarizerModel and then to the model itself.
+	SummarizerModel string `yaml:"summarizerModel"`
+
+	// OverflowTarget is the model a request is re-routed to when its prompt
+	// does not fit this model's context: a configured model, a peer model or
+	// an ollama/ model. Empty crops the prompt instead.
+	OverflowTarget string `yaml:"overflowTarget"`
+}
+
+// Validate checks the policy value and that numeric settings are not negative
+func (p PromptOptimizationConfig) Validate() error {
+	if policy := strings.TrimSpace(p.Policy); policy != "" && !IsPromptOptimizationPolicy(policy) {
+		return fmt.Errorf("promptOptimization.policy must be one of: %s", strings.Join(PromptOptimizationPolicies, ", "))
+	}
+	for _, policy := range p.AllowedOverrides {
+		if !IsPromptOptimizationPolicy(policy) {
+			return fmt.Errorf("promptOptimization.allowedOverrides: %q must be one of: %s", policy, strings.Join(PromptOptimizationPolicies, ", "))
+		}
+	}
+
+	numbers := []struct {
+		name  string
+		value int
+	}{
+		{"keepTail", p.KeepTail},
+		{"safetyMargin", p.SafetyMargin},
+		{"reservedOutputTokens", p.ReservedOutputTokens},
+		{"pinFirstUserMessages", p.PinFirstUserMessages},
+		{"pinLastExchanges", p.PinLastExchanges},
+		{"toolResultMaxTokens", p.ToolResultMaxTokens},
+		{"toolResultKeepRecent", p.ToolResultKeepRecent},
+		{"minOutputTokens", p.MinOutputTokens},
+		{"imageTokens", p.ImageTokens},
+		{"imageTileTokens", p.ImageTileTokens},
+		{"imageTileSize", p.ImageTileSize},
+		{"summaryMaxInputChars", p.SummaryMaxInputChars},
+		{"summaryMaxTokens", p.SummaryMaxTokens},
+	}
+	for _, n := range numbers {
+		if n.value < 0 {
+			return fmt.Errorf("promptOptimization.%s must be >= 0", n.name)
+		}
+	}
+	for _, pattern := range p.PinPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("promptOptimization.pinPatterns: %w", err)
+		}
+	}
+	if p.CheckpointPercent < 0 || p.CheckpointPercent > 100 {
+		return fmt.Errorf("promptOptimization.checkpointPercent must be between 0 and 100")
+	}
+	return nil
+}
+
+// IsPromptOptimizationPolicy reports whether policy is a known policy name
+func IsPromptOptimizationPolicy(policy string) bool {
+	for _, allowed := range PromptOptimizationPolicies {
+		if policy == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsOverride reports whether a request may select policy for itself
+func (p PromptOptimizationConfig) AllowsOverride(policy string) bool {
+	if len(p.AllowedOverrides) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedOverrides {
+		if policy == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// EffectiveKeepTail returns KeepTail or the default of 4
+func (p PromptOptimizationConfig) EffectiveKeepTail() int {
+	if p.KeepTail > 0 {
+		return p.KeepTail
+	}
+	return 4
+}
+
+// EffectiveToolResultKeepRecent returns ToolResultKeepRecent or the default of 2
+func (p PromptOptimizationConfig) EffectiveToolResultKeepRecent() int {
+	if p.ToolResultKeepRecent > 0 {
+		return p.ToolResultKeepRecent
+	}
+	return 2
+}
+
+// EffectiveMinOutputTokens returns MinOutputTokens or the default of 1024
+func (p PromptOptimizationConfig) EffectiveMinOutputTokens() int {
+	if p.MinOutputTokens > 0 {
+		return p.MinOutputTokens
+	}
+	return 1024
+}
+
+// EffectiveImageTokens returns ImageTokens or the default of 576
+func (p PromptOptimizationConfig) EffectiveImageTokens() int {
+	if p.ImageTokens > 0 {
+		return p.ImageTokens
+	}
+	return 576
+}
+
+// EffectiveImageTileSize returns ImageTileSize or the default of 512
+func (p PromptOptimizationConfig) EffectiveImageTileSize() int {
+	if p.ImageTileSize > 0 {
+		return p.ImageTileSize
+	}
+	return 512
+}
+
+// EffectiveCheckpointPercent returns CheckpointPercent or the default of 50
+func (p PromptOptimizationConfig) EffectiveCheckpointPercent() int {
+	if p.CheckpointPercent > 0 {
+		return p.CheckpointPercent
+	}
+	return 50
+}
+
+// EffectiveSummaryPrompt returns SummaryPrompt or DefaultSummaryPrompt
+func (p PromptOptimizationConfig) EffectiveSummaryPrompt() string {
+	if prompt := strings.TrimSpace(p.SummaryPrompt); prompt != "" {
+		return prompt
+	}
+	return DefaultSummaryPrompt
+}
+
+// EffectiveSummaryMaxInputChars returns SummaryMaxInputChars or the default of 12000
+func (p PromptOptimizationConfig) EffectiveSummaryMaxInputChars() int {
+	if p.SummaryMaxInputChars > 0 {
+		return p.SummaryMaxInputChars
+	}
+	return 12000
+}
+
+// EffectiveSummaryMaxTokens returns SummaryMaxTokens or the default of 512
+func (p PromptOptimizationConfig) EffectiveSummaryMaxTokens() int {
+	if p.SummaryMaxTokens > 0 {
+		return p.SummaryMaxTokens
+	}
+	return 512
+}
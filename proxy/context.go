@@ -6,7 +6,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/config"
 )
 
 // TruncationMode defines how context overflow is handled
@@ -33,6 +38,41 @@ type ContextManager struct {
 	truncationMode   TruncationMode
 	proxyLogger      *LogMonitor
 	upstreamProxyURL string
+
+	// reservedOutputTokens overrides the ctx-derived reservation when > 0
+	reservedOutputTokens int
+
+	// messageFormat selects how messages are grouped when cropping
+	messageFormat MessageFormat
+
+	// cropExchanges drops whole user->assistant exchanges instead of single
+	// messages or tool-call turns
+	cropExchanges bool
+
+	// toolResultMaxTokens caps older tool results, 0 disables the cap
+	toolResultMaxTokens int
+	// toolResultKeepRecent tool results at the end are never truncated
+	toolResultKeepRecent int
+	// stripReasoning removes reasoning from assistant turns before the
+	// current one
+	stripReasoning bool
+	// pin rules protect messages from the sliding window
+	pinFirstUserMessages int
+	pinPatterns          []*regexp.Regexp
+	pinLastExchanges     int
+	// clampMaxTokens lowers the requested output limit to fit the context,
+	// down to minOutputTokens
+	clampMaxTokens  bool
+	minOutputTokens int
+	// imageTokens is the fixed cost of an image, imageTileTokens the cost
+	// per imageTileSize tile when set
+	imageTokens     int
+	imageTileTokens int
+	imageTileSize   int
+
+	// tokenCache caches /tokenize counts per message and calibrates the
+	// word based estimate, nil counts the whole prompt on every call
+	tokenCache *tokenCountCache
 }
 
 // NewContextManager creates a new context manager for a model
@@ -44,7 +84,49 @@ func NewContextManager(modelID string, ctxSize int, truncationMode TruncationMod
 		truncationMode:   truncationMode,
 		proxyLogger:      proxyLogger,
 		upstreamProxyURL: upstreamProxyURL,
+		messageFormat:    MessageFormatOpenAI,
+	}
+}
+
+// WithOptimizationConfig applies per-model settings from config.yaml
+func (cm *ContextManager) WithOptimizationConfig(cfg config.PromptOptimizationConfig) *ContextManager {
+	if cfg.SafetyMargin > 0 {
+		cm.safetyMargin = cfg.SafetyMargin
+	}
+	if cfg.ReservedOutputTokens > 0 {
+		cm.reservedOutputTokens = cfg.ReservedOutputTokens
+	}
+	cm.cropExchanges = cfg.CropExchanges
+	cm.pinFirstUserMessages = cfg.PinFirstUserMessages
+	cm.pinLastExchanges = cfg.PinLastExchanges
+	cm.pinPatterns = cm.pinPatterns[:0]
+	for _, pattern := range cfg.PinPatterns {
+		// patterns are checked when the config is loaded
+		if re, err := regexp.Compile(pattern); err == nil {
+			cm.pinPatterns = append(cm.pinPatterns, re)
+		}
 	}
+	cm.toolResultMaxTokens = cfg.ToolResultMaxTokens
+	cm.toolResultKeepRecent = cfg.EffectiveToolResultKeepRecent()
+	cm.stripReasoning = cfg.StripReasoning
+	cm.clampMaxTokens = cfg.ClampMaxTokens
+	cm.minOutputTokens = cfg.EffectiveMinOutputTokens()
+	cm.imageTokens = cfg.EffectiveImageTokens()
+	cm.imageTileTokens = cfg.ImageTileTokens
+	cm.imageTileSize = cfg.EffectiveImageTileSize()
+	return cm
+}
+
+// WithTokenCache shares a token count cache with the context manager
+func (cm *ContextManager) WithTokenCache(tc *tokenCountCache) *ContextManager {
+	cm.tokenCache = tc
+	return cm
+}
+
+// WithMessageFormat sets the wire format of the messages being cropped
+func (cm *ContextManager) WithMessageFormat(format MessageFormat) *ContextManager {
+	cm.messageFormat = format
+	return cm
 }
 
 // ContextInfo contains context size and max tokens information
@@ -87,6 +169,82 @@ type ChatMessage struct {
 	Name         string     `json:"name,omitempty"`
 	FunctionName string     `json:"function_name,omitempty"`
 	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID   string     `json:"tool_call_id,omitempty"`
+
+	// Extra holds message fields not modeled above, such as
+	// reasoning_content, so they survive a rewrite of the messages array
+	Extra map[string]json.RawMessage `json:"-"`
+
+	// origin is the 1-based index of the message in the incoming request,
+	// 0 for messages added by the optimizer
+	origin int
+	// summarizes lists the origins replaced by an llm_assisted summary
+	summarizes []int
+	// replacedBlocks lists the blocks dedupeRepeatedBlocks replaced with a
+	// reference, in the order the references appear
+	replacedBlocks []replacedBlock
+}
+
+var chatMessageFields = []string{"role", "content", "name", "function_name", "tool_calls", "tool_call_id"}
+
+// UnmarshalJSON decodes a message and keeps unknown fields in Extra
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+	type plainMessage ChatMessage
+	var plain plainMessage
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	extra, err := unknownFields(data, chatMessageFields)
+	if err != nil {
+		return err
+	}
+	*m = ChatMessage(plain)
+	m.Extra = extra
+	return nil
+}
+
+// MarshalJSON encodes a message together with the fields kept in Extra
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+	type plainMessage ChatMessage
+	data, err := json.Marshal(plainMessage(m))
+	if err != nil {
+		return nil, err
+	}
+	return withExtraFields(data, m.Extra)
+}
+
+// unknownFields returns the fields of the JSON object data that are not in
+// known, nil when there are none
+func unknownFields(data []byte, known []string) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for _, key := range known {
+		delete(fields, key)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// withExtraFields adds the extra fields to the encoded JSON object data.
+// Fields already in data win.
+func withExtraFields(data []byte, extra map[string]json.RawMessage) ([]byte, error) {
+	if len(extra) == 0 {
+		return data, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range extra {
+		if _, known := fields[key]; !known {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
 }
 
 // ToolCall represents a tool call in a message
@@ -94,12 +252,75 @@ type ToolCall struct {
 	ID       string       `json:"id"`
 	Type     string       `json:"type"`
 	Function FunctionCall `json:"function"`
+
+	// Extra holds tool call fields not modeled above, such as the index of
+	// a streamed call or provider specific extra_content
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+var toolCallFields = []string{"id", "type", "function"}
+
+// UnmarshalJSON decodes a tool call and keeps unknown fields in Extra
+func (tc *ToolCall) UnmarshalJSON(data []byte) error {
+	type plainToolCall ToolCall
+	var plain plainToolCall
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	extra, err := unknownFields(data, toolCallFields)
+	if err != nil {
+		return err
+	}
+	*tc = ToolCall(plain)
+	tc.Extra = extra
+	return nil
+}
+
+// MarshalJSON encodes a tool call together with the fields kept in Extra
+func (tc ToolCall) MarshalJSON() ([]byte, error) {
+	type plainToolCall ToolCall
+	data, err := json.Marshal(plainToolCall(tc))
+	if err != nil {
+		return nil, err
+	}
+	return withExtraFields(data, tc.Extra)
 }
 
 // FunctionCall represents the function being called
 type FunctionCall struct {
 	Name      string `json:"name"`
 	Arguments string `json:"arguments"`
+
+	// Extra holds function fields not modeled above
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+var functionCallFields = []string{"name", "arguments"}
+
+// UnmarshalJSON decodes a function call and keeps unknown fields in Extra
+func (fc *FunctionCall) UnmarshalJSON(data []byte) error {
+	type plainFunctionCall FunctionCall
+	var plain plainFunctionCall
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	extra, err := unknownFields(data, functionCallFields)
+	if err != nil {
+		return err
+	}
+	*fc = FunctionCall(plain)
+	fc.Extra = extra
+	return nil
+}
+
+// MarshalJSON encodes a function call together with the fields kept in Extra
+func (fc FunctionCall) MarshalJSON() ([]byte, error) {
+	type plainFunctionCall FunctionCall
+	data, err := json.Marshal(plainFunctionCall(fc))
+	if err != nil {
+		return nil, err
+	}
+	return withExtraFields(data, fc.Extra)
 }
 
 // ChatRequest represents an OpenAI-style chat completion request
@@ -157,6 +378,8 @@ func (cm *ContextManager) CropChatRequest(originalReq ChatRequest) (*CropResult,
 			Tools:            workingTools,
 			OriginalMessages: originalReq.Messages,
 			OriginalTools:    originalReq.Tools,
+			TokensBefore:     totalTokens,
+			TokensAfter:      totalTokens,
 		}, nil
 	}
 
@@ -169,6 +392,30 @@ func (cm *ContextManager) CropChatRequest(originalReq ChatRequest) (*CropResult,
 			totalTokens, info.SafePromptTokens)
 	}
 
+	// repeated blocks go first, they cost nothing the model cannot look up
+	workingMessages, dedupedBlocks := dedupeRepeatedBlocks(workingMessages)
+	if dedupedBlocks > 0 {
+		dedupedTokens, err := cm.CountChatTokens(workingMessages, workingTools)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count deduplicated tokens: %w", err)
+		}
+		cm.proxyLogger.Debugf("<%s> Deduplicated %d repeated block(s): %d -> %d tokens",
+			cm.modelID, dedupedBlocks, totalTokens, dedupedTokens)
+		if dedupedTokens <= info.SafePromptTokens {
+			return &CropResult{
+				Messages:         workingMessages,
+				Tools:            workingTools,
+				OriginalMessages: originalReq.Messages,
+				OriginalTools:    originalReq.Tools,
+				DedupedBlocks:    dedupedBlocks,
+				TokensBefore:     totalTokens,
+				TokensAfter:      dedupedTokens,
+			}, nil
+		}
+	}
+
+	workingTools, toolsStripped, prunedTools := cm.applyToolBudget(workingMessages, workingTools, originalReq.ToolChoice, info.SafePromptTokens)
+	workingMessages, omittedImages := cm.omitOldImages(workingMessages, workingTools, info.SafePromptTokens)
 	croppedMessages, croppedTools := cm.applySlidingWindow(workingMessages, workingTools, info.SafePromptTokens)
 
 	croppedTokens, err := cm.CountChatTokens(croppedMessages, croppedTools)
@@ -184,10 +431,19 @@ func (cm *ContextManager) CropChatRequest(originalReq ChatRequest) (*CropResult,
 		Tools:            croppedTools,
 		OriginalMessages: originalReq.Messages,
 		OriginalTools:    originalReq.Tools,
+		ToolsStripped:    toolsStripped,
+		PrunedTools:      prunedTools,
+		DedupedBlocks:    dedupedBlocks,
+		OmittedImages:    omittedImages,
+		TokensBefore:     totalTokens,
+		TokensAfter:      croppedTokens,
 	}, nil
 }
 
 func (cm *ContextManager) defaultReservedOutputTokens() int {
+	if cm.reservedOutputTokens > 0 {
+		return cm.reservedOutputTokens
+	}
 	if cm.ctxSize <= 0 {
 		return DefaultReservedOutputTokens
 	}
@@ -208,10 +464,6 @@ func (cm *ContextManager) CountChatTokens(messages []ChatMessage, tools []ToolSc
 		return 0, fmt.Errorf("upstream URL not configured for model %s", cm.modelID)
 	}
 
-	payload := map[string]any{
-		"content": "",
-	}
-
 	textParts := make([]string, 0)
 
 	for _, msg := range messages {
@@ -222,16 +474,135 @@ func (cm *ContextManager) CountChatTokens(messages []ChatMessage, tools []ToolSc
 			}
 		}
 	}
+	messageParts := len(textParts)
+
+	// /tokenize only looks at content, so tool definitions are counted as text
+	if len(tools) > 0 {
+		if toolsJSON, err := json.Marshal(tools); err == nil {
+			textParts = append(textParts, "[TOOLS]: "+string(toolsJSON))
+		}
+	}
+
+	// /tokenize only sees text, images are priced separately
+	imageTokens := cm.estimateImageTokens(messages)
 
-	if len(textParts) > 0 {
-		payload["content"] = strings.Join(textParts, "\n\n")
+	if cm.tokenCache != nil {
+		return cm.countTextPartsCached(textParts, messageParts) + imageTokens, nil
 	}
 
-	if len(tools) > 0 {
-		payload["tools"] = tools
+	tokens, err := cm.tokenize(strings.Join(textParts, "\n\n"))
+	if err != nil {
+		cm.proxyLogger.Warnf("<%s> Failed to use llama.cpp /tokenize endpoint: %v (fallback to approximate counting)",
+			cm.modelID, err)
+		return cm.estimateTokens(textParts) + imageTokens, nil
+	}
+	return tokens + imageTokens, nil
+}
+
+// countTextPartsCached counts every part on its own so a part seen before,
+// usually a message of the re-sent history, is never tokenized again. The
+// uncached parts are counted together with one /tokenize call and then
+// tokenized one by one in the background to fill the cache. The first
+// messageParts parts are messages and calibrate the word estimate, the rest
+// are tool definitions. If /tokenize fails the uncached parts are estimated.
+func (cm *ContextManager) countTextPartsCached(textParts []string, messageParts int) int {
+	total := len(textParts) // separators
+	missing := make(map[string]int)
+	var cold []string
+	for i, part := range textParts {
+		key := tokenCountKey(part)
+		if tokens, ok := cm.tokenCache.get(cm.modelID, key); ok {
+			total += tokens
+			continue
+		}
+		cold = append(cold, part)
+		if _, ok := missing[key]; !ok {
+			missing[key] = i
+		}
+	}
+	cm.tokenCache.record(cm.modelID, len(textParts)-len(cold), len(cold))
+	if len(cold) == 0 {
+		return total
+	}
+
+	tokens, err := cm.tokenize(strings.Join(cold, "\n\n"))
+	if err != nil {
+		cm.proxyLogger.Warnf("<%s> Failed to tokenize %d of %d message(s) with llama.cpp /tokenize endpoint: %v (fallback to approximate counting)",
+			cm.modelID, len(cold), len(textParts), err)
+		for _, part := range cold {
+			total += cm.estimateWordTokens(part)
+		}
+		return total
+	}
+	cm.tokenCache.fill(cm.modelID, missing, func(missing map[string]int) {
+		cm.fillTokenCache(textParts, missing, messageParts)
+	})
+	return total + tokens
+}
+
+// fillTokenCache tokenizes the parts at the given indexes one by one and
+// stores their counts
+func (cm *ContextManager) fillTokenCache(textParts []string, missing map[string]int, messageParts int) {
+	counts := cm.tokenizeParts(textParts, missing)
+	for key, i := range missing {
+		tokens, ok := counts[key]
+		if !ok {
+			continue
+		}
+		cm.tokenCache.store(cm.modelID, key, tokens)
+		if i < messageParts {
+			cm.tokenCache.calibrate(cm.modelID, len(strings.Fields(textParts[i])), tokens)
+		}
+	}
+}
+
+// tokenizeConcurrency bounds the parallel /tokenize calls for uncached parts
+const tokenizeConcurrency = 4
+
+// tokenizeParts tokenizes the parts at the given indexes, keyed like
+// missing. After the first failure the rest are skipped, the upstream is
+// most likely not up.
+func (cm *ContextManager) tokenizeParts(textParts []string, missing map[string]int) map[string]int {
+	type job struct {
+		key  string
+		text string
+	}
+	jobs := make(chan job)
+	counts := make(map[string]int, len(missing))
+	var mu sync.Mutex
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < min(tokenizeConcurrency, len(missing)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if failed.Load() {
+					continue
+				}
+				tokens, err := cm.tokenize(j.text)
+				if err != nil {
+					cm.proxyLogger.Debugf("<%s> /tokenize failed: %v", cm.modelID, err)
+					failed.Store(true)
+					continue
+				}
+				mu.Lock()
+				counts[j.key] = tokens
+				mu.Unlock()
+			}
+		}()
 	}
+	for key, i := range missing {
+		jobs <- job{key: key, text: textParts[i]}
+	}
+	close(jobs)
+	wg.Wait()
+	return counts
+}
 
-	reqBody, err := json.Marshal(payload)
+// tokenize counts the tokens of text with the upstream /tokenize endpoint
+func (cm *ContextManager) tokenize(text string) (int, error) {
+	reqBody, err := json.Marshal(map[string]any{"content": text})
 	if err != nil {
 		return 0, fmt.Errorf("failed to marshal tokenization payload: %w", err)
 	}
@@ -240,16 +611,13 @@ func (cm *ContextManager) CountChatTokens(messages []ChatMessage, tools []ToolSc
 
 	resp, err := http.Post(tokenizeURL, "application/json", bytes.NewReader(reqBody))
 	if err != nil {
-		cm.proxyLogger.Warnf("<%s> Failed to use llama.cpp /tokenize endpoint: %v (fallback to approximate counting)",
-			cm.modelID, err)
-		return cm.estimateTokens(textParts), nil
+		return 0, err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		cm.proxyLogger.Warnf("<%s> Failed to read tokenize response: %v", cm.modelID, err)
-		return cm.estimateTokens(textParts), nil
+		return 0, fmt.Errorf("failed to read tokenize response: %w", err)
 	}
 
 	var result struct {
@@ -266,20 +634,30 @@ func (cm *ContextManager) CountChatTokens(messages []ChatMessage, tools []ToolSc
 			return len(result.Tokens), nil
 		}
 	}
-
-	cm.proxyLogger.Warnf("<%s> Tokenize endpoint returned unexpected response", cm.modelID)
-	return cm.estimateTokens(textParts), nil
+	return 0, fmt.Errorf("tokenize endpoint returned unexpected response (status %d)", resp.StatusCode)
 }
 
 // estimateTokens provides a rough token count for when llama.cpp endpoint unavailable
 func (cm *ContextManager) estimateTokens(textParts []string) int {
 	total := 0
 	for _, text := range textParts {
-		total += len(strings.Fields(text)) * 13 / 10 // Rough approximation: ~1.3 tokens per word
+		total += cm.estimateWordTokens(text)
 	}
 	return total + len(textParts) // Add separators
 }
 
+// estimateWordTokens estimates text by its words, at the ratio observed for
+// the model on /tokenize once calibrated and ~1.3 tokens per word before
+func (cm *ContextManager) estimateWordTokens(text string) int {
+	ratio := defaultTokensPerKiloWord
+	if cm.tokenCache != nil {
+		if calibrated := cm.tokenCache.tokensPerKiloWord(cm.modelID); calibrated > 0 {
+			ratio = calibrated
+		}
+	}
+	return len(strings.Fields(text)) * ratio / 1000
+}
+
 // applySlidingWindow implements the sliding window cropping strategy
 func (cm *ContextManager) applySlidingWindow(messages []ChatMessage, tools []ToolSchema, maxTokens int) ([]ChatMessage, []ToolSchema) {
 	if maxTokens <= 0 || len(messages) == 0 {
@@ -292,41 +670,197 @@ func (cm *ContextManager) applySlidingWindow(messages []ChatMessage, tools []Too
 		result = append(result, msg)
 	}
 
+	// tool definitions are sent with every request and cannot be cropped
+	maxTokens -= cm.estimateToolsTokens(tools)
+	if maxTokens <= 0 {
+		maxTokens = 1
+	}
+
 	totalTokens := cm.estimateMessagesTokens(result)
 
 	for totalTokens > maxTokens && len(result) > 1 {
-		result = cm.removeOldestNonSystemMessage(result)
+		next := cm.removeOldestMessageUnit(result)
+		if len(next) == len(result) {
+			break
+		}
+		result = next
 		totalTokens = cm.estimateMessagesTokens(result)
 	}
 
+	// a reference must not outlive the copy it points at
+	if len(result) < len(messages) {
+		var restored int
+		result, restored = resolveBlockReferences(result)
+		if restored > 0 {
+			cm.proxyLogger.Debugf("<%s> Restored %d deduplicated block(s) whose copy was cropped", cm.modelID, restored)
+		}
+	}
+
 	if len(result) == 1 {
 		msg := result[0]
 		truncatedContent := cm.truncateContent(chatContentToText(msg.Content), maxTokens)
-		result[0] = ChatMessage{
-			Role:         msg.Role,
-			Content:      applyTextToChatContent(msg.Content, truncatedContent),
-			Name:         msg.Name,
-			FunctionName: msg.FunctionName,
-			ToolCalls:    msg.ToolCalls,
-		}
+		msg.Content = applyTextToChatContent(msg.Content, truncatedContent)
+		result[0] = msg
 	}
 
 	return result, tools
 }
 
-// removeOldestNonSystemMessage removes the oldest message that isn't a system message
-func (cm *ContextManager) removeOldestNonSystemMessage(messages []ChatMessage) []ChatMessage {
-	if len(messages) <= 1 {
+// messageUnit lists the indexes of messages that must be dropped together
+type messageUnit []int
+
+// messageUnits groups non-system messages into units that can be dropped
+// without leaving orphans: an assistant turn that calls tools travels with
+// the messages carrying the matching results (role "tool" messages or
+// Anthropic tool_result blocks). With exchanges set, units are merged into
+// whole exchanges that start at a user turn.
+func messageUnits(messages []ChatMessage, exchanges bool) []messageUnit {
+	units := make([]messageUnit, 0, len(messages))
+	for i := 0; i < len(messages); {
+		if messages[i].Role == "system" {
+			i++
+			continue
+		}
+		unit := messageUnit{i}
+		pending := make(map[string]struct{})
+		for _, id := range toolUseIDs(messages[i]) {
+			pending[id] = struct{}{}
+		}
+		next := i + 1
+		for next < len(messages) && len(pending) > 0 {
+			results := toolResultIDs(messages[next])
+			if len(results) == 0 {
+				break
+			}
+			for _, id := range results {
+				delete(pending, id)
+			}
+			unit = append(unit, next)
+			next++
+		}
+		units = append(units, unit)
+		i = next
+	}
+
+	if !exchanges {
+		return units
+	}
+	merged := make([]messageUnit, 0, len(units))
+	for _, unit := range units {
+		first := messages[unit[0]]
+		startsExchange := first.Role == "user" && len(toolResultIDs(first)) == 0
+		if len(merged) == 0 || startsExchange {
+			merged = append(merged, unit)
+			continue
+		}
+		merged[len(merged)-1] = append(merged[len(merged)-1], unit...)
+	}
+	return merged
+}
+
+// removeOldestMessageUnit drops the oldest message unit that holds no pinned
+// message, keeping system messages and the most recent unit. Anthropic
+// conversations must start with a user turn, so when the first unit goes,
+// further units are dropped until one does.
+func (cm *ContextManager) removeOldestMessageUnit(messages []ChatMessage) []ChatMessage {
+	units := messageUnits(messages, cm.cropExchanges)
+	if len(units) <= 1 {
+		return messages
+	}
+	pinned := cm.pinnedMessages(messages)
+
+	first := 0
+	for first < len(units)-1 && unitPinned(units[first], pinned) {
+		first++
+	}
+	if first == len(units)-1 {
 		return messages
 	}
 
-	for i := 0; i < len(messages); i++ {
-		if messages[i].Role != "system" {
-			return append(messages[:i], messages[i+1:]...)
+	drop := make(map[int]struct{})
+	for k := first; k < len(units)-1; k++ {
+		if k > first && (first > 0 || cm.messageFormat != MessageFormatAnthropic || messages[units[k][0]].Role == "user" || unitPinned(units[k], pinned)) {
+			break
+		}
+		for _, idx := range units[k] {
+			drop[idx] = struct{}{}
+		}
+	}
+
+	result := make([]ChatMessage, 0, len(messages)-len(drop))
+	for i, msg := range messages {
+		if _, ok := drop[i]; !ok {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// windowKeptMessages returns the messages removeOldestMessageUnit never
+// drops: system messages, units holding a pinned message and the most
+// recent unit
+func (cm *ContextManager) windowKeptMessages(messages []ChatMessage) []ChatMessage {
+	units := messageUnits(messages, cm.cropExchanges)
+	pinned := cm.pinnedMessages(messages)
+	keep := make(map[int]bool)
+	for k, unit := range units {
+		if k == len(units)-1 || unitPinned(unit, pinned) {
+			for _, idx := range unit {
+				keep[idx] = true
+			}
+		}
+	}
+	kept := make([]ChatMessage, 0, len(keep))
+	for i, msg := range messages {
+		if msg.Role == "system" || keep[i] {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// toolUseIDs returns the ids of tool calls made by a message, either OpenAI
+// tool_calls or Anthropic tool_use blocks.
+func toolUseIDs(msg ChatMessage) []string {
+	ids := make([]string, 0, len(msg.ToolCalls))
+	for _, call := range msg.ToolCalls {
+		ids = append(ids, call.ID)
+	}
+	for _, block := range contentBlocksOfType(msg.Content, "tool_use") {
+		if id, ok := block["id"].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// toolResultIDs returns the tool call ids answered by a message, either the
+// tool_call_id of a tool message or Anthropic tool_result blocks.
+func toolResultIDs(msg ChatMessage) []string {
+	var ids []string
+	if msg.Role == "tool" {
+		ids = append(ids, msg.ToolCallID)
+	}
+	for _, block := range contentBlocksOfType(msg.Content, "tool_result") {
+		if id, ok := block["tool_use_id"].(string); ok {
+			ids = append(ids, id)
 		}
 	}
+	return ids
+}
 
-	return messages[1:]
+func contentBlocksOfType(content any, blockType string) []map[string]any {
+	parts, ok := content.([]any)
+	if !ok {
+		return nil
+	}
+	var blocks []map[string]any
+	for _, p := range parts {
+		if m, ok := p.(map[string]any); ok && m["type"] == blockType {
+			blocks = append(blocks, m)
+		}
+	}
+	return blocks
 }
 
 // truncateContent truncates content to fit token limit (keeps most recent)
@@ -353,11 +887,188 @@ func (cm *ContextManager) truncateContent(content string, maxTokens int) string
 	return strings.Join(result, "\n")
 }
 
+// ToolResultsTruncatedHeader carries the number of tool results a request
+// had cut to their head and tail
+const ToolResultsTruncatedHeader = "X-LlamaSwap-Tool-Results-Truncated"
+
+// toolResultCapHalvingStep is the number of tool results after which the
+// cap for even older results halves
+const toolResultCapHalvingStep = 4
+
+// truncateToolResults reduces old tool results longer than the configured
+// cap to their head and tail. The most recent results are left alone, and the
+// cap halves every few results further back, down to a quarter. It returns
+// the number of messages that were truncated.
+func (cm *ContextManager) truncateToolResults(messages []ChatMessage) ([]ChatMessage, int) {
+	if cm.toolResultMaxTokens <= 0 {
+		return messages, 0
+	}
+
+	result := messages
+	copied := false
+	truncated := 0
+	age := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		isToolRole := messages[i].Role == "tool"
+		if !isToolRole && len(toolResultIDs(messages[i])) == 0 {
+			continue
+		}
+		age++
+		if age <= cm.toolResultKeepRecent {
+			continue
+		}
+		limit := cm.toolResultCap(age - cm.toolResultKeepRecent - 1)
+		content, changed := mapToolResultText(messages[i].Content, isToolRole, func(text string) (string, bool) {
+			return cm.truncateHeadTail(text, limit)
+		})
+		if !changed {
+			continue
+		}
+		if !copied {
+			result = cloneMessages(messages)
+			copied = true
+		}
+		result[i].Content = content
+		truncated++
+	}
+	return result, truncated
+}
+
+// toolResultCap returns the token cap for a tool result that has age older
+// results ahead of it in the truncation window
+func (cm *ContextManager) toolResultCap(age int) int {
+	limit := cm.toolResultMaxTokens >> (age / toolResultCapHalvingStep)
+	if floor := cm.toolResultMaxTokens / 4; limit < floor {
+		limit = floor
+	}
+	return limit
+}
+
+// mapToolResultText applies fn to the text of a tool result: the content of a
+// role "tool" message or the tool_result blocks of an Anthropic user turn.
+// Other content is left alone and the input is never modified.
+func mapToolResultText(content any, isToolRole bool, fn func(text string) (string, bool)) (any, bool) {
+	mapText := func(content any) (any, bool) {
+		switch v := content.(type) {
+		case string:
+			return fn(v)
+		case []any:
+			out := make([]any, len(v))
+			changed := false
+			for i, p := range v {
+				out[i] = p
+				m, ok := p.(map[string]any)
+				if !ok || m["type"] != "text" {
+					continue
+				}
+				text, _ := m["text"].(string)
+				if mapped, ok := fn(text); ok {
+					cp := copyContentBlock(m)
+					cp["text"] = mapped
+					out[i] = cp
+					changed = true
+				}
+			}
+			return out, changed
+		default:
+			return content, false
+		}
+	}
+
+	if isToolRole {
+		return mapText(content)
+	}
+	blocks, ok := content.([]any)
+	if !ok {
+		return content, false
+	}
+	out := make([]any, len(blocks))
+	changed := false
+	for i, p := range blocks {
+		out[i] = p
+		m, ok := p.(map[string]any)
+		if !ok || m["type"] != "tool_result" {
+			continue
+		}
+		if inner, ok := mapText(m["content"]); ok {
+			cp := copyContentBlock(m)
+			cp["content"] = inner
+			out[i] = cp
+			changed = true
+		}
+	}
+	return out, changed
+}
+
+// truncateHeadTail keeps the first and last lines of text within maxTokens
+// and replaces the middle with an elision marker. Text without usable line
+// breaks, such as minified JSON, is cut by characters instead.
+func (cm *ContextManager) truncateHeadTail(text string, maxTokens int) (string, bool) {
+	total := cm.estimateTextTokens(text)
+	if maxTokens <= 0 || total <= maxTokens {
+		return text, false
+	}
+
+	lines := strings.Split(text, "\n")
+	half := maxTokens / 2
+	head, used := 0, 0
+	for head < len(lines) {
+		lineTokens := cm.estimateTextTokens(lines[head]) + 1
+		if used+lineTokens > half {
+			break
+		}
+		used += lineTokens
+		head++
+	}
+	tail := 0
+	used = 0
+	for tail < len(lines)-head {
+		lineTokens := cm.estimateTextTokens(lines[len(lines)-1-tail]) + 1
+		if used+lineTokens > half {
+			break
+		}
+		used += lineTokens
+		tail++
+	}
+
+	if head == 0 && tail == 0 {
+		runes := []rune(text)
+		keep := half * 4 // ~4 characters per token
+		if 2*keep >= len(runes) {
+			return text, false
+		}
+		return fmt.Sprintf("%s\n[... %d characters omitted ...]\n%s",
+			string(runes[:keep]), len(runes)-2*keep, string(runes[len(runes)-keep:])), true
+	}
+
+	omitted := lines[head : len(lines)-tail]
+	marker := fmt.Sprintf("[... %d line(s), ~%d tokens omitted ...]", len(omitted), cm.estimateTextTokens(strings.Join(omitted, "\n")))
+	kept := make([]string, 0, head+tail+1)
+	kept = append(kept, lines[:head]...)
+	kept = append(kept, marker)
+	kept = append(kept, lines[len(lines)-tail:]...)
+	return strings.Join(kept, "\n"), true
+}
+
+// estimateTextTokens estimates tokens in tool output. Such output is often
+// dense (JSON, paths, code), so a size based estimate of ~4 bytes per token
+// is used when it is higher than the word based one.
+func (cm *ContextManager) estimateTextTokens(text string) int {
+	tokens := cm.estimateLineTokens(text)
+	if bySize := len(text) / 4; bySize > tokens {
+		return bySize
+	}
+	return tokens
+}
+
 // estimateMessagesTokens estimates tokens in messages
 func (cm *ContextManager) estimateMessagesTokens(messages []ChatMessage) int {
 	total := 0
 	for _, msg := range messages {
 		total += cm.estimateLineTokens(chatContentToText(msg.Content))
+		for _, part := range imageParts(msg.Content) {
+			total += cm.imageTokenCost(part)
+		}
 		if msg.Name != "" {
 			total += len(strings.Fields(msg.Name)) * 13 / 10
 		}
@@ -368,12 +1079,25 @@ func (cm *ContextManager) estimateMessagesTokens(messages []ChatMessage) int {
 	return total + len(messages)*2 // Add overhead for message structure
 }
 
+// estimateToolsTokens estimates tokens used by tool definitions. JSON has few
+// spaces so it is counted by size (~4 bytes per token) instead of words.
+func (cm *ContextManager) estimateToolsTokens(tools []ToolSchema) int {
+	if len(tools) == 0 {
+		return 0
+	}
+	encoded, err := json.Marshal(tools)
+	if err != nil {
+		return 0
+	}
+	return len(encoded) / 4
+}
+
 // estimateLineTokens estimates tokens in a single line of text
 func (cm *ContextManager) estimateLineTokens(line string) int {
 	if line == "" {
 		return 0
 	}
-	return len(strings.Fields(line)) * 13 / 10 // Rough approximation: ~1.3 tokens per word
+	return cm.estimateWordTokens(line)
 }
 
 func cloneMessages(messages []ChatMessage) []ChatMessage {
@@ -422,7 +1146,9 @@ func (cm *ContextManager) compactRepeatedMessages(messages []ChatMessage) []Chat
 		}
 
 		signature := msg.Role + "|" + normalizeMessageContent(chatContentToText(msg.Content))
-		if _, found := seen[signature]; found {
+		// dropping either side of a tool call would orphan the other side
+		linked := len(toolUseIDs(msg)) > 0 || len(toolResultIDs(msg)) > 0
+		if _, found := seen[signature]; found && !linked {
 			continue
 		}
 
@@ -498,6 +1224,22 @@ type CropResult struct {
 	Tools            []ToolSchema  `json:"tools,omitempty"`
 	OriginalMessages []ChatMessage `json:"-"`
 	OriginalTools    []ToolSchema  `json:"-"`
+	// ToolsStripped is set when tool descriptions and schema docs were cut
+	ToolsStripped bool `json:"-"`
+	// PrunedTools names the tool definitions that were dropped
+	PrunedTools []string `json:"prunedTools,omitempty"`
+	// DedupedBlocks counts repeated blocks replaced with a reference
+	DedupedBlocks int `json:"dedupedBlocks,omitempty"`
+	// OmittedImages counts images replaced with "[image omitted]"
+	OmittedImages int `json:"omittedImages,omitempty"`
+	// TokensBefore and TokensAfter are the prompt sizes counted on the way
+	TokensBefore int `json:"-"`
+	TokensAfter  int `json:"-"`
+}
+
+// ToolsChanged returns true if the tool budget stage rewrote the tools
+func (cr CropResult) ToolsChanged() bool {
+	return cr.ToolsStripped || len(cr.PrunedTools) > 0
 }
 
 // IsCropped returns true if the request was actually cropped
@@ -541,8 +1283,19 @@ func chatContentToText(content any) string {
 						parts = append(parts, txt)
 					}
 				}
-			case "image_url":
+			case "image_url", "image":
 				parts = append(parts, "[image]")
+			case "thinking":
+				if txt, ok := m["thinking"].(string); ok && strings.TrimSpace(txt) != "" {
+					parts = append(parts, strings.TrimSpace(txt))
+				}
+			case "tool_use":
+				input, _ := json.Marshal(m["input"])
+				parts = append(parts, fmt.Sprintf("[tool_use %v] %s", m["name"], input))
+			case "tool_result":
+				if txt := chatContentToText(m["content"]); txt != "" {
+					parts = append(parts, txt)
+				}
 			}
 		}
 		return strings.Join(parts, "\n")
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// MessageFormat identifies the wire format of the messages being optimized
+type MessageFormat string
+
+const (
+	// MessageFormatOpenAI is the /v1/chat/completions messages array
+	MessageFormatOpenAI MessageFormat = "openai"
+	// MessageFormatAnthropic is the /v1/messages array with content blocks
+	MessageFormatAnthropic MessageFormat = "anthropic"
+)
+
+// anthropicMessagesRequest is the part of an Anthropic /v1/messages request
+// the optimizer looks at. Message content is kept as raw content blocks.
+type anthropicMessagesRequest struct {
+	Model      string          `json:"model"`
+	System     any             `json:"system,omitempty"`
+	Messages   []ChatMessage   `json:"messages"`
+	MaxTokens  int             `json:"max_tokens,omitempty"`
+	Tools      []anthropicTool `json:"tools,omitempty"`
+	ToolChoice any             `json:"tool_choice,omitempty"`
+}
+
+type anthropicTool struct {
+	Type        string `json:"type,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema,omitempty"`
+}
+
+// parseAnthropicChatRequest maps an Anthropic request onto ChatRequest so it
+// can be budgeted like a chat completion: the top-level system prompt becomes
+// a leading system message and tool definitions become function schemas.
+func parseAnthropicChatRequest(body []byte) (ChatRequest, error) {
+	var req anthropicMessagesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ChatRequest{}, err
+	}
+
+	chatReq := ChatRequest{
+		Model:      req.Model,
+		MaxTokens:  req.MaxTokens,
+		Messages:   make([]ChatMessage, 0, len(req.Messages)+1),
+		ToolChoice: req.ToolChoice,
+	}
+	if chatContentToText(req.System) != "" {
+		chatReq.Messages = append(chatReq.Messages, ChatMessage{Role: "system", Content: req.System})
+	}
+	chatReq.Messages = append(chatReq.Messages, req.Messages...)
+
+	for _, tool := range req.Tools {
+		chatReq.Tools = append(chatReq.Tools, ToolSchema{
+			Type: "function",
+			Function: FunctionDef{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	return chatReq, nil
+}
+
+// writeAnthropicChatRequest patches optimized messages back into an Anthropic
+// request. Leading system messages are folded into the top-level system
+// field, everything else is written to messages. Tools are left to
+// writeToolPruning.
+func writeAnthropicChatRequest(body []byte, messages []ChatMessage) ([]byte, error) {
+	split := 0
+	for split < len(messages) && messages[split].Role == "system" {
+		split++
+	}
+
+	var err error
+	switch system := mergeAnthropicSystem(messages[:split]); {
+	case system != nil:
+		body, err = sjson.SetBytes(body, "system", system)
+	case gjson.GetBytes(body, "system").Exists():
+		body, err = sjson.DeleteBytes(body, "system")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update system prompt: %w", err)
+	}
+
+	rest := messages[split:]
+	if rest == nil {
+		rest = []ChatMessage{}
+	}
+	return sjson.SetBytes(body, "messages", rest)
+}
+
+// mergeAnthropicSystem joins system messages into a single system value. A
+// lone message keeps its original shape, several plain strings are joined
+// and anything else becomes a list of text blocks.
+func mergeAnthropicSystem(systemMessages []ChatMessage) any {
+	switch len(systemMessages) {
+	case 0:
+		return nil
+	case 1:
+		return systemMessages[0].Content
+	}
+
+	allStrings := true
+	for _, msg := range systemMessages {
+		if _, ok := msg.Content.(string); !ok {
+			allStrings = false
+			break
+		}
+	}
+	if allStrings {
+		parts := make([]string, 0, len(systemMessages))
+		for _, msg := range systemMessages {
+			parts = append(parts, msg.Content.(string))
+		}
+		return strings.Join(parts, "\n\n")
+	}
+
+	blocks := make([]any, 0, len(systemMessages))
+	for _, msg := range systemMessages {
+		switch v := msg.Content.(type) {
+		case []any:
+			blocks = append(blocks, v...)
+		default:
+			if text := chatContentToText(v); text != "" {
+				blocks = append(blocks, map[string]any{"type": "text", "text": text})
+			}
+		}
+	}
+	return blocks
+}
+
+// compactAnthropicMessages collapses repeated lines inside text and
+// tool_result blocks. Unlike the OpenAI compaction no message is removed, so
+// role alternation and tool_use/tool_result pairs stay intact.
+func compactAnthropicMessages(messages []ChatMessage) []ChatMessage {
+	result := cloneMessages(messages)
+	for i := range result {
+		if result[i].Role == "system" {
+			continue
+		}
+		result[i].Content = compactContentBlocks(result[i].Content)
+	}
+	return result
+}
+
+func compactContentBlocks(content any) any {
+	switch v := content.(type) {
+	case string:
+		return compactRepeatedLines(v)
+	case []any:
+		out := make([]any, 0, len(v))
+		for _, p := range v {
+			m, ok := p.(map[string]any)
+			if !ok {
+				out = append(out, p)
+				continue
+			}
+			switch m["type"] {
+			case "text":
+				if text, ok := m["text"].(string); ok {
+					cp := copyContentBlock(m)
+					cp["text"] = compactRepeatedLines(text)
+					out = append(out, cp)
+					continue
+				}
+			case "tool_result":
+				if inner, ok := m["content"]; ok && inner != nil {
+					cp := copyContentBlock(m)
+					cp["content"] = compactContentBlocks(inner)
+					out = append(out, cp)
+					continue
+				}
+			}
+			out = append(out, m)
+		}
+		return out
+	default:
+		return content
+	}
+}
+
+func copyContentBlock(m map[string]any) map[string]any {
+	cp := make(map[string]any, len(m))
+	for k, val := range m {
+		cp[k] = val
+	}
+	return cp
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+const (
+	// blockDedupWindowLines is the number of lines hashed together when
+	// looking for repeated blocks. Shorter repeats are never replaced.
+	blockDedupWindowLines = 6
+	// blockDedupMinChars is the smallest block worth replacing with a
+	// reference
+	blockDedupMinChars = 400
+	// blockDedupHashBase is the multiplier of the rolling window hash
+	blockDedupHashBase = 1099511628211
+)
+
+// blockRef locates a window of lines in a message seen earlier in the scan
+type blockRef struct {
+	lines []string
+	start int
+	label string
+}
+
+// replacedBlock is a block dedupeRepeatedBlocks replaced with a reference,
+// kept so the block can be put back when the copy it refers to is gone
+type replacedBlock struct {
+	label string
+	lines []string
+}
+
+// dedupeRepeatedBlocks replaces blocks of text in old tool results that
+// appear again later in the conversation, such as a file read twice, with a
+// short reference to the most recent copy. Blocks are found with a rolling
+// hash over windows of lines. Only tool results are rewritten and the last
+// message is never touched, but any message can hold the copy that is kept.
+// A message is only rewritten once, later passes just look up its blocks.
+// It returns the number of blocks replaced.
+func dedupeRepeatedBlocks(messages []ChatMessage) ([]ChatMessage, int) {
+	if len(messages) < 2 {
+		return messages, 0
+	}
+	labels := blockDedupLabels(messages)
+	index := make(map[uint64]blockRef)
+
+	var result []ChatMessage
+	replaced := 0
+	lastIndex := len(messages) - 1
+	for i := lastIndex; i >= 0; i-- {
+		msg := messages[i]
+		if msg.Role == "system" {
+			continue
+		}
+		isToolRole := msg.Role == "tool"
+		if i == lastIndex || len(msg.replacedBlocks) > 0 || (!isToolRole && len(toolResultIDs(msg)) == 0) {
+			for _, text := range chatContentTexts(msg.Content) {
+				indexBlocks(splitBlockLines(text), index, labels[i])
+			}
+			continue
+		}
+
+		var blocks []replacedBlock
+		content, changed := mapToolResultText(msg.Content, isToolRole, func(text string) (string, bool) {
+			lines := splitBlockLines(text)
+			deduped, replacedHere := replaceKnownBlocks(lines, index)
+			indexBlocks(lines, index, labels[i])
+			if len(replacedHere) == 0 {
+				return text, false
+			}
+			blocks = append(blocks, replacedHere...)
+			return strings.Join(deduped, "\n"), true
+		})
+		if !changed {
+			continue
+		}
+		if result == nil {
+			result = cloneMessages(messages)
+		}
+		result[i].Content = content
+		result[i].replacedBlocks = blocks
+		replaced += len(blocks)
+	}
+	if result == nil {
+		return messages, 0
+	}
+	return result, replaced
+}
+
+// blockDedupLabels names each message the way a reference to it reads.
+// Labels stay the same when other messages are dropped: tool results are
+// named by their tool call id, everything else by its position in the
+// incoming request.
+func blockDedupLabels(messages []ChatMessage) []string {
+	labels := make([]string, len(messages))
+	for i, msg := range messages {
+		if ids := toolResultIDs(msg); len(ids) == 1 && ids[0] != "" {
+			labels[i] = "tool result " + ids[0]
+			continue
+		}
+		position := i + 1
+		if msg.origin > 0 {
+			position = msg.origin
+		}
+		labels[i] = fmt.Sprintf("message #%d", position)
+	}
+	return labels
+}
+
+func blockReferenceLine(label string) string {
+	return fmt.Sprintf("[content identical to %s]", label)
+}
+
+// resolveBlockReferences puts back replaced blocks whose copy is no longer
+// in the message the reference names, e.g. because the sliding window
+// dropped that message. It returns the number of blocks put back.
+func resolveBlockReferences(messages []ChatMessage) ([]ChatMessage, int) {
+	var texts map[string]string
+	var result []ChatMessage
+	restored := 0
+	for i, msg := range messages {
+		if len(msg.replacedBlocks) == 0 {
+			continue
+		}
+		if texts == nil {
+			texts = make(map[string]string, len(messages))
+			for k, label := range blockDedupLabels(messages) {
+				texts[label] = strings.Join(chatContentTexts(messages[k].Content), "\n")
+			}
+		}
+		missing := make([]bool, len(msg.replacedBlocks))
+		var kept []replacedBlock
+		for k, block := range msg.replacedBlocks {
+			missing[k] = !strings.Contains(texts[block.label], strings.Join(block.lines, "\n"))
+			if !missing[k] {
+				kept = append(kept, block)
+			}
+		}
+		if len(kept) == len(msg.replacedBlocks) {
+			continue
+		}
+
+		// references appear in the order they were recorded
+		next := 0
+		content, _ := mapToolResultText(msg.Content, msg.Role == "tool", func(text string) (string, bool) {
+			lines := splitBlockLines(text)
+			out := make([]string, 0, len(lines))
+			changed := false
+			for _, line := range lines {
+				if next < len(msg.replacedBlocks) && line == blockReferenceLine(msg.replacedBlocks[next].label) {
+					if missing[next] {
+						out = append(out, msg.replacedBlocks[next].lines...)
+						changed = true
+						restored++
+					} else {
+						out = append(out, line)
+					}
+					next++
+					continue
+				}
+				out = append(out, line)
+			}
+			if !changed {
+				return text, false
+			}
+			return strings.Join(out, "\n"), true
+		})
+		if result == nil {
+			result = cloneMessages(messages)
+		}
+		result[i].Content = content
+		result[i].replacedBlocks = kept
+	}
+	if result == nil {
+		return messages, 0
+	}
+	return result, restored
+}
+
+// chatContentTexts returns every text of a message, including the text
+// inside Anthropic tool_result blocks
+func chatContentTexts(content any) []string {
+	switch v := content.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var texts []string
+		for _, p := range v {
+			m, ok := p.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch m["type"] {
+			case "text":
+				if text, ok := m["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			case "tool_result":
+				texts = append(texts, chatContentTexts(m["content"])...)
+			}
+		}
+		return texts
+	default:
+		return nil
+	}
+}
+
+func splitBlockLines(text string) []string {
+	return strings.Split(text, "\n")
+}
+
+// blockWindowHashes returns the rolling hash of every window of
+// blockDedupWindowLines lines. Trailing whitespace does not count.
+func blockWindowHashes(lines []string) []uint64 {
+	if len(lines) < blockDedupWindowLines {
+		return nil
+	}
+	lineHashes := make([]uint64, len(lines))
+	for i, line := range lines {
+		h := fnv.New64a()
+		h.Write([]byte(strings.TrimRight(line, " \t\r")))
+		lineHashes[i] = h.Sum64()
+	}
+
+	// weight of the line leaving the window
+	var outWeight uint64 = 1
+	for i := 1; i < blockDedupWindowLines; i++ {
+		outWeight *= blockDedupHashBase
+	}
+	hashes := make([]uint64, 0, len(lines)-blockDedupWindowLines+1)
+	var h uint64
+	for i, lh := range lineHashes {
+		if i >= blockDedupWindowLines {
+			h -= lineHashes[i-blockDedupWindowLines] * outWeight
+		}
+		h = h*blockDedupHashBase + lh
+		if i >= blockDedupWindowLines-1 {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+// indexBlocks records the windows of lines so older messages can refer to
+// them. Windows already indexed keep their reference to the newer copy.
+func indexBlocks(lines []string, index map[uint64]blockRef, label string) {
+	for start, h := range blockWindowHashes(lines) {
+		if _, ok := index[h]; !ok {
+			index[h] = blockRef{lines: lines, start: start, label: label}
+		}
+	}
+}
+
+// replaceKnownBlocks replaces runs of lines found in index with a reference
+// line and returns the replaced runs. Runs shorter than blockDedupMinChars
+// are kept.
+func replaceKnownBlocks(lines []string, index map[uint64]blockRef) ([]string, []replacedBlock) {
+	hashes := blockWindowHashes(lines)
+	if len(hashes) == 0 {
+		return lines, nil
+	}
+
+	// refs[k] is set when the window starting at line k repeats a known block
+	refs := make([]*blockRef, len(hashes))
+	for k, h := range hashes {
+		ref, ok := index[h]
+		if ok && sameBlockLines(lines[k:k+blockDedupWindowLines], ref.lines[ref.start:ref.start+blockDedupWindowLines]) {
+			refs[k] = &ref
+		}
+	}
+
+	var out []string
+	var replaced []replacedBlock
+	next := 0
+	for k := 0; k < len(refs); {
+		if refs[k] == nil {
+			k++
+			continue
+		}
+		end := k
+		for end+1 < len(refs) && refs[end+1] != nil {
+			end++
+		}
+		runStart, runEnd := max(k, next), end+blockDedupWindowLines
+		if blockChars(lines[runStart:runEnd]) >= blockDedupMinChars {
+			out = append(out, lines[next:runStart]...)
+			out = append(out, blockReferenceLine(refs[k].label))
+			replaced = append(replaced, replacedBlock{label: refs[k].label, lines: lines[runStart:runEnd]})
+			next = runEnd
+		}
+		k = end + 1
+	}
+	if len(replaced) == 0 {
+		return lines, nil
+	}
+	return append(out, lines[next:]...), replaced
+}
+
+func sameBlockLines(a, b []string) bool {
+	for i := range a {
+		if strings.TrimRight(a[i], " \t\r") != strings.TrimRight(b[i], " \t\r") {
+			return false
+		}
+	}
+	return true
+}
+
+func blockChars(lines []string) int {
+	n := 0
+	for _, line := range lines {
+		n += len(strings.TrimSpace(line))
+	}
+	return n
+}
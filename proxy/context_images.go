@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+)
+
+// omittedImageText replaces images dropped to fit the context
+const omittedImageText = "[image omitted]"
+
+// imageParts returns the image parts of a message: OpenAI image_url parts
+// and Anthropic image blocks, including those inside tool_result blocks
+func imageParts(content any) []map[string]any {
+	parts, ok := content.([]any)
+	if !ok {
+		return nil
+	}
+	var images []map[string]any
+	for _, p := range parts {
+		m, ok := p.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch m["type"] {
+		case "image_url", "image":
+			images = append(images, m)
+		case "tool_result":
+			images = append(images, imageParts(m["content"])...)
+		}
+	}
+	return images
+}
+
+// imageData returns the base64 payload of an inline image, or "" for images
+// passed by URL
+func imageData(part map[string]any) string {
+	if source, ok := part["source"].(map[string]any); ok {
+		// Anthropic {"type":"image","source":{"type":"base64","data":...}}
+		if source["type"] == "base64" {
+			data, _ := source["data"].(string)
+			return data
+		}
+		return ""
+	}
+
+	var url string
+	switch v := part["image_url"].(type) {
+	case string:
+		url = v
+	case map[string]any:
+		url, _ = v["url"].(string)
+	}
+	if !strings.HasPrefix(url, "data:") {
+		return ""
+	}
+	_, data, found := strings.Cut(url, ";base64,")
+	if !found {
+		return ""
+	}
+	return data
+}
+
+// imageDimensions decodes just enough of an inline PNG, JPEG or GIF to learn
+// its size
+func imageDimensions(data string) (int, int, bool) {
+	if data == "" {
+		return 0, 0, false
+	}
+	cfg, _, err := image.DecodeConfig(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// imageTokenCost estimates the prompt tokens of one image. With a per-tile
+// cost configured, inline images are split into tiles of imageTileSize
+// pixels; other images cost the fixed imageTokens.
+func (cm *ContextManager) imageTokenCost(part map[string]any) int {
+	if cm.imageTileTokens > 0 && cm.imageTileSize > 0 {
+		if width, height, ok := imageDimensions(imageData(part)); ok {
+			tilesX := (width + cm.imageTileSize - 1) / cm.imageTileSize
+			tilesY := (height + cm.imageTileSize - 1) / cm.imageTileSize
+			return tilesX * tilesY * cm.imageTileTokens
+		}
+	}
+	return cm.imageTokens
+}
+
+// estimateImageTokens sums the image cost of messages. /tokenize and the
+// word based estimate only see text, so this is added to both.
+func (cm *ContextManager) estimateImageTokens(messages []ChatMessage) int {
+	total := 0
+	for _, msg := range messages {
+		for _, part := range imageParts(msg.Content) {
+			total += cm.imageTokenCost(part)
+		}
+	}
+	return total
+}
+
+// omitOldImages replaces images with an "[image omitted]" text part, oldest
+// first, until the messages fit maxTokens. Images are cheaper to lose than
+// whole messages, so this runs before the sliding window drops anything.
+// The last message keeps its images. It returns the number of images
+// replaced.
+func (cm *ContextManager) omitOldImages(messages []ChatMessage, tools []ToolSchema, maxTokens int) ([]ChatMessage, int) {
+	if maxTokens <= 0 || len(messages) < 2 {
+		return messages, 0
+	}
+	excess := cm.estimateMessagesTokens(messages) + cm.estimateToolsTokens(tools) - maxTokens
+	if excess <= 0 {
+		return messages, 0
+	}
+
+	result := messages
+	copied := false
+	omitted := 0
+	for i := 0; i < len(messages)-1 && excess > 0; i++ {
+		if len(imageParts(messages[i].Content)) == 0 {
+			continue
+		}
+		content, saved, count := cm.omitImagesInContent(messages[i].Content, &excess)
+		if count == 0 {
+			continue
+		}
+		if !copied {
+			result = cloneMessages(messages)
+			copied = true
+		}
+		result[i].Content = content
+		omitted += count
+		cm.proxyLogger.Debugf("<%s> Omitted %d image(s) from message %d, ~%d tokens", cm.modelID, count, i, saved)
+	}
+	return result, omitted
+}
+
+// omitImagesInContent replaces image parts while excess tokens remain and
+// returns the new content, the tokens saved and the number of images
+// replaced
+func (cm *ContextManager) omitImagesInContent(content any, excess *int) (any, int, int) {
+	parts, ok := content.([]any)
+	if !ok {
+		return content, 0, 0
+	}
+	out := make([]any, 0, len(parts))
+	saved, count := 0, 0
+	for _, p := range parts {
+		m, ok := p.(map[string]any)
+		if !ok || *excess <= 0 {
+			out = append(out, p)
+			continue
+		}
+		switch m["type"] {
+		case "image_url", "image":
+			cost := cm.imageTokenCost(m)
+			*excess -= cost
+			saved += cost
+			count++
+			out = append(out, map[string]any{"type": "text", "text": omittedImageText})
+			continue
+		case "tool_result":
+			if inner, innerSaved, innerCount := cm.omitImagesInContent(m["content"], excess); innerCount > 0 {
+				cp := copyContentBlock(m)
+				cp["content"] = inner
+				out = append(out, cp)
+				saved += innerSaved
+				count += innerCount
+				continue
+			}
+		}
+		out = append(out, m)
+	}
+	if count == 0 {
+		return content, 0, 0
+	}
+	return out, saved, count
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// MaxTokensClampedHeader carries the output limit a request was clamped to
+// when clampMaxTokens is enabled for its model
+const MaxTokensClampedHeader = "X-LlamaSwap-Max-Tokens-Clamped"
+
+// outputTokenFields are the request fields that limit the completion length
+var outputTokenFields = []string{"max_tokens", "max_completion_tokens"}
+
+// requestedOutputTokens returns the largest output limit a request asks for,
+// or 0 when it sets none
+func requestedOutputTokens(body []byte) int {
+	requested := 0
+	for _, field := range outputTokenFields {
+		if value := int(gjson.GetBytes(body, field).Int()); value > requested {
+			requested = value
+		}
+	}
+	return requested
+}
+
+// clampOutputTokens returns the output limit to send for a prompt of
+// promptTokens. When clamping is enabled and the requested limit does not fit
+// next to the prompt, it is lowered to what is left of the context, but not
+// below minOutputTokens; the prompt is then cropped to make room for that.
+func (cm *ContextManager) clampOutputTokens(requested int, promptTokens int) int {
+	if !cm.clampMaxTokens || requested <= 0 || cm.ctxSize <= 0 {
+		return requested
+	}
+	available := cm.ctxSize - cm.safetyMargin - promptTokens
+	if requested <= available {
+		return requested
+	}
+
+	clamped := max(available, cm.minOutputTokens)
+	// leave room for at least some prompt
+	clamped = min(clamped, requested, cm.ctxSize-cm.safetyMargin-1)
+	if clamped <= 0 {
+		return requested
+	}
+	return clamped
+}
+
+// clampRequestMaxTokens writes a clamped output limit into every limit field
+// the request sets and records it in the result
+func clampRequestMaxTokens(opt *promptOptimization, requested int, clamped int) error {
+	body := opt.body
+	for _, field := range outputTokenFields {
+		if !gjson.GetBytes(body, field).Exists() {
+			continue
+		}
+		var err error
+		if body, err = sjson.SetBytes(body, field, clamped); err != nil {
+			return fmt.Errorf("failed to clamp %s: %w", field, err)
+		}
+	}
+	opt.body = body
+	opt.result.ClampedMaxTokens = clamped
+	opt.result.addStep(fmt.Sprintf("clamped max_tokens %d -> %d", requested, clamped))
+	return nil
+}
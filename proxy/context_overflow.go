@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// ContextOverflowRetryHeader is set on responses that were produced by a
+// retry after the upstream rejected the original prompt as too long
+const ContextOverflowRetryHeader = "X-LlamaSwap-Context-Retry"
+
+// overflowRetryBudgetPercent is the share of the context size the retry
+// crops the prompt to. The first attempt already fit the estimated budget, so
+// the retry leaves room for the estimate being off.
+const overflowRetryBudgetPercent = 75
+
+// contextOverflowMarkers are lowercase fragments of the errors upstreams
+// return when a prompt does not fit their context
+var contextOverflowMarkers = []string{
+	"exceeds the available context size", // llama.cpp
+	"exceed_context_size_error",          // llama.cpp error type
+	"context_length_exceeded",            // OpenAI compatible servers
+	"maximum context length",
+	"context length exceeded",
+	"prompt is too long", // Anthropic compatible servers
+}
+
+// detectContextOverflow reports whether an upstream error response says the
+// prompt exceeded the context. nCtx is the context size the upstream reported
+// along with the error, or 0.
+func detectContextOverflow(status int, header http.Header, body []byte) (overflow bool, nCtx int) {
+	if status < http.StatusBadRequest || len(body) == 0 {
+		return false, 0
+	}
+	if encoding := header.Get("Content-Encoding"); encoding != "" {
+		decoded, err := decompressBody(body, encoding)
+		if err != nil {
+			return false, 0
+		}
+		body = decoded
+	}
+
+	lower := strings.ToLower(string(body))
+	for _, marker := range contextOverflowMarkers {
+		if strings.Contains(lower, marker) {
+			return true, int(gjson.GetBytes(body, "error.n_ctx").Int())
+		}
+	}
+	return false, 0
+}
+
+// overflowCaptureWriter holds back error responses so a context overflow can
+// be retried before anything reaches the client. Successful responses,
+// including streams, pass straight through.
+type overflowCaptureWriter struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	held   bool
+	body   bytes.Buffer
+}
+
+func newOverflowCaptureWriter(w http.ResponseWriter) *overflowCaptureWriter {
+	return &overflowCaptureWriter{ResponseWriter: w, header: make(http.Header)}
+}
+
+func (w *overflowCaptureWriter) Header() http.Header {
+	if w.status != 0 && !w.held {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *overflowCaptureWriter) WriteHeader(statusCode int) {
+	if w.status != 0 {
+		return
+	}
+	if statusCode < http.StatusOK {
+		// informational responses never carry the error
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	w.status = statusCode
+	if statusCode >= http.StatusBadRequest {
+		w.held = true
+		return
+	}
+	copyHeaders(w.ResponseWriter.Header(), w.header)
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *overflowCaptureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *overflowCaptureWriter) Flush() {
+	if w.status == 0 || w.held {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *overflowCaptureWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+// contextOverflow reports whether the held back response is a context overflow
+func (w *overflowCaptureWriter) contextOverflow() (bool, int) {
+	if !w.held {
+		return false, 0
+	}
+	return detectContextOverflow(w.status, w.header, w.body.Bytes())
+}
+
+// release sends a held back error response to the client unchanged
+func (w *overflowCaptureWriter) release() error {
+	if !w.held {
+		return nil
+	}
+	w.held = false
+	copyHeaders(w.ResponseWriter.Header(), w.header)
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.body.Bytes())
+	return err
+}
+
+func copyHeaders(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = append([]string(nil), values...)
+	}
+}
+
+// retryOnContextOverflow wraps an inference handler so a request the upstream
+// rejects for exceeding its context is compacted and sent once more. Only
+// responses that have not started are retried; a stream that already began
+// is left alone.
+func (pm *ProxyManager) retryOnContextOverflow(requestPolicy PromptOptimizationPolicy, next func(modelID string, w http.ResponseWriter, r *http.Request) error) func(modelID string, w http.ResponseWriter, r *http.Request) error {
+	return func(modelID string, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost || r.Body == nil {
+			return next(modelID, w, r)
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if !gjson.GetBytes(body, "messages").IsArray() {
+			return next(modelID, w, r)
+		}
+
+		capture := newOverflowCaptureWriter(w)
+		if err := next(modelID, capture, r); err != nil {
+			return err
+		}
+		overflow, nCtx := capture.contextOverflow()
+		if !overflow {
+			return capture.release()
+		}
+
+		retryBody, ok := pm.compactAfterContextOverflow(modelID, r.URL.Path, body, requestPolicy, nCtx)
+		if !ok {
+			pm.proxyLogger.Warnf("<%s> upstream rejected the prompt as too long and it cannot be compacted further", modelID)
+			return capture.release()
+		}
+		pm.proxyLogger.Infof("<%s> upstream rejected the prompt as too long, retrying with a compacted prompt", modelID)
+
+		w.Header().Set(ContextOverflowRetryHeader, "true")
+		w.Header().Set("X-LlamaSwap-Prompt-Optimized", "true")
+		r.Body = io.NopCloser(bytes.NewReader(retryBody))
+		r.ContentLength = int64(len(retryBody))
+		r.Header.Set("content-length", strconv.Itoa(len(retryBody)))
+		return next(modelID, w, r)
+	}
+}
+
+// compactAfterContextOverflow re-optimizes a rejected request. When the
+// context size is known the prompt is cropped to a tighter budget, otherwise
+// (or when cropping changes nothing) the policy is escalated one level where
+// the model's config allows it, or cropped to an even tighter budget. It
+// returns false when the request cannot be made any smaller.
+func (pm *ProxyManager) compactAfterContextOverflow(modelID string, requestPath string, body []byte, requestPolicy PromptOptimizationPolicy, reportedCtx int) ([]byte, bool) {
+	policy := requestPolicy
+	if policy == "" {
+		policy, _ = pm.resolvePromptOptimizationPolicy(modelID)
+	}
+	if policy == PromptOptimizationOff {
+		return nil, false
+	}
+
+	ctxSize, _ := pm.effectiveCtxSize(modelID)
+	if reportedCtx > 0 && (ctxSize <= 0 || reportedCtx < ctxSize) {
+		ctxSize = reportedCtx
+	}
+	budget := ctxSize * overflowRetryBudgetPercent / 100
+
+	attempts := make([]promptOptimizeOptions, 0, 2)
+	if budget > 0 {
+		attempts = append(attempts, promptOptimizeOptions{policy: policy, ctxSize: budget, retry: true})
+	}
+	if escalated := pm.retryEscalationPolicy(modelID, policy); escalated != "" {
+		attempts = append(attempts, promptOptimizeOptions{policy: escalated, ctxSize: budget, retry: true})
+	} else if budget > 0 {
+		// without an allowed escalation the same policy gets a tighter budget
+		attempts = append(attempts, promptOptimizeOptions{policy: policy, ctxSize: budget * overflowRetryBudgetPercent / 100, retry: true})
+	}
+
+	for _, opts := range attempts {
+		opt, err := pm.optimizePrompt(modelID, requestPath, body, opts)
+		if err != nil {
+			pm.proxyLogger.Warnf("<%s> could not compact prompt for retry: %v", modelID, err)
+			continue
+		}
+		if !opt.evaluated || !opt.result.Applied || bytes.Equal(opt.body, body) {
+			continue
+		}
+		opt.result.Note = "retried after context overflow: " + opt.result.Note
+		pm.savePromptOptimizationSnapshot(modelID, opt.result, body, opt.body)
+		pm.recordPromptOptimizationHistory(modelID, opt)
+		return opt.body, true
+	}
+	return nil, false
+}
+
+// retryEscalationPolicy returns the policy a retry may escalate to: the next
+// more aggressive one, if the model's allowedOverrides permit it. llm_assisted
+// also needs a configured summarizer, the retry never adds a summary
+// inference on the model itself. It returns "" when there is none.
+func (pm *ProxyManager) retryEscalationPolicy(modelID string, policy PromptOptimizationPolicy) PromptOptimizationPolicy {
+	escalated := escalatePromptOptimizationPolicy(policy)
+	if escalated == "" || !pm.config.Models[modelID].PromptOptimization.AllowsOverride(string(escalated)) {
+		return ""
+	}
+	if escalated == PromptOptimizationLLMAssist && pm.summarizerModelFor(modelID) == modelID {
+		return ""
+	}
+	return escalated
+}
+
+// escalatePromptOptimizationPolicy returns the next more aggressive policy,
+// or "" when there is none
+func escalatePromptOptimizationPolicy(policy PromptOptimizationPolicy) PromptOptimizationPolicy {
+	switch policy {
+	case PromptOptimizationLimitOnly:
+		return PromptOptimizationAlways
+	case PromptOptimizationAlways:
+		return PromptOptimizationLLMAssist
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestDetectContextOverflow(t *testing.T) {
+	llamaErr := `{"error":{"code":400,"message":"the request exceeds the available context size, try increasing it","type":"exceed_context_size_error","n_prompt_tokens":9000,"n_ctx":8192}}`
+	overflow, nCtx := detectContextOverflow(http.StatusBadRequest, http.Header{}, []byte(llamaErr))
+	assert.True(t, overflow)
+	assert.Equal(t, 8192, nCtx)
+
+	overflow, nCtx = detectContextOverflow(http.StatusBadRequest, http.Header{}, []byte(`{"error":{"code":"context_length_exceeded"}}`))
+	assert.True(t, overflow)
+	assert.Equal(t, 0, nCtx)
+
+	overflow, _ = detectContextOverflow(http.StatusInternalServerError, http.Header{}, []byte(`{"error":"model crashed"}`))
+	assert.False(t, overflow)
+
+	// success responses are never overflows, whatever they say
+	overflow, _ = detectContextOverflow(http.StatusOK, http.Header{}, []byte(`prompt is too long`))
+	assert.False(t, overflow)
+}
+
+func TestProxyManager_ContextOverflowRetry(t *testing.T) {
+	var mu sync.Mutex
+	var received []int
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		messages := len(gjson.GetBytes(body, "messages").Array())
+		mu.Lock()
+		received = append(received, messages)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case gjson.GetBytes(body, "x_fail").Bool():
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"model crashed"}`))
+		case messages > 10:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":400,"message":"the request exceeds the available context size","type":"exceed_context_size_error","n_ctx":2048}}`))
+		default:
+			w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":100,"completion_tokens":1}}`))
+		}
+	}))
+	defer peerServer.Close()
+
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(fmt.Sprintf(`
+logLevel: error
+peers:
+  test-peer:
+    proxy: %s
+    models:
+      - peer-model
+`, peerServer.URL)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	messages := []map[string]string{{"role": "system", "content": "You are helpful."}}
+	for i := 0; i < 20; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		messages = append(messages, map[string]string{"role": role, "content": strings.Repeat(fmt.Sprintf("turn %d ", i), 100)})
+	}
+	sendRequest := func(extra map[string]any) *TestResponseRecorder {
+		req := map[string]any{"model": "peer-model", "messages": messages, "max_tokens": 64}
+		for k, v := range extra {
+			req[k] = v
+		}
+		body, _ := json.Marshal(req)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(body)))
+		return w
+	}
+
+	w := sendRequest(nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get(ContextOverflowRetryHeader))
+	assert.Contains(t, w.Body.String(), `"content":"ok"`)
+	if assert.Len(t, received, 2) {
+		assert.Equal(t, 21, received[0])
+		assert.LessOrEqual(t, received[1], 10)
+	}
+
+	snapshot, ok := proxy.latestPromptOptimizations["peer-model"]
+	if assert.True(t, ok) {
+		assert.True(t, snapshot.Retried)
+		assert.True(t, strings.HasPrefix(snapshot.Note, "retried after context overflow"))
+	}
+	metrics := proxy.metricsMonitor.getMetrics()
+	if assert.NotEmpty(t, metrics) {
+		assert.True(t, metrics[len(metrics)-1].ContextRetried)
+	}
+
+	// other errors are relayed as they are, without a retry
+	received = nil
+	w = sendRequest(map[string]any{"x_fail": true})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, `{"error":"model crashed"}`, w.Body.String())
+	assert.Empty(t, w.Header().Get(ContextOverflowRetryHeader))
+	assert.Len(t, received, 1)
+
+	// with optimization off the overflow reaches the client
+	received = nil
+	proxy.Lock()
+	proxy.promptPolicies["peer-model"] = PromptOptimizationOff
+	proxy.Unlock()
+	w = sendRequest(nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "exceed_context_size_error")
+	assert.Len(t, received, 1)
+}
+
+func TestProxyManager_RetryEscalationPolicy(t *testing.T) {
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(`
+logLevel: error
+models:
+  open:
+    cmd: echo
+    proxy: http://127.0.0.1:1
+  restricted:
+    cmd: echo
+    proxy: http://127.0.0.1:1
+    promptOptimization:
+      allowedOverrides: [limit_only, always]
+  summarized:
+    cmd: echo
+    proxy: http://127.0.0.1:1
+    promptOptimization:
+      summarizerModel: open
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	assert.Equal(t, PromptOptimizationAlways, proxy.retryEscalationPolicy("open", PromptOptimizationLimitOnly))
+	// llm_assisted would summarize with the model itself
+	assert.Equal(t, PromptOptimizationPolicy(""), proxy.retryEscalationPolicy("open", PromptOptimizationAlways))
+	assert.Equal(t, PromptOptimizationLLMAssist, proxy.retryEscalationPolicy("summarized", PromptOptimizationAlways))
+	assert.Equal(t, PromptOptimizationAlways, proxy.retryEscalationPolicy("restricted", PromptOptimizationLimitOnly))
+	assert.Equal(t, PromptOptimizationPolicy(""), proxy.retryEscalationPolicy("restricted", PromptOptimizationAlways))
+	assert.Equal(t, PromptOptimizationPolicy(""), proxy.retryEscalationPolicy("open", PromptOptimizationLLMAssist))
+}
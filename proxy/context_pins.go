@@ -0,0 +1,62 @@
+package proxy
+
+import "regexp"
+
+// hasPinRules reports whether any retention rule is configured
+func (cm *ContextManager) hasPinRules() bool {
+	return cm.pinFirstUserMessages > 0 || len(cm.pinPatterns) > 0 || cm.pinLastExchanges > 0
+}
+
+// pinnedMessages returns the indexes of messages the sliding window must keep:
+// the first pinFirstUserMessages user messages, messages whose text matches a
+// pin pattern and the last pinLastExchanges exchanges. Anthropic user turns
+// that only carry tool results do not count as user messages.
+func (cm *ContextManager) pinnedMessages(messages []ChatMessage) map[int]bool {
+	pinned := make(map[int]bool)
+	if !cm.hasPinRules() {
+		return pinned
+	}
+
+	userMessages := 0
+	for i, msg := range messages {
+		if cm.pinFirstUserMessages > 0 && msg.Role == "user" && len(toolResultIDs(msg)) == 0 {
+			userMessages++
+			if userMessages <= cm.pinFirstUserMessages {
+				pinned[i] = true
+			}
+		}
+		if len(cm.pinPatterns) > 0 && matchesAnyPattern(chatContentToText(msg.Content), cm.pinPatterns) {
+			pinned[i] = true
+		}
+	}
+
+	if cm.pinLastExchanges > 0 {
+		exchanges := messageUnits(messages, true)
+		for k := max(0, len(exchanges)-cm.pinLastExchanges); k < len(exchanges); k++ {
+			for _, idx := range exchanges[k] {
+				pinned[idx] = true
+			}
+		}
+	}
+	return pinned
+}
+
+func matchesAnyPattern(text string, patterns []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// unitPinned reports whether a unit holds a pinned message. A unit is dropped
+// as a whole, so one pinned message keeps all of it.
+func unitPinned(unit messageUnit, pinned map[int]bool) bool {
+	for _, idx := range unit {
+		if pinned[idx] {
+			return true
+		}
+	}
+	return false
+}
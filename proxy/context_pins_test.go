@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func pinTestConversation() []ChatMessage {
+	return []ChatMessage{
+		{Role: "system", Content: "sys"},
+		{Role: "user", Content: "task"},
+		{Role: "assistant", Content: "a1"},
+		{Role: "user", Content: "IMPORTANT: never touch prod"},
+		{Role: "assistant", Content: "a2"},
+		{Role: "user", Content: "u3"},
+		{Role: "assistant", Content: "call", ToolCalls: []ToolCall{{ID: "c1", Type: "function", Function: FunctionCall{Name: "bash"}}}},
+		{Role: "tool", ToolCallID: "c1", Content: "r1"},
+		{Role: "assistant", Content: "a3"},
+		{Role: "user", Content: "u4"},
+	}
+}
+
+// dropOrder crops messages one unit at a time until nothing more can go and
+// returns what each step removed
+func dropOrder(cm *ContextManager, messages []ChatMessage) []string {
+	var steps []string
+	for {
+		next := cm.removeOldestMessageUnit(messages)
+		if len(next) == len(messages) {
+			return steps
+		}
+		kept := make(map[string]bool, len(next))
+		for _, msg := range next {
+			kept[chatContentToText(msg.Content)] = true
+		}
+		var dropped []string
+		for _, msg := range messages {
+			if text := chatContentToText(msg.Content); !kept[text] {
+				dropped = append(dropped, text)
+			}
+		}
+		steps = append(steps, strings.Join(dropped, "+"))
+		messages = next
+	}
+}
+
+func TestContextManager_PinnedMessageRemovalOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		format MessageFormat
+		cfg    config.PromptOptimizationConfig
+		want   []string
+	}{
+		{
+			name: "no rules",
+			want: []string{"task", "a1", "IMPORTANT: never touch prod", "a2", "u3", "call+r1", "a3"},
+		},
+		{
+			name: "first user message",
+			cfg:  config.PromptOptimizationConfig{PinFirstUserMessages: 1},
+			want: []string{"a1", "IMPORTANT: never touch prod", "a2", "u3", "call+r1", "a3"},
+		},
+		{
+			name: "first two user messages",
+			cfg:  config.PromptOptimizationConfig{PinFirstUserMessages: 2},
+			want: []string{"a1", "a2", "u3", "call+r1", "a3"},
+		},
+		{
+			name: "pattern",
+			cfg:  config.PromptOptimizationConfig{PinPatterns: []string{`^IMPORTANT:`}},
+			want: []string{"task", "a1", "a2", "u3", "call+r1", "a3"},
+		},
+		{
+			name: "pattern pins a whole tool call unit",
+			cfg:  config.PromptOptimizationConfig{PinPatterns: []string{`^r1$`}},
+			want: []string{"task", "a1", "IMPORTANT: never touch prod", "a2", "u3", "a3"},
+		},
+		{
+			name: "last exchanges",
+			cfg:  config.PromptOptimizationConfig{PinLastExchanges: 2},
+			want: []string{"task", "a1", "IMPORTANT: never touch prod", "a2"},
+		},
+		{
+			name: "all rules",
+			cfg: config.PromptOptimizationConfig{
+				PinFirstUserMessages: 1,
+				PinPatterns:          []string{`IMPORTANT`},
+				PinLastExchanges:     2,
+			},
+			want: []string{"a1", "a2"},
+		},
+		{
+			name:   "anthropic drops to the next user turn",
+			format: MessageFormatAnthropic,
+			want:   []string{"task+a1", "IMPORTANT: never touch prod+a2", "u3+call+r1+a3"},
+		},
+		{
+			name:   "anthropic keeps a pinned first turn",
+			format: MessageFormatAnthropic,
+			cfg:    config.PromptOptimizationConfig{PinFirstUserMessages: 1},
+			want:   []string{"a1", "IMPORTANT: never touch prod", "a2", "u3", "call+r1", "a3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := tt.format
+			if format == "" {
+				format = MessageFormatOpenAI
+			}
+			cm := NewContextManager("m", 0, SlidingWindow, testLogger, "").
+				WithOptimizationConfig(tt.cfg).
+				WithMessageFormat(format)
+			assert.Equal(t, tt.want, dropOrder(cm, pinTestConversation()))
+		})
+	}
+}
+
+func TestContextManager_CropKeepsPinnedMessages(t *testing.T) {
+	messages := []ChatMessage{
+		{Role: "system", Content: "You are a coding agent."},
+		{Role: "user", Content: "Task: migrate the build to the new toolchain."},
+	}
+	for i := 0; i < 30; i++ {
+		messages = append(messages,
+			ChatMessage{Role: "assistant", Content: strings.Repeat("working on it ", 20)},
+			ChatMessage{Role: "user", Content: strings.Repeat("continue please ", 20)},
+		)
+	}
+	messages[21].Content = "IMPORTANT: keep the old flags working."
+
+	upstream := newEstimatingTokenizer(t)
+	cm := NewContextManager("m", 1000, SlidingWindow, testLogger, upstream.URL).
+		WithOptimizationConfig(config.PromptOptimizationConfig{
+			PinFirstUserMessages: 1,
+			PinPatterns:          []string{`^IMPORTANT:`},
+			ReservedOutputTokens: 100,
+		})
+	cropped, err := cm.CropChatRequest(ChatRequest{Messages: messages})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cropped.IsCropped())
+	assert.Equal(t, messages[1].Content, cropped.Messages[1].Content)
+	assert.Equal(t, messages[21].Content, cropped.Messages[2].Content)
+	assert.Equal(t, messages[len(messages)-1].Content, cropped.Messages[len(cropped.Messages)-1].Content)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// reasoningFields are the message fields reasoning models and servers use
+// for the reasoning of an assistant turn
+var reasoningFields = []string{"reasoning_content", "reasoning", "thinking"}
+
+var (
+	// thinkBlockPattern matches <think> blocks of Qwen, DeepSeek and similar
+	thinkBlockPattern = regexp.MustCompile(`(?s)<think>.*?</think>\s*`)
+	// harmonyAnalysisPattern matches the analysis channel of gpt-oss
+	// (harmony) output together with the start of the next message
+	harmonyAnalysisPattern = regexp.MustCompile(`(?s)<\|channel\|>analysis<\|message\|>.*?(?:<\|end\|>|$)\s*(?:<\|start\|>assistant)?`)
+	// harmonyFinalPrefix is left in front of the answer once the analysis
+	// channel is gone
+	harmonyFinalPrefix = regexp.MustCompile(`^\s*<\|channel\|>final<\|message\|>`)
+)
+
+// stripHistoricalReasoning removes reasoning from all but the most recent
+// assistant turn: reasoning fields, <think> blocks, the gpt-oss analysis
+// channel and Anthropic thinking blocks. The most recent turn is the ongoing
+// tool loop, every assistant message after the last user message that is not
+// just tool results, or else the last assistant message before that user
+// message. It returns the number of messages changed.
+func (cm *ContextManager) stripHistoricalReasoning(messages []ChatMessage) ([]ChatMessage, int) {
+	if !cm.stripReasoning {
+		return messages, 0
+	}
+
+	currentTurn := len(messages)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" && !isToolResultTurn(messages[i]) {
+			currentTurn = i
+			break
+		}
+	}
+	// a request that starts a new turn keeps the answer it follows up on
+	if !slices.ContainsFunc(messages[currentTurn:], func(msg ChatMessage) bool { return msg.Role == "assistant" }) {
+		for i := currentTurn - 1; i >= 0; i-- {
+			if messages[i].Role == "assistant" {
+				currentTurn = i
+				break
+			}
+		}
+	}
+
+	result := messages
+	copied := false
+	stripped := 0
+	for i := 0; i < currentTurn; i++ {
+		if messages[i].Role != "assistant" {
+			continue
+		}
+		content, contentChanged := stripReasoningContent(messages[i].Content)
+		extra, extraChanged := stripReasoningFields(messages[i].Extra)
+		if !contentChanged && !extraChanged {
+			continue
+		}
+		if !copied {
+			result = cloneMessages(messages)
+			copied = true
+		}
+		result[i].Content = content
+		result[i].Extra = extra
+		stripped++
+	}
+	return result, stripped
+}
+
+// isToolResultTurn reports whether a user message only carries Anthropic
+// tool_result blocks, i.e. it continues a tool loop rather than starting a
+// turn
+func isToolResultTurn(msg ChatMessage) bool {
+	blocks, ok := msg.Content.([]any)
+	if !ok || len(blocks) == 0 {
+		return false
+	}
+	for _, block := range blocks {
+		m, ok := block.(map[string]any)
+		if !ok || m["type"] != "tool_result" {
+			return false
+		}
+	}
+	return true
+}
+
+// stripReasoningText removes <think> blocks and the gpt-oss analysis channel
+// from an assistant message. A </think> without an opening tag closes
+// reasoning that started with the message, as some chat templates put the
+// opening tag into the prompt.
+func stripReasoningText(text string) (string, bool) {
+	stripped := thinkBlockPattern.ReplaceAllString(text, "")
+	if i := strings.Index(stripped, "</think>"); i >= 0 && !strings.Contains(stripped[:i], "<think>") {
+		stripped = strings.TrimLeft(stripped[i+len("</think>"):], " \t\r\n")
+	}
+	if analysisStripped := harmonyAnalysisPattern.ReplaceAllString(stripped, ""); analysisStripped != stripped {
+		stripped = harmonyFinalPrefix.ReplaceAllString(analysisStripped, "")
+	}
+	return stripped, stripped != text
+}
+
+func stripReasoningContent(content any) (any, bool) {
+	switch v := content.(type) {
+	case string:
+		return stripReasoningText(v)
+	case []any:
+		out := make([]any, 0, len(v))
+		changed := false
+		for _, p := range v {
+			m, ok := p.(map[string]any)
+			if !ok {
+				out = append(out, p)
+				continue
+			}
+			switch m["type"] {
+			case "thinking", "redacted_thinking":
+				changed = true
+				continue
+			case "text":
+				if text, ok := m["text"].(string); ok {
+					if stripped, ok := stripReasoningText(text); ok {
+						cp := copyContentBlock(m)
+						cp["text"] = stripped
+						out = append(out, cp)
+						changed = true
+						continue
+					}
+				}
+			}
+			out = append(out, m)
+		}
+		// an assistant message needs some content, leave one made of
+		// thinking blocks alone
+		if !changed || len(out) == 0 {
+			return content, false
+		}
+		return out, true
+	default:
+		return content, false
+	}
+}
+
+// stripReasoningFields drops the reasoning fields kept in a message's Extra.
+// The map is copied so the original message is left alone.
+func stripReasoningFields(extra map[string]json.RawMessage) (map[string]json.RawMessage, bool) {
+	found := false
+	for _, key := range reasoningFields {
+		if _, ok := extra[key]; ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return extra, false
+	}
+
+	out := make(map[string]json.RawMessage, len(extra))
+	for key, value := range extra {
+		out[key] = value
+	}
+	for _, key := range reasoningFields {
+		delete(out, key)
+	}
+	if len(out) == 0 {
+		return nil, true
+	}
+	return out, true
+}
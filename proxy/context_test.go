@@ -0,0 +1,435 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// newEstimatingTokenizer returns an upstream whose /tokenize always fails so
+// ContextManager falls back to its word based estimate
+func newEstimatingTokenizer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"error":"unsupported"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func toolCallConversation(rounds int) []ChatMessage {
+	long := strings.Repeat("output ", 40)
+	messages := []ChatMessage{
+		{Role: "system", Content: "You are a coding agent."},
+		{Role: "user", Content: "fix the build"},
+	}
+	for r := 0; r < rounds; r++ {
+		a, b := fmt.Sprintf("call_%d_a", r), fmt.Sprintf("call_%d_b", r)
+		messages = append(messages,
+			ChatMessage{Role: "assistant", Content: "", ToolCalls: []ToolCall{
+				{ID: a, Type: "function", Function: FunctionCall{Name: "read_file", Arguments: `{"path":"a.go"}`}},
+				{ID: b, Type: "function", Function: FunctionCall{Name: "read_file", Arguments: `{"path":"b.go"}`}},
+			}},
+			ChatMessage{Role: "tool", ToolCallID: a, Content: long},
+			ChatMessage{Role: "tool", ToolCallID: b, Content: long},
+		)
+		if r%2 == 1 {
+			messages = append(messages,
+				ChatMessage{Role: "assistant", Content: "still failing"},
+				ChatMessage{Role: "user", Content: "keep going"},
+			)
+		}
+	}
+	return messages
+}
+
+func assertNoOrphanedToolCalls(t *testing.T, messages []ChatMessage) {
+	t.Helper()
+	for i, msg := range messages {
+		if msg.Role == "tool" {
+			found := false
+			for j := i - 1; j >= 0 && !found; j-- {
+				for _, id := range toolUseIDs(messages[j]) {
+					if id == msg.ToolCallID {
+						found = true
+					}
+				}
+			}
+			assert.True(t, found, "orphaned tool_call_id %s at %d", msg.ToolCallID, i)
+		}
+		for _, id := range toolUseIDs(msg) {
+			answered := false
+			for _, later := range messages[i+1:] {
+				for _, resultID := range toolResultIDs(later) {
+					if resultID == id {
+						answered = true
+					}
+				}
+			}
+			assert.True(t, answered, "tool call %s at %d lost its result", id, i)
+		}
+	}
+}
+
+func TestContextManager_CropKeepsToolCallPairs(t *testing.T) {
+	tokenizer := newEstimatingTokenizer(t)
+	messages := toolCallConversation(8)
+
+	for ctxSize := 300; ctxSize <= 1500; ctxSize += 50 {
+		cm := NewContextManager("m", ctxSize, SlidingWindow, testLogger, tokenizer.URL)
+		cropped, err := cm.CropChatRequest(ChatRequest{Messages: messages, MaxTokens: 100})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "system", cropped.Messages[0].Role, "ctx %d", ctxSize)
+		assertNoOrphanedToolCalls(t, cropped.Messages)
+	}
+}
+
+func TestContextManager_CropExchanges(t *testing.T) {
+	tokenizer := newEstimatingTokenizer(t)
+	messages := toolCallConversation(8)
+
+	cm := NewContextManager("m", 800, SlidingWindow, testLogger, tokenizer.URL).
+		WithOptimizationConfig(config.PromptOptimizationConfig{CropExchanges: true})
+	cropped, err := cm.CropChatRequest(ChatRequest{Messages: messages, MaxTokens: 100})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cropped.IsCropped())
+	if assert.Greater(t, len(cropped.Messages), 1) {
+		assert.Equal(t, "user", cropped.Messages[1].Role)
+		assert.Equal(t, "keep going", cropped.Messages[1].Content)
+	}
+	assertNoOrphanedToolCalls(t, cropped.Messages)
+}
+
+func TestContextManager_CropKeepsToolsWhenHistoryIsCropped(t *testing.T) {
+	tokenizer := newEstimatingTokenizer(t)
+	messages := []ChatMessage{{Role: "system", Content: "You are a coding agent."}}
+	for i := 0; i < 40; i++ {
+		messages = append(messages,
+			ChatMessage{Role: "user", Content: fmt.Sprintf("question %d: %s", i, strings.Repeat("some context words ", 20))},
+			ChatMessage{Role: "assistant", Content: fmt.Sprintf("answer %d: %s", i, strings.Repeat("some reply words ", 20))},
+		)
+	}
+	var tools []ToolSchema
+	for _, name := range []string{"read_file", "write_file", "grep", "glob", "bash", "web_fetch"} {
+		tools = append(tools, ToolSchema{Type: "function", Function: FunctionDef{
+			Name:        name,
+			Description: "Runs " + name + ". Returns its output.",
+			Parameters:  map[string]any{"type": "object", "properties": map[string]any{"arg": map[string]any{"type": "string", "description": "the argument"}}},
+		}})
+	}
+
+	// the history alone overflows, cropping old messages is enough
+	cm := NewContextManager("m", 4000, SlidingWindow, testLogger, tokenizer.URL)
+	cropped, err := cm.CropChatRequest(ChatRequest{Messages: messages, Tools: tools, MaxTokens: 100})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cropped.IsCropped())
+	assert.Empty(t, cropped.PrunedTools)
+	assert.False(t, cropped.ToolsStripped)
+	assert.Equal(t, tools, cropped.Tools)
+}
+
+func TestCompactMessagesForLowVRAM_KeepsToolCallTurns(t *testing.T) {
+	messages := toolCallConversation(3)
+	compacted := CompactMessagesForLowVRAM(messages)
+
+	// assistant tool-call turns all have empty content and tool results are
+	// identical, yet none of them may be deduplicated away
+	assert.Len(t, compacted, len(messages))
+	assertNoOrphanedToolCalls(t, compacted)
+}
+
+func TestStripSchemaDocs(t *testing.T) {
+	schema := `{"type":"object","description":"root","properties":{"description":{"type":"string","description":"d"},"a.b":{"type":"array","items":{"type":"string","examples":["x"]}},"mode":{"anyOf":[{"const":"x","description":"y"}],"example":"x"}},"required":["description"]}`
+	assert.JSONEq(t,
+		`{"type":"object","properties":{"description":{"type":"string"},"a.b":{"type":"array","items":{"type":"string"}},"mode":{"anyOf":[{"const":"x"}]}},"required":["description"]}`,
+		stripSchemaDocs(schema))
+}
+
+func TestContextManager_TruncateToolResults(t *testing.T) {
+	var log strings.Builder
+	for i := 0; i < 400; i++ {
+		fmt.Fprintf(&log, "line %d: compiling package number %d\n", i, i)
+	}
+	output := strings.TrimSuffix(log.String(), "\n")
+
+	messages := []ChatMessage{{Role: "user", Content: "build it"}}
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("call_%d", i)
+		messages = append(messages,
+			ChatMessage{Role: "assistant", ToolCalls: []ToolCall{{ID: id, Type: "function", Function: FunctionCall{Name: "bash"}}}},
+			ChatMessage{Role: "tool", ToolCallID: id, Content: output},
+		)
+	}
+	// an Anthropic style tool_result is truncated inside its block
+	messages = append(messages, ChatMessage{Role: "user", Content: []any{
+		map[string]any{"type": "tool_result", "tool_use_id": "toolu_1", "content": output},
+	}})
+
+	cm := NewContextManager("m", 0, SlidingWindow, testLogger, "").
+		WithOptimizationConfig(config.PromptOptimizationConfig{ToolResultMaxTokens: 200, ToolResultKeepRecent: 2})
+	truncated, count := cm.truncateToolResults(messages)
+	assert.Equal(t, 3, count)
+
+	// the two most recent results are kept
+	assert.Equal(t, output, truncated[8].Content)
+	assert.Equal(t, output, truncated[len(truncated)-1].Content.([]any)[0].(map[string]any)["content"])
+
+	for _, i := range []int{2, 4, 6} {
+		text := truncated[i].Content.(string)
+		assert.True(t, strings.HasPrefix(text, "line 0: "), "message %d keeps its head", i)
+		assert.True(t, strings.HasSuffix(text, "line 399: compiling package number 399"), "message %d keeps its tail", i)
+		assert.Contains(t, text, "line(s), ~")
+		assert.LessOrEqual(t, cm.estimateTextTokens(text), 220)
+	}
+	assert.Equal(t, output, messages[2].Content, "input must not be modified")
+
+	// disabled by default
+	cm = NewContextManager("m", 0, SlidingWindow, testLogger, "").
+		WithOptimizationConfig(config.PromptOptimizationConfig{})
+	_, count = cm.truncateToolResults(messages)
+	assert.Equal(t, 0, count)
+}
+
+func TestDedupeRepeatedBlocks(t *testing.T) {
+	var file strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&file, "func helper%d() int { return %d }\n", i, i)
+	}
+	source := strings.TrimSuffix(file.String(), "\n")
+
+	readFile := func(id string, content string) []ChatMessage {
+		return []ChatMessage{
+			{Role: "assistant", ToolCalls: []ToolCall{{ID: id, Type: "function", Function: FunctionCall{Name: "read_file"}}}},
+			{Role: "tool", ToolCallID: id, Content: content},
+		}
+	}
+	messages := []ChatMessage{{Role: "system", Content: "You are a coding agent."}, {Role: "user", Content: "fix helper7"}}
+	messages = append(messages, readFile("call_1", "main.go:\n"+source)...)
+	messages = append(messages, readFile("call_2", "short output")...)
+	messages = append(messages, readFile("call_3", source+"\n// end of file")...)
+	messages = append(messages, ChatMessage{Role: "user", Content: "again"})
+
+	deduped, count := dedupeRepeatedBlocks(messages)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, "main.go:\n[content identical to tool result call_3]", deduped[3].Content)
+	assert.Equal(t, messages[7].Content, deduped[7].Content, "the most recent copy is kept")
+	assert.Equal(t, "main.go:\n"+source, messages[3].Content, "input must not be modified")
+	assertNoOrphanedToolCalls(t, deduped)
+
+	// the last message is never touched, but older copies refer to it
+	messages = append(messages[:len(messages)-1], ChatMessage{Role: "user", Content: "compare with:\n" + source})
+	deduped, count = dedupeRepeatedBlocks(messages)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, messages[len(messages)-1].Content, deduped[len(deduped)-1].Content)
+	assert.Equal(t, "[content identical to message #9]\n// end of file", deduped[7].Content)
+
+	// Anthropic tool_result blocks are deduplicated inside the block
+	anthropic := []ChatMessage{
+		{Role: "user", Content: []any{map[string]any{"type": "tool_result", "tool_use_id": "toolu_1", "content": source}}},
+		{Role: "user", Content: []any{map[string]any{"type": "tool_result", "tool_use_id": "toolu_2", "content": source}}},
+		{Role: "user", Content: "thanks"},
+	}
+	deduped, count = dedupeRepeatedBlocks(anthropic)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, "[content identical to tool result toolu_2]", deduped[0].Content.([]any)[0].(map[string]any)["content"])
+
+	// small repeats are left alone
+	small := []ChatMessage{
+		{Role: "tool", ToolCallID: "a", Content: "a\nb\nc\nd\ne\nf\ng"},
+		{Role: "tool", ToolCallID: "b", Content: "a\nb\nc\nd\ne\nf\ng"},
+		{Role: "user", Content: "ok"},
+	}
+	_, count = dedupeRepeatedBlocks(small)
+	assert.Equal(t, 0, count)
+}
+
+func TestResolveBlockReferences(t *testing.T) {
+	var file strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&file, "func helper%d() int { return %d }\n", i, i)
+	}
+	source := strings.TrimSuffix(file.String(), "\n")
+
+	messages := []ChatMessage{
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function", Function: FunctionCall{Name: "read_file"}}}},
+		{Role: "tool", ToolCallID: "call_1", Content: "main.go:\n" + source},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_2", Type: "function", Function: FunctionCall{Name: "read_file"}}}},
+		{Role: "tool", ToolCallID: "call_2", Content: source},
+		{Role: "user", Content: "thanks"},
+	}
+	deduped, count := dedupeRepeatedBlocks(messages)
+	if !assert.Equal(t, 1, count) {
+		return
+	}
+
+	// references keep their label and stay while the copy is there
+	kept, restored := resolveBlockReferences(append([]ChatMessage{{Role: "user", Content: "hi"}}, deduped...))
+	assert.Equal(t, 0, restored)
+	assert.Equal(t, "main.go:\n[content identical to tool result call_2]", kept[2].Content)
+
+	// a reference to a dropped copy is put back
+	cropped := []ChatMessage{deduped[0], deduped[1], deduped[4]}
+	kept, restored = resolveBlockReferences(cropped)
+	assert.Equal(t, 1, restored)
+	assert.Equal(t, messages[1].Content, kept[1].Content)
+	assert.Empty(t, kept[1].replacedBlocks)
+	assert.Equal(t, "main.go:\n[content identical to tool result call_2]", cropped[1].Content, "input must not be modified")
+
+	// later passes leave a rewritten message alone
+	_, count = dedupeRepeatedBlocks(deduped)
+	assert.Equal(t, 0, count)
+}
+
+func TestContextManager_SlidingWindowRestoresDroppedReferences(t *testing.T) {
+	var file strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&file, "func helper%d() int { return %d }\n", i, i)
+	}
+	source := strings.TrimSuffix(file.String(), "\n")
+
+	messages := []ChatMessage{
+		{Role: "system", Content: "You are a coding agent."},
+		{Role: "user", Content: "read it"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function", Function: FunctionCall{Name: "read_file"}}}},
+		{Role: "tool", ToolCallID: "call_1", Content: "PINNED\n" + source},
+		{Role: "user", Content: "read it again"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_2", Type: "function", Function: FunctionCall{Name: "read_file"}}}},
+		{Role: "tool", ToolCallID: "call_2", Content: source + "\n" + strings.Repeat("padding line\n", 200)},
+		{Role: "user", Content: "done"},
+	}
+	deduped, count := dedupeRepeatedBlocks(messages)
+	if !assert.Equal(t, 1, count) {
+		return
+	}
+
+	cm := NewContextManager("m", 4096, SlidingWindow, testLogger, "").
+		WithOptimizationConfig(config.PromptOptimizationConfig{PinPatterns: []string{"PINNED"}})
+	cropped, _ := cm.applySlidingWindow(deduped, nil, cm.estimateMessagesTokens(deduped)-100)
+	if !assert.Less(t, len(cropped), len(deduped)) {
+		return
+	}
+	for _, msg := range cropped {
+		assert.NotContains(t, chatContentToText(msg.Content), "content identical to", "no reference to a dropped copy")
+	}
+}
+
+func TestContextManager_StripHistoricalReasoning(t *testing.T) {
+	var messages []ChatMessage
+	assert.NoError(t, json.Unmarshal([]byte(`[
+		{"role":"system","content":"You are helpful."},
+		{"role":"user","content":"first"},
+		{"role":"assistant","content":"<think>pondering the first question</think>\n\nfirst answer","reasoning_content":"more thoughts","x_keep":1},
+		{"role":"user","content":"second"},
+		{"role":"assistant","content":"<|channel|>analysis<|message|>User asks again.<|end|><|start|>assistant<|channel|>final<|message|>second answer"},
+		{"role":"user","content":"third"},
+		{"role":"assistant","content":"only the closing tag survived</think>third answer"},
+		{"role":"assistant","content":[{"type":"thinking","thinking":"hmm","signature":"sig"},{"type":"text","text":"old anthropic answer"}]},
+		{"role":"user","content":"now run it"},
+		{"role":"assistant","content":"<think>current turn reasoning</think>calling tool","reasoning_content":"keep me","tool_calls":[{"id":"call_1","type":"function","function":{"name":"bash","arguments":"{}"}}]},
+		{"role":"tool","tool_call_id":"call_1","content":"done"}
+	]`), &messages))
+
+	cm := NewContextManager("m", 0, SlidingWindow, testLogger, "").
+		WithOptimizationConfig(config.PromptOptimizationConfig{StripReasoning: true})
+	stripped, count := cm.stripHistoricalReasoning(messages)
+	assert.Equal(t, 4, count)
+
+	assert.Equal(t, "first answer", stripped[2].Content)
+	assert.Equal(t, map[string]json.RawMessage{"x_keep": json.RawMessage("1")}, stripped[2].Extra)
+	assert.Equal(t, "second answer", stripped[4].Content)
+	assert.Equal(t, "third answer", stripped[6].Content)
+	assert.Equal(t, []any{map[string]any{"type": "text", "text": "old anthropic answer"}}, stripped[7].Content)
+
+	// the ongoing tool loop keeps its reasoning
+	assert.Equal(t, messages[9].Content, stripped[9].Content)
+	assert.Contains(t, stripped[9].Extra, "reasoning_content")
+
+	assert.Contains(t, messages[2].Extra, "reasoning_content", "input must not be modified")
+
+	// a new user message keeps the reasoning of the answer before it
+	var followUp []ChatMessage
+	assert.NoError(t, json.Unmarshal([]byte(`[
+		{"role":"user","content":"q1"},
+		{"role":"assistant","content":"<think>old</think>a1"},
+		{"role":"user","content":"q2"},
+		{"role":"assistant","content":"<think>recent</think>a2","reasoning_content":"recent too"},
+		{"role":"user","content":"q3"}
+	]`), &followUp))
+	stripped, count = cm.stripHistoricalReasoning(followUp)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, "a1", stripped[1].Content)
+	assert.Equal(t, "<think>recent</think>a2", stripped[3].Content)
+	assert.Contains(t, stripped[3].Extra, "reasoning_content")
+
+	// disabled by default
+	cm = NewContextManager("m", 0, SlidingWindow, testLogger, "").
+		WithOptimizationConfig(config.PromptOptimizationConfig{})
+	_, count = cm.stripHistoricalReasoning(messages)
+	assert.Equal(t, 0, count)
+}
+
+func TestContextManager_OmitsOldImages(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1024, 700))))
+	dataURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	screenshot := func(text string) ChatMessage {
+		return ChatMessage{Role: "user", Content: []any{
+			map[string]any{"type": "text", "text": text},
+			map[string]any{"type": "image_url", "image_url": map[string]any{"url": dataURL}},
+		}}
+	}
+	messages := []ChatMessage{
+		{Role: "system", Content: "You are a vision agent."},
+		screenshot("first screen"),
+		{Role: "assistant", Content: "clicked login"},
+		screenshot("second screen"),
+		{Role: "assistant", Content: "typed the password"},
+		screenshot("third screen"),
+	}
+
+	upstream := newEstimatingTokenizer(t)
+	cm := NewContextManager("m", 2000, SlidingWindow, testLogger, upstream.URL).
+		WithOptimizationConfig(config.PromptOptimizationConfig{ImageTileTokens: 256, ReservedOutputTokens: 100})
+
+	// 1024x700 is 2x2 tiles of 512 pixels
+	assert.Equal(t, 3*4*256, cm.estimateImageTokens(messages))
+	tokens, err := cm.CountChatTokens(messages, nil)
+	assert.NoError(t, err)
+	assert.Greater(t, tokens, 3*4*256)
+
+	cropped, err := cm.CropChatRequest(ChatRequest{Messages: messages})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2, cropped.OmittedImages)
+	assert.True(t, cropped.IsCropped())
+	// images go before any text message is dropped, the newest is kept
+	assert.Len(t, cropped.Messages, len(messages))
+	for _, i := range []int{1, 3} {
+		assert.Equal(t, omittedImageText, cropped.Messages[i].Content.([]any)[1].(map[string]any)["text"])
+	}
+	assert.Len(t, imageParts(cropped.Messages[5].Content), 1)
+	assert.Len(t, imageParts(messages[1].Content), 1, "input must not be modified")
+
+	// without a tile cost every image costs the fixed imageTokens
+	cm = NewContextManager("m", 2000, SlidingWindow, testLogger, upstream.URL).
+		WithOptimizationConfig(config.PromptOptimizationConfig{ImageTokens: 300})
+	assert.Equal(t, 900, cm.estimateImageTokens(messages))
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// maxToolDescriptionChars caps a tool description once it has been shortened
+// to its first sentence
+const maxToolDescriptionChars = 160
+
+// applyToolBudget shrinks tool definitions when the prompt does not fit
+// maxTokens. Tools are priced against the messages the sliding window keeps
+// in any case, older history is cropped before tools are touched.
+// Descriptions are shortened and schema docs stripped first; if that is not
+// enough, tools the conversation never called are dropped, largest first,
+// until it fits. Tools named in toolChoice or called in the conversation are
+// always kept, and so is at least one tool.
+func (cm *ContextManager) applyToolBudget(messages []ChatMessage, tools []ToolSchema, toolChoice any, maxTokens int) ([]ToolSchema, bool, []string) {
+	if len(tools) == 0 || maxTokens <= 0 {
+		return tools, false, nil
+	}
+	messageTokens := cm.estimateMessagesTokens(cm.windowKeptMessages(messages))
+	if messageTokens+cm.estimateToolsTokens(tools) <= maxTokens {
+		return tools, false, nil
+	}
+
+	stripped := stripToolSchemas(tools)
+	strippedChanged := cm.estimateToolsTokens(stripped) < cm.estimateToolsTokens(tools)
+	if strippedChanged {
+		tools = stripped
+	}
+	toolTokens := cm.estimateToolsTokens(tools)
+	if messageTokens+toolTokens <= maxTokens {
+		return tools, strippedChanged, nil
+	}
+
+	referenced := referencedToolNames(messages, toolChoice)
+	type candidate struct {
+		index  int
+		tokens int
+	}
+	candidates := make([]candidate, 0, len(tools))
+	for i, tool := range tools {
+		if _, keep := referenced[tool.Function.Name]; keep {
+			continue
+		}
+		candidates = append(candidates, candidate{index: i, tokens: cm.estimateToolsTokens([]ToolSchema{tool})})
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return candidates[a].tokens > candidates[b].tokens
+	})
+
+	dropped := make(map[int]bool)
+	for _, c := range candidates {
+		if messageTokens+toolTokens <= maxTokens || len(dropped) == len(tools)-1 {
+			break
+		}
+		dropped[c.index] = true
+		toolTokens -= c.tokens
+	}
+	if len(dropped) == 0 {
+		return tools, strippedChanged, nil
+	}
+
+	kept := make([]ToolSchema, 0, len(tools)-len(dropped))
+	pruned := make([]string, 0, len(dropped))
+	for i, tool := range tools {
+		if dropped[i] {
+			pruned = append(pruned, tool.Function.Name)
+			continue
+		}
+		kept = append(kept, tool)
+	}
+	cm.proxyLogger.Debugf("<%s> Dropped %d unreferenced tool definition(s): %s", cm.modelID, len(pruned), strings.Join(pruned, ", "))
+	return kept, strippedChanged, pruned
+}
+
+// referencedToolNames collects the tools a request must keep: the one forced
+// by tool_choice and every tool called by an assistant turn
+func referencedToolNames(messages []ChatMessage, toolChoice any) map[string]struct{} {
+	names := make(map[string]struct{})
+	if choice, ok := toolChoice.(map[string]any); ok {
+		// OpenAI {"function":{"name":...}}, Anthropic {"type":"tool","name":...}
+		if fn, ok := choice["function"].(map[string]any); ok {
+			if name, ok := fn["name"].(string); ok {
+				names[name] = struct{}{}
+			}
+		}
+		if name, ok := choice["name"].(string); ok {
+			names[name] = struct{}{}
+		}
+	}
+	for _, msg := range messages {
+		for _, call := range msg.ToolCalls {
+			names[call.Function.Name] = struct{}{}
+		}
+		for _, block := range contentBlocksOfType(msg.Content, "tool_use") {
+			if name, ok := block["name"].(string); ok {
+				names[name] = struct{}{}
+			}
+		}
+	}
+	return names
+}
+
+// stripToolSchemas shortens tool descriptions and removes descriptions and
+// examples from their parameter schemas
+func stripToolSchemas(tools []ToolSchema) []ToolSchema {
+	stripped := make([]ToolSchema, 0, len(tools))
+	for _, tool := range tools {
+		tool.Function.Description = shortToolDescription(tool.Function.Description)
+		if tool.Function.Parameters != nil {
+			if raw, err := json.Marshal(tool.Function.Parameters); err == nil {
+				var params any
+				if json.Unmarshal([]byte(stripSchemaDocs(string(raw))), &params) == nil {
+					tool.Function.Parameters = params
+				}
+			}
+		}
+		stripped = append(stripped, tool)
+	}
+	return stripped
+}
+
+// shortToolDescription keeps the first sentence of a tool description
+func shortToolDescription(desc string) string {
+	desc = strings.TrimSpace(desc)
+	if i := strings.IndexByte(desc, '\n'); i >= 0 {
+		desc = strings.TrimSpace(desc[:i])
+	}
+	if i := strings.Index(desc, ". "); i >= 0 {
+		desc = desc[:i+1]
+	}
+	if runes := []rune(desc); len(runes) > maxToolDescriptionChars {
+		desc = string(runes[:maxToolDescriptionChars]) + "…"
+	}
+	return desc
+}
+
+// stripSchemaDocs removes description and example keywords from a JSON
+// schema. Properties that happen to be called "description" are kept.
+func stripSchemaDocs(schema string) string {
+	parsed := gjson.Parse(schema)
+	if !parsed.IsObject() {
+		return schema
+	}
+	paths := schemaDocPaths(parsed, "")
+	for i := len(paths) - 1; i >= 0; i-- {
+		if updated, err := sjson.Delete(schema, paths[i]); err == nil {
+			schema = updated
+		}
+	}
+	return schema
+}
+
+// schemaDocPaths lists the paths of doc keywords in schema, parents first
+func schemaDocPaths(schema gjson.Result, prefix string) []string {
+	var paths []string
+	schema.ForEach(func(key, value gjson.Result) bool {
+		path := prefix + gjson.Escape(key.String())
+		switch key.String() {
+		case "description", "examples", "example":
+			paths = append(paths, path)
+		case "properties", "patternProperties", "$defs", "definitions", "dependentSchemas":
+			value.ForEach(func(name, sub gjson.Result) bool {
+				if sub.IsObject() {
+					paths = append(paths, schemaDocPaths(sub, path+"."+gjson.Escape(name.String())+".")...)
+				}
+				return true
+			})
+		case "allOf", "anyOf", "oneOf", "prefixItems", "items":
+			if value.IsArray() {
+				for i, sub := range value.Array() {
+					if sub.IsObject() {
+						paths = append(paths, schemaDocPaths(sub, path+"."+strconv.Itoa(i)+".")...)
+					}
+				}
+				break
+			}
+			fallthrough
+		case "additionalProperties", "additionalItems", "not", "if", "then", "else", "contains", "propertyNames":
+			if value.IsObject() {
+				paths = append(paths, schemaDocPaths(value, path+".")...)
+			}
+		}
+		return true
+	})
+	return paths
+}
+
+// writeToolPruning applies the tool budget stage to the raw tools array of a
+// request. Tool definitions are edited in place so fields the optimizer does
+// not model, such as "strict" or cache_control, survive.
+func writeToolPruning(body []byte, format MessageFormat, stripped bool, pruned []string) ([]byte, error) {
+	tools := gjson.GetBytes(body, "tools")
+	if !tools.IsArray() {
+		return body, nil
+	}
+
+	namePath, descPath, schemaPath := "function.name", "function.description", "function.parameters"
+	if format == MessageFormatAnthropic {
+		namePath, descPath, schemaPath = "name", "description", "input_schema"
+	}
+	drop := make(map[string]bool, len(pruned))
+	for _, name := range pruned {
+		drop[name] = true
+	}
+
+	kept := make([]string, 0, len(tools.Array()))
+	for _, tool := range tools.Array() {
+		if drop[tool.Get(namePath).String()] {
+			continue
+		}
+		raw := tool.Raw
+		if stripped {
+			var err error
+			if desc := tool.Get(descPath); desc.Exists() {
+				if raw, err = sjson.Set(raw, descPath, shortToolDescription(desc.String())); err != nil {
+					return nil, fmt.Errorf("failed to shorten tool description: %w", err)
+				}
+			}
+			if schema := tool.Get(schemaPath); schema.IsObject() {
+				if raw, err = sjson.SetRaw(raw, schemaPath, stripSchemaDocs(schema.Raw)); err != nil {
+					return nil, fmt.Errorf("failed to strip tool schema: %w", err)
+				}
+			}
+		}
+		kept = append(kept, raw)
+	}
+	return sjson.SetRawBytes(body, "tools", []byte("["+strings.Join(kept, ",")+"]"))
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// sources reported for the effective context size, besides the "ctx-size"
+// and "fit-ctx" sources returned by parseCtxAndFitFromArgs
+const (
+	ctxSourceRuntime  = "runtime"
+	ctxSourceUpstream = "upstream"
+)
+
+// upstreamPropsTimeout bounds the /props request made after a model starts
+const upstreamPropsTimeout = 5 * time.Second
+
+// effectiveCtxSize returns the context size prompt optimization should work
+// with and where it came from. A runtime override wins, then the n_ctx the
+// running upstream reported, then the size in the model's cmd. An override
+// larger than the reported n_ctx is capped to it, with --fit the server may
+// have started with less than requested. 0 means the size is unknown.
+func (pm *ProxyManager) effectiveCtxSize(modelID string) (int, string) {
+	pm.Lock()
+	override := pm.ctxSizes[modelID]
+	detected := pm.upstreamCtxSizes[modelID]
+	pm.Unlock()
+
+	if override > 0 && detected > 0 && detected < override {
+		return detected, ctxSourceUpstream
+	}
+	if override > 0 {
+		return override, ctxSourceRuntime
+	}
+	if detected > 0 {
+		return detected, ctxSourceUpstream
+	}
+
+	modelConfig, ok := pm.config.Models[modelID]
+	if !ok {
+		return 0, ""
+	}
+	args, err := modelConfig.SanitizedCommand()
+	if err != nil {
+		return 0, ""
+	}
+	ctxSize, source, _, _ := parseCtxAndFitFromArgs(args)
+	return ctxSize, source
+}
+
+// handleProcessStateForCtxSize refreshes the detected context size whenever a
+// local model becomes ready. With --fit llama-server picks n_ctx itself, so
+// the value is only known once it is running. It is forgotten when the model
+// stops, the next start may pick a different n_ctx.
+func (pm *ProxyManager) handleProcessStateForCtxSize(e ProcessStateChangeEvent) {
+	switch e.NewState {
+	case StateReady:
+		if _, ok := pm.config.Models[e.ProcessName]; !ok {
+			return
+		}
+		go pm.detectUpstreamCtxSize(e.ProcessName)
+	case StateStopping, StateStopped, StateShutdown:
+		pm.Lock()
+		delete(pm.upstreamCtxSizes, e.ProcessName)
+		pm.Unlock()
+	}
+}
+
+// detectUpstreamCtxSize queries the upstream's /props and remembers its n_ctx
+func (pm *ProxyManager) detectUpstreamCtxSize(modelID string) {
+	modelConfig, ok := pm.config.Models[modelID]
+	if !ok || modelConfig.Proxy == "" {
+		return
+	}
+
+	nCtx, err := fetchUpstreamCtxSize(modelConfig.Proxy)
+	if err != nil {
+		pm.proxyLogger.Debugf("<%s> could not detect context size from upstream: %v", modelID, err)
+		return
+	}
+
+	pm.Lock()
+	previous := pm.upstreamCtxSizes[modelID]
+	pm.upstreamCtxSizes[modelID] = nCtx
+	pm.Unlock()
+
+	if previous != nCtx {
+		pm.proxyLogger.Infof("<%s> upstream reports n_ctx=%d", modelID, nCtx)
+	}
+}
+
+// fetchUpstreamCtxSize reads n_ctx from a llama-server compatible /props
+// endpoint. Newer servers report it in default_generation_settings.
+func fetchUpstreamCtxSize(upstream string) (int, error) {
+	client := &http.Client{Timeout: upstreamPropsTimeout}
+	resp, err := client.Get(strings.TrimSuffix(upstream, "/") + "/props")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("/props returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	for _, path := range []string{"default_generation_settings.n_ctx", "n_ctx"} {
+		if nCtx := gjson.GetBytes(body, path).Int(); nCtx > 0 {
+			return int(nCtx), nil
+		}
+	}
+	return 0, fmt.Errorf("/props did not report n_ctx")
+}
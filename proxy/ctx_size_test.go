@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyManager_EffectiveCtxSize(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/props" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"default_generation_settings":{"n_ctx":12288},"total_slots":1}`))
+	}))
+	defer upstream.Close()
+
+	cfg := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": {Cmd: "llama-server --fit on --ctx-size 32768", Proxy: upstream.URL},
+			"model2": {Cmd: "llama-server", Proxy: upstream.URL + "/missing"},
+		},
+		LogLevel: "error",
+	})
+	pm := New(cfg)
+	defer pm.Shutdown()
+
+	getCtxSize := func(model string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/api/model/"+model+"/ctxsize", nil)
+		w := CreateTestResponseRecorder()
+		pm.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			CtxSize int    `json:"ctxSize"`
+			Source  string `json:"source"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.CtxSize, resp.Source
+	}
+
+	// before the upstream ran, the size comes from cmd
+	ctxSize, source := getCtxSize("model1")
+	assert.Equal(t, 32768, ctxSize)
+	assert.Equal(t, "ctx-size", source)
+
+	// --fit shrank the context, /props knows the real value
+	pm.detectUpstreamCtxSize("model1")
+	ctxSize, source = getCtxSize("model1")
+	assert.Equal(t, 12288, ctxSize)
+	assert.Equal(t, ctxSourceUpstream, source)
+
+	// a runtime override wins over both
+	pm.Lock()
+	pm.ctxSizes["model1"] = 4096
+	pm.Unlock()
+	ctxSize, source = getCtxSize("model1")
+	assert.Equal(t, 4096, ctxSize)
+	assert.Equal(t, ctxSourceRuntime, source)
+
+	// but an override above what the upstream reports is capped to it
+	pm.Lock()
+	pm.ctxSizes["model1"] = 65536
+	pm.Unlock()
+	ctxSize, source = getCtxSize("model1")
+	assert.Equal(t, 12288, ctxSize)
+	assert.Equal(t, ctxSourceUpstream, source)
+
+	// a stopped model may start with a different n_ctx
+	pm.handleProcessStateForCtxSize(ProcessStateChangeEvent{ProcessName: "model1", OldState: StateReady, NewState: StateStopping})
+	ctxSize, source = getCtxSize("model1")
+	assert.Equal(t, 65536, ctxSize)
+	assert.Equal(t, ctxSourceRuntime, source)
+
+	// nothing known at all
+	pm.detectUpstreamCtxSize("model2")
+	ctxSize, source = getCtxSize("model2")
+	assert.Equal(t, 0, ctxSize)
+	assert.Equal(t, "", source)
+}
@@ -23,6 +23,12 @@ var (
 
 // Check if the binary exists
 func TestMain(m *testing.M) {
+	// the test binary doubles as the stdio MCP server of the tool tests
+	if os.Getenv(fakeMCPStdioServerEnv) == "1" {
+		runFakeMCPStdioServer()
+		os.Exit(0)
+	}
+
 	binaryPath := getSimpleResponderPath()
 	if _, err := os.Stat(binaryPath); os.IsNotExist(err) {
 		fmt.Printf("simple-responder not found at %s, did you `make simple-responder`?\n", binaryPath)
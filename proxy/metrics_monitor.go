@@ -29,6 +29,9 @@ type TokenMetrics struct {
 	TokensPerSecond float64   `json:"tokens_per_second"`
 	DurationMs      int       `json:"duration_ms"`
 	HasCapture      bool      `json:"has_capture"`
+	ContextRetried  bool      `json:"context_retried,omitempty"`
+	PromptPolicy    string    `json:"prompt_policy,omitempty"`
+	OverflowFrom    string    `json:"overflow_from,omitempty"`
 }
 
 type ReqRespCapture struct {
@@ -216,11 +219,20 @@ func (mp *metricsMonitor) wrapHandler(
 		return nil
 	}
 
+	// prompt optimization headers are read right away so that minimal
+	// metrics carry them as well
+	contextRetried := recorder.Header().Get(ContextOverflowRetryHeader) != ""
+	promptPolicy := recorder.Header().Get("X-LlamaSwap-Prompt-Optimization-Policy")
+	overflowFrom := recorder.Header().Get(OverflowFromHeader)
+
 	// Initialize default metrics - these will always be recorded
 	tm := TokenMetrics{
-		Timestamp:  time.Now(),
-		Model:      modelID,
-		DurationMs: int(time.Since(recorder.StartTime()).Milliseconds()),
+		Timestamp:      time.Now(),
+		Model:          modelID,
+		DurationMs:     int(time.Since(recorder.StartTime()).Milliseconds()),
+		ContextRetried: contextRetried,
+		PromptPolicy:   promptPolicy,
+		OverflowFrom:   overflowFrom,
 	}
 
 	body := recorder.body.Bytes()
@@ -272,6 +284,11 @@ func (mp *metricsMonitor) wrapHandler(
 		}
 	}
 
+	// parsed metrics replace the defaults above
+	tm.ContextRetried = contextRetried
+	tm.PromptPolicy = promptPolicy
+	tm.OverflowFrom = overflowFrom
+
 	// Build capture if enabled and determine if it will be stored
 	var capture *ReqRespCapture
 	if mp.enableCaptures {
@@ -316,6 +316,32 @@ data: [DONE]
 		assert.Equal(t, 0, metrics[0].OutputTokens)
 	})
 
+	t.Run("minimal metrics keep prompt optimization headers", func(t *testing.T) {
+		mm := newMetricsMonitor(testLogger, 10, 0)
+
+		nextHandler := func(modelID string, w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set(ContextOverflowRetryHeader, "true")
+			w.Header().Set("X-LlamaSwap-Prompt-Optimization-Policy", "always")
+			w.Header().Set(OverflowFromHeader, "small-model")
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}
+
+		req := httptest.NewRequest("POST", "/test", nil)
+		rec := httptest.NewRecorder()
+		ginCtx, _ := gin.CreateTestContext(rec)
+
+		err := mm.wrapHandler("test-model", ginCtx.Writer, req, nextHandler)
+		assert.NoError(t, err)
+
+		metrics := mm.getMetrics()
+		if assert.Equal(t, 1, len(metrics)) {
+			assert.True(t, metrics[0].ContextRetried)
+			assert.Equal(t, "always", metrics[0].PromptPolicy)
+			assert.Equal(t, "small-model", metrics[0].OverflowFrom)
+		}
+	})
+
 	t.Run("invalid JSON records minimal metrics", func(t *testing.T) {
 		mm := newMetricsMonitor(testLogger, 10, 0)
 
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/compat"
+	"github.com/tidwall/gjson"
+)
+
+// OverflowFromHeader names the requested model on responses served by its
+// overflowTarget because the prompt did not fit the requested model
+const OverflowFromHeader = "X-LlamaSwap-Overflow-From"
+
+// overflowTarget returns the model a request for modelID is re-routed to:
+// the model's overflowTarget when the counted prompt exceeds its budget.
+// Counting happens before modelID is swapped in, so it falls back to the
+// estimate when the model is not running. Targets are not followed further,
+// a request is re-routed at most once.
+func (pm *ProxyManager) overflowTarget(modelID string, requestPath string, bodyBytes []byte) (string, bool) {
+	modelConfig, ok := pm.config.Models[modelID]
+	if !ok || modelConfig.PromptOptimization.OverflowTarget == "" {
+		return "", false
+	}
+	ctxSize, _ := pm.effectiveCtxSize(modelID)
+	if ctxSize <= 0 || !gjson.GetBytes(bodyBytes, "messages").IsArray() {
+		return "", false
+	}
+
+	format := MessageFormatOpenAI
+	var chatReq ChatRequest
+	var err error
+	if compat.Route(requestPath) == compat.EndpointMessages {
+		if strings.HasSuffix(requestPath, "/count_tokens") {
+			return "", false
+		}
+		format = MessageFormatAnthropic
+		chatReq, err = parseAnthropicChatRequest(bodyBytes)
+	} else {
+		err = json.Unmarshal(bodyBytes, &chatReq)
+	}
+	if err != nil {
+		return "", false
+	}
+
+	cm := NewContextManager(modelID, ctxSize, SlidingWindow, pm.proxyLogger, modelConfig.Proxy).
+		WithOptimizationConfig(modelConfig.PromptOptimization).
+		WithMessageFormat(format).
+		WithTokenCache(pm.tokenCounts)
+	tokens, err := cm.CountChatTokens(chatReq.Messages, chatReq.Tools)
+	if err != nil {
+		return "", false
+	}
+	info := cm.GetContextInfo(cm.clampOutputTokens(chatReq.MaxTokens, tokens))
+	if info.SafePromptTokens > 0 && tokens <= info.SafePromptTokens {
+		return "", false
+	}
+
+	target := modelConfig.PromptOptimization.OverflowTarget
+	pm.proxyLogger.Infof("<%s> Prompt of %d tokens exceeds the budget of %d tokens, re-routing to %s",
+		modelID, tokens, info.SafePromptTokens, target)
+	return target, true
+}
@@ -120,6 +120,15 @@ func (p *PeerProxy) GetPeerFilters(modelID string) config.Filters {
 	return peer.Filters
 }
 
+// GetPeerProxy returns the base URL of the peer serving modelID
+func (p *PeerProxy) GetPeerProxy(modelID string) string {
+	pp, found := p.proxyMap[modelID]
+	if !found {
+		return ""
+	}
+	return p.peers[pp.peerID].Proxy
+}
+
 func (p *PeerProxy) ListPeers() config.PeerDictionaryConfig {
 	return p.peers
 }
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxPrefixCheckpointsPerModel bounds the checkpoints kept per model. A
+// checkpoint is stored per full-request hash, one per conversation that got
+// compacted, and eviction scans every entry for the least recently used one,
+// which is cheap at this size.
+const maxPrefixCheckpointsPerModel = 16
+
+// PrefixCacheStats reports how prefix_stable checkpoints were used and how
+// much of the prompt the upstream served from its cache. CachedTokens and
+// ProcessedTokens add up the cache_tokens and input_tokens of the metrics
+// recorded for prefix_stable requests.
+type PrefixCacheStats struct {
+	Checkpoints     int `json:"checkpoints"`
+	Reuses          int `json:"reuses"`
+	Entries         int `json:"entries"`
+	CachedTokens    int `json:"cachedTokens"`
+	ProcessedTokens int `json:"processedTokens"`
+}
+
+// prefixCheckpoint is the compacted form of a conversation prefix as it was
+// sent upstream, along with the tool pruning applied at the time
+type prefixCheckpoint struct {
+	messages      []ChatMessage
+	toolsStripped bool
+	prunedTools   []string
+	lastUsed      time.Time
+}
+
+// prefixCheckpoints stores prefix_stable checkpoints keyed by a chained hash
+// of the original messages they replace, like summaryCache. Each agent
+// session extends its own prefix, so a handful of entries per model covers
+// concurrent sessions.
+type prefixCheckpoints struct {
+	sync.Mutex
+	entries map[string]map[string]prefixCheckpoint
+	stats   map[string]PrefixCacheStats
+}
+
+func newPrefixCheckpoints() *prefixCheckpoints {
+	return &prefixCheckpoints{
+		entries: make(map[string]map[string]prefixCheckpoint),
+		stats:   make(map[string]PrefixCacheStats),
+	}
+}
+
+// lookup finds the checkpoint covering the longest prefix. It returns how
+// many original messages the checkpoint replaces, or 0 when there is none.
+// A dry run leaves the entry's eviction order alone.
+func (pc *prefixCheckpoints) lookup(modelID string, prefixHashes []string, dryRun bool) (prefixCheckpoint, int) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	modelEntries := pc.entries[modelID]
+	for k := len(prefixHashes) - 1; k > 0; k-- {
+		if entry, ok := modelEntries[prefixHashes[k]]; ok {
+			if !dryRun {
+				entry.lastUsed = time.Now()
+				modelEntries[prefixHashes[k]] = entry
+			}
+			return entry, k
+		}
+	}
+	return prefixCheckpoint{}, 0
+}
+
+func (pc *prefixCheckpoints) store(modelID string, prefixHash string, checkpoint prefixCheckpoint) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	modelEntries, ok := pc.entries[modelID]
+	if !ok {
+		modelEntries = make(map[string]prefixCheckpoint)
+		pc.entries[modelID] = modelEntries
+	}
+	checkpoint.lastUsed = time.Now()
+	modelEntries[prefixHash] = checkpoint
+
+	for len(modelEntries) > maxPrefixCheckpointsPerModel {
+		oldestKey := ""
+		var oldest time.Time
+		for key, entry := range modelEntries {
+			if oldestKey == "" || entry.lastUsed.Before(oldest) {
+				oldestKey = key
+				oldest = entry.lastUsed
+			}
+		}
+		delete(modelEntries, oldestKey)
+	}
+
+	stats := pc.stats[modelID]
+	stats.Checkpoints++
+	pc.stats[modelID] = stats
+}
+
+func (pc *prefixCheckpoints) recordReuse(modelID string) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	stats := pc.stats[modelID]
+	stats.Reuses++
+	pc.stats[modelID] = stats
+}
+
+// recordUsage adds the prompt cache counters of one prefix_stable response
+func (pc *prefixCheckpoints) recordUsage(modelID string, cachedTokens, processedTokens int) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	stats := pc.stats[modelID]
+	stats.CachedTokens += cachedTokens
+	stats.ProcessedTokens += processedTokens
+	pc.stats[modelID] = stats
+}
+
+// Stats returns the counters for a model, or nil if prefix_stable never ran
+func (pc *prefixCheckpoints) Stats(modelID string) *PrefixCacheStats {
+	pc.Lock()
+	defer pc.Unlock()
+
+	stats, ok := pc.stats[modelID]
+	if !ok {
+		return nil
+	}
+	stats.Entries = len(pc.entries[modelID])
+	return &stats
+}
+
+func (pc *prefixCheckpoints) Reset() {
+	pc.Lock()
+	defer pc.Unlock()
+	pc.entries = make(map[string]map[string]prefixCheckpoint)
+	pc.stats = make(map[string]PrefixCacheStats)
+}
+
+// handleTokenMetricsForPrefixCache feeds the cache counters of prefix_stable
+// responses into the checkpoint stats
+func (pm *ProxyManager) handleTokenMetricsForPrefixCache(e TokenMetricsEvent) {
+	if e.Metrics.PromptPolicy != string(PromptOptimizationPrefixStable) {
+		return
+	}
+	pm.prefixCheckpoints.recordUsage(e.Metrics.Model, e.Metrics.CachedTokens, e.Metrics.InputTokens)
+}
+
+// optimizePrefixStable applies the prefix_stable policy. A request that
+// continues a checkpointed conversation is sent as the checkpoint followed by
+// the messages appended since, so the upstream sees exactly the prefix it
+// cached on the previous turn. Only when that no longer fits is a new
+// checkpoint compacted from the full conversation, down to checkpointPercent
+// of the prompt budget so many turns fit before the next one.
+func (pm *ProxyManager) optimizePrefixStable(opt *promptOptimization, chatReq ChatRequest, checkpointPercent int, writeMessages func([]byte, []ChatMessage) ([]byte, error), dryRun bool) error {
+	result := &opt.result
+	cm := opt.cm
+	modelID := cm.modelID
+
+	prefixHashes := summaryPrefixHashes(chatReq.Messages)
+	checkpoint, covered := pm.prefixCheckpoints.lookup(modelID, prefixHashes, dryRun)
+
+	messages, tools := chatReq.Messages, chatReq.Tools
+	if covered > 0 {
+		messages = append(checkpoint.messages[:len(checkpoint.messages):len(checkpoint.messages)], chatReq.Messages[covered:]...)
+		tools = pruneToolSchemas(tools, checkpoint.toolsStripped, checkpoint.prunedTools)
+	}
+
+	fits := true
+	info := cm.GetContextInfo(chatReq.MaxTokens)
+	if cm.ctxSize > 0 {
+		tokens, err := cm.CountChatTokens(messages, tools)
+		if err != nil {
+			return fmt.Errorf("failed to count tokens: %w", err)
+		}
+		requested := requestedOutputTokens(opt.body)
+		if clamped := cm.clampOutputTokens(requested, tokens); clamped < requested {
+			if err := clampRequestMaxTokens(opt, requested, clamped); err != nil {
+				return err
+			}
+			info = cm.GetContextInfo(clamped)
+		}
+		fits = tokens <= info.SafePromptTokens
+	}
+
+	if fits {
+		if covered == 0 {
+			return nil
+		}
+		if !dryRun {
+			pm.prefixCheckpoints.recordReuse(modelID)
+		}
+		result.addStep(fmt.Sprintf("reused prefix checkpoint covering %d message(s)", covered))
+		return writePrefixStable(opt, messages, tools, checkpoint.toolsStripped, checkpoint.prunedTools, writeMessages)
+	}
+
+	// a new checkpoint starts from the full conversation, not from the old
+	// checkpoint, so earlier compaction is not compounded
+	messages, stripped := cm.stripHistoricalReasoning(chatReq.Messages)
+	messages, truncated := cm.truncateToolResults(messages)
+	messages, deduped := dedupeRepeatedBlocks(messages)
+	target := info.SafePromptTokens * checkpointPercent / 100
+	tools, toolsStripped, prunedTools := cm.applyToolBudget(messages, chatReq.Tools, chatReq.ToolChoice, target)
+	messages, omitted := cm.omitOldImages(messages, tools, target)
+	messages, tools = cm.applySlidingWindow(messages, tools, target)
+
+	if !dryRun {
+		pm.prefixCheckpoints.store(modelID, prefixHashes[len(chatReq.Messages)], prefixCheckpoint{
+			messages:      messages,
+			toolsStripped: toolsStripped,
+			prunedTools:   prunedTools,
+		})
+		pm.proxyLogger.Infof("<%s> Prompt compacted to a new prefix checkpoint: %d -> %d messages", modelID, len(chatReq.Messages), len(messages))
+	}
+	result.StrippedReasoning = stripped
+	result.DedupedBlocks = deduped
+	result.TruncatedToolResults = truncated
+	result.PrunedTools = prunedTools
+	result.OmittedImages = omitted
+	result.addStep(fmt.Sprintf("compacted to new prefix checkpoint (%d -> %d messages)", len(chatReq.Messages), len(messages)))
+	if truncated > 0 {
+		result.addStep(fmt.Sprintf("truncated %d tool result(s)", truncated))
+	}
+	return writePrefixStable(opt, messages, tools, toolsStripped, prunedTools, writeMessages)
+}
+
+// writePrefixStable patches the messages and tool pruning of a prefix_stable
+// request into its body
+func writePrefixStable(opt *promptOptimization, messages []ChatMessage, tools []ToolSchema, toolsStripped bool, prunedTools []string, writeMessages func([]byte, []ChatMessage) ([]byte, error)) error {
+	body, err := writeMessages(opt.body, messages)
+	if err != nil {
+		return fmt.Errorf("failed to update chat messages: %w", err)
+	}
+	if toolsStripped || len(prunedTools) > 0 {
+		if body, err = writeToolPruning(body, opt.format, toolsStripped, prunedTools); err != nil {
+			return fmt.Errorf("failed to update chat tools: %w", err)
+		}
+	}
+	opt.body = body
+	opt.messages = messages
+	opt.tools = tools
+	opt.result.Applied = true
+	return nil
+}
+
+// pruneToolSchemas repeats the tool budget decisions of a checkpoint on the
+// parsed tools of a later request
+func pruneToolSchemas(tools []ToolSchema, stripped bool, pruned []string) []ToolSchema {
+	if stripped {
+		tools = stripToolSchemas(tools)
+	}
+	if len(pruned) == 0 {
+		return tools
+	}
+	drop := make(map[string]bool, len(pruned))
+	for _, name := range pruned {
+		drop[name] = true
+	}
+	kept := make([]ToolSchema, 0, len(tools))
+	for _, tool := range tools {
+		if !drop[tool.Function.Name] {
+			kept = append(kept, tool)
+		}
+	}
+	return kept
+}
@@ -96,6 +96,21 @@ func (pg *ProcessGroup) GetMember(modelName string) (*Process, bool) {
 	return nil, false
 }
 
+// IsServing reports whether modelID is running and a request to it would
+// not swap out another model of the group
+func (pg *ProcessGroup) IsServing(modelID string) bool {
+	process, ok := pg.GetMember(modelID)
+	if !ok || process.CurrentState() != StateReady {
+		return false
+	}
+	if !pg.swap {
+		return true
+	}
+	pg.Lock()
+	defer pg.Unlock()
+	return pg.lastUsedProcess == modelID
+}
+
 func (pg *ProcessGroup) StopProcess(modelID string, strategy StopStrategy) error {
 	pg.Lock()
 
@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/event"
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/config"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// promptOptimizeOptions adjust a single run of optimizePrompt
+type promptOptimizeOptions struct {
+	// policy replaces the model's effective policy when set
+	policy PromptOptimizationPolicy
+	// dryRun never contacts the summarizer and leaves caches untouched
+	dryRun bool
+	// ctxSize replaces the model's effective context size when set
+	ctxSize int
+	// retry marks a second attempt after the upstream rejected the prompt
+	// for exceeding its context
+	retry bool
+}
+
+// promptOptimization is the outcome of optimizePrompt
+type promptOptimization struct {
+	body   []byte
+	result PromptOptimizationResult
+
+	// evaluated is false when the request was passed through without
+	// looking at it, e.g. it has no messages or the model is unknown
+	evaluated bool
+	format    MessageFormat
+	original  ChatRequest
+	messages  []ChatMessage
+	tools     []ToolSchema
+	cm        *ContextManager
+
+	// tokensBefore and tokensAfter are the sizes of original and messages
+	// when cropping already counted both, which tokensCounted reports
+	tokensBefore  int
+	tokensAfter   int
+	tokensCounted bool
+}
+
+// PromptMessageChange describes what optimization did to one message.
+// Index refers to the request's messages array; for /v1/messages requests
+// the top-level system prompt counts as message 0.
+type PromptMessageChange struct {
+	Index       int    `json:"index"`
+	Role        string `json:"role"`
+	Action      string `json:"action"` // dropped, compacted or summarized
+	LinesBefore int    `json:"linesBefore,omitempty"`
+	LinesAfter  int    `json:"linesAfter,omitempty"`
+}
+
+// PromptOptimizationPreview is returned by the prompt-optimization preview API
+type PromptOptimizationPreview struct {
+	Model                string                   `json:"model"`
+	Policy               PromptOptimizationPolicy `json:"policy"`
+	Format               MessageFormat            `json:"format"`
+	Applied              bool                     `json:"applied"`
+	Note                 string                   `json:"note"`
+	TokensBefore         int                      `json:"tokensBefore"`
+	TokensAfter          int                      `json:"tokensAfter"`
+	Changes              []PromptMessageChange    `json:"changes"`
+	PrunedTools          []string                 `json:"prunedTools,omitempty"`
+	TruncatedToolResults int                      `json:"truncatedToolResults,omitempty"`
+	OptimizedBody        json.RawMessage          `json:"optimizedBody"`
+}
+
+// diffPromptMessages compares the messages of a request before and after
+// optimization using the origin recorded on every parsed message.
+func diffPromptMessages(original, optimized []ChatMessage) []PromptMessageChange {
+	kept := make(map[int]ChatMessage, len(optimized))
+	summarized := make(map[int]bool)
+	for _, msg := range optimized {
+		if msg.origin > 0 {
+			kept[msg.origin] = msg
+		}
+		for _, origin := range msg.summarizes {
+			summarized[origin] = true
+		}
+	}
+
+	changes := make([]PromptMessageChange, 0)
+	for _, msg := range original {
+		change := PromptMessageChange{Index: msg.origin - 1, Role: msg.Role}
+		after, ok := kept[msg.origin]
+		switch {
+		case !ok && summarized[msg.origin]:
+			change.Action = "summarized"
+		case !ok:
+			change.Action = "dropped"
+		default:
+			beforeText := chatContentToText(msg.Content)
+			afterText := chatContentToText(after.Content)
+			if beforeText == afterText {
+				continue
+			}
+			change.Action = "compacted"
+			change.LinesBefore = countLines(beforeText)
+			change.LinesAfter = countLines(afterText)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func countLines(text string) int {
+	if text == "" {
+		return 0
+	}
+	return strings.Count(text, "\n") + 1
+}
+
+// detectMessageFormat guesses the wire format of a captured request body.
+// Anthropic requests have a top-level system prompt or tool_use/tool_result
+// content blocks.
+func detectMessageFormat(body []byte) MessageFormat {
+	if gjson.GetBytes(body, "system").Exists() {
+		return MessageFormatAnthropic
+	}
+	for _, msg := range gjson.GetBytes(body, "messages").Array() {
+		for _, block := range msg.Get("content").Array() {
+			switch block.Get("type").String() {
+			case "tool_use", "tool_result":
+				return MessageFormatAnthropic
+			}
+		}
+	}
+	return MessageFormatOpenAI
+}
+
+// countTokens counts the prompt before and after optimization with
+// CountChatTokens. Unchanged prompts are only counted once.
+func (opt promptOptimization) countTokens() (int, int, error) {
+	before, err := opt.cm.CountChatTokens(opt.original.Messages, opt.original.Tools)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !opt.result.Applied {
+		return before, before, nil
+	}
+	after, err := opt.cm.CountChatTokens(opt.messages, opt.tools)
+	if err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
+
+// maxPromptOptimizationHistory is the number of entries kept per model
+const maxPromptOptimizationHistory = 50
+
+// PromptOptimizationHistoryEntry records one optimization of a request
+type PromptOptimizationHistoryEntry struct {
+	ID           uint64                   `json:"id"`
+	Model        string                   `json:"model"`
+	Policy       PromptOptimizationPolicy `json:"policy"`
+	Format       MessageFormat            `json:"format"`
+	Applied      bool                     `json:"applied"`
+	Note         string                   `json:"note"`
+	Timestamp    string                   `json:"timestamp"`
+	TokensBefore int                      `json:"tokensBefore"`
+	TokensAfter  int                      `json:"tokensAfter"`
+	Changes      []PromptMessageChange    `json:"changes"`
+	Retried      bool                     `json:"retried,omitempty"`
+	PrunedTools  []string                 `json:"prunedTools,omitempty"`
+	// TruncatedToolResults counts tool results cut to their head and tail
+	TruncatedToolResults int `json:"truncatedToolResults,omitempty"`
+	// Summary is the llm_assisted summary that replaced summarized messages
+	Summary string `json:"summary,omitempty"`
+}
+
+// PromptOptimizationEvent is emitted for every new history entry, and again
+// with the same ID once its token counts are filled in
+type PromptOptimizationEvent struct {
+	Entry PromptOptimizationHistoryEntry
+}
+
+func (e PromptOptimizationEvent) Type() uint32 {
+	return PromptOptimizationEventID // defined in events.go
+}
+
+// promptOptimizationCount is a history entry whose tokens are still to be
+// counted
+type promptOptimizationCount struct {
+	model string
+	id    uint64
+	opt   promptOptimization
+}
+
+// recordPromptOptimizationHistory appends opt to the model's history and
+// publishes it on the event bus. Token counts cropping did not already
+// compute are counted in the background and published as an update. Prompts
+// the optimization left unchanged are not counted.
+func (pm *ProxyManager) recordPromptOptimizationHistory(modelID string, opt promptOptimization) {
+	entry := PromptOptimizationHistoryEntry{
+		Model:                modelID,
+		Policy:               opt.result.Policy,
+		Format:               opt.format,
+		Applied:              opt.result.Applied,
+		Note:                 opt.result.Note,
+		Retried:              opt.result.Retried,
+		PrunedTools:          opt.result.PrunedTools,
+		TruncatedToolResults: opt.result.TruncatedToolResults,
+		Timestamp:            time.Now().UTC().Format(time.RFC3339),
+		Changes:              diffPromptMessages(opt.original.Messages, opt.messages),
+	}
+	for _, msg := range opt.messages {
+		if len(msg.summarizes) > 0 {
+			entry.Summary = chatContentToText(msg.Content)
+			break
+		}
+	}
+	if opt.tokensCounted {
+		entry.TokensBefore = opt.tokensBefore
+		entry.TokensAfter = opt.tokensAfter
+	}
+	id := pm.appendPromptOptimizationHistory(entry)
+	if opt.tokensCounted || !opt.result.Applied {
+		return
+	}
+
+	// counting can take /tokenize round trips the request must not wait for.
+	// Only as many entries as the history keeps wait, the oldest are dropped.
+	pm.Lock()
+	pm.promptOptimizationCounts = append(pm.promptOptimizationCounts, promptOptimizationCount{model: modelID, id: id, opt: opt})
+	if len(pm.promptOptimizationCounts) > maxPromptOptimizationHistory {
+		pm.promptOptimizationCounts = append([]promptOptimizationCount(nil), pm.promptOptimizationCounts[len(pm.promptOptimizationCounts)-maxPromptOptimizationHistory:]...)
+	}
+	start := !pm.promptOptimizationCounting
+	pm.promptOptimizationCounting = true
+	pm.Unlock()
+	if start {
+		go pm.countPromptOptimizationHistory()
+	}
+}
+
+// countPromptOptimizationHistory fills in the token counts of the waiting
+// history entries until none are left
+func (pm *ProxyManager) countPromptOptimizationHistory() {
+	for {
+		pm.Lock()
+		if len(pm.promptOptimizationCounts) == 0 {
+			pm.promptOptimizationCounting = false
+			pm.Unlock()
+			return
+		}
+		count := pm.promptOptimizationCounts[0]
+		pm.promptOptimizationCounts = pm.promptOptimizationCounts[1:]
+		pm.Unlock()
+
+		tokensBefore, tokensAfter, err := count.opt.countTokens()
+		if err != nil {
+			pm.proxyLogger.Debugf("<%s> could not count tokens for optimization history: %v", count.model, err)
+			continue
+		}
+		pm.updatePromptOptimizationHistory(count.model, count.id, tokensBefore, tokensAfter)
+	}
+}
+
+// appendPromptOptimizationHistory adds entry to the history and returns its ID
+func (pm *ProxyManager) appendPromptOptimizationHistory(entry PromptOptimizationHistoryEntry) uint64 {
+	pm.Lock()
+	pm.promptOptimizationSeq++
+	entry.ID = pm.promptOptimizationSeq
+	history := append(pm.promptOptimizationHistory[entry.Model], entry)
+	if len(history) > maxPromptOptimizationHistory {
+		history = append([]PromptOptimizationHistoryEntry(nil), history[len(history)-maxPromptOptimizationHistory:]...)
+	}
+	pm.promptOptimizationHistory[entry.Model] = history
+	pm.Unlock()
+
+	event.Emit(PromptOptimizationEvent{Entry: entry})
+	return entry.ID
+}
+
+// updatePromptOptimizationHistory sets the token counts of the entry with id,
+// unless it was dropped from the history in the meantime
+func (pm *ProxyManager) updatePromptOptimizationHistory(modelID string, id uint64, tokensBefore, tokensAfter int) {
+	pm.Lock()
+	history := pm.promptOptimizationHistory[modelID]
+	i := slices.IndexFunc(history, func(entry PromptOptimizationHistoryEntry) bool { return entry.ID == id })
+	if i < 0 {
+		pm.Unlock()
+		return
+	}
+	history[i].TokensBefore = tokensBefore
+	history[i].TokensAfter = tokensAfter
+	entry := history[i]
+	pm.Unlock()
+
+	event.Emit(PromptOptimizationEvent{Entry: entry})
+}
+
+const (
+	// PromptOptimizationHeader picks the prompt optimization policy for a
+	// single request
+	PromptOptimizationHeader = "X-LlamaSwap-Prompt-Optimization"
+	// promptOptimizationBodyField is the body equivalent of the header. It
+	// is removed before the request is forwarded.
+	promptOptimizationBodyField = "llamaswap_prompt_optimization"
+)
+
+// requestPromptOptimizationPolicy returns the policy a request picked for
+// itself, or "" when it did not. The header wins over the body field, and
+// the body field is always stripped from the returned body.
+func requestPromptOptimizationPolicy(header http.Header, body []byte) (PromptOptimizationPolicy, []byte, error) {
+	raw := strings.TrimSpace(header.Get(PromptOptimizationHeader))
+	source := PromptOptimizationHeader
+	if field := gjson.GetBytes(body, promptOptimizationBodyField); field.Exists() {
+		var err error
+		if body, err = sjson.DeleteBytes(body, promptOptimizationBodyField); err != nil {
+			return "", nil, fmt.Errorf("error removing %s from request: %w", promptOptimizationBodyField, err)
+		}
+		if raw == "" {
+			raw = strings.TrimSpace(field.String())
+			source = promptOptimizationBodyField
+		}
+	}
+	if raw == "" {
+		return "", body, nil
+	}
+
+	policy := PromptOptimizationPolicy(strings.ToLower(raw))
+	if !isValidPromptOptimizationPolicy(policy) {
+		return "", nil, fmt.Errorf("%s must be one of: %s", source, strings.Join(config.PromptOptimizationPolicies, ", "))
+	}
+	return policy, body, nil
+}
+
+// authorizePromptOptimizationOverride checks that the request may pick
+// policy for modelID: the policy must be in the model's allowedOverrides and,
+// when promptOptimizationOverrideKeys is set, the request must have used one
+// of those API keys.
+func (pm *ProxyManager) authorizePromptOptimizationOverride(c *gin.Context, modelID string, policy PromptOptimizationPolicy) error {
+	if policy == "" {
+		return nil
+	}
+
+	if keys := pm.config.PromptOptimizationOverrideKeys; len(keys) > 0 {
+		if !slices.Contains(keys, c.GetString(apiKeyContextKey)) {
+			return fmt.Errorf("this API key may not override the prompt optimization policy")
+		}
+	}
+
+	if modelConfig, ok := pm.config.Models[modelID]; ok && !modelConfig.PromptOptimization.AllowsOverride(string(policy)) {
+		return fmt.Errorf("prompt optimization policy %s is not allowed for model %s", policy, modelID)
+	}
+	return nil
+}
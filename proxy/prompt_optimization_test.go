@@ -0,0 +1,1090 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/event"
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestProxyManager_LLMAssistedUsesSummarizerModel(t *testing.T) {
+	var summarizerBody string
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		summarizerBody = string(b)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"SUMMARY-FROM-PEER"}}],"usage":{"prompt_tokens":10,"completion_tokens":3,"total_tokens":13}}`))
+	}))
+	defer peerServer.Close()
+
+	configStr := fmt.Sprintf(`
+logLevel: error
+peers:
+  test-peer:
+    proxy: %s
+    models:
+      - summarizer
+    filters:
+      stripParams: "temperature"
+      setParams:
+        top_k: 7
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      policy: llm_assisted
+      keepTail: 2
+      summarizerModel: summarizer
+`, peerServer.URL, getSimpleResponderPath())
+
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	reqBody := `{"model":"local-model","messages":[
+		{"role":"system","content":"sys"},
+		{"role":"user","content":"first question"},
+		{"role":"assistant","content":"first answer"},
+		{"role":"user","content":"second question"},
+		{"role":"assistant","content":"second answer"},
+		{"role":"user","content":"latest question"}
+	]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "summarizer", gjson.Get(summarizerBody, "model").String())
+	assert.False(t, gjson.Get(summarizerBody, "temperature").Exists(), "summarizer filters apply")
+	assert.Equal(t, int64(7), gjson.Get(summarizerBody, "top_k").Int())
+	assert.Contains(t, summarizerBody, "first question")
+	assert.NotContains(t, summarizerBody, "latest question")
+
+	upstreamBody := gjson.Get(w.Body.String(), "request_body").String()
+	assert.Contains(t, upstreamBody, "SUMMARY-FROM-PEER")
+	assert.NotContains(t, upstreamBody, "first question")
+	assert.Contains(t, upstreamBody, "latest question")
+
+	found := false
+	for _, m := range proxy.metricsMonitor.getMetrics() {
+		if m.Model == "summarizer" {
+			found = true
+		}
+	}
+	assert.True(t, found, "summarizer call should be recorded in metrics")
+}
+
+func TestProxyManager_LLMAssistedNeverSwapsInSummarizer(t *testing.T) {
+	configStr := fmt.Sprintf(`
+logLevel: error
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      policy: llm_assisted
+      keepTail: 2
+      summarizerModel: summarizer
+  summarizer:
+    cmd: %s -port ${PORT} -silent -respond summarizer
+`, getSimpleResponderPath(), getSimpleResponderPath())
+
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	reqBody := `{"model":"local-model","messages":[
+		{"role":"system","content":"sys"},
+		{"role":"user","content":"first question"},
+		{"role":"assistant","content":"first answer"},
+		{"role":"user","content":"second question"},
+		{"role":"assistant","content":"second answer"},
+		{"role":"user","content":"latest question"}
+	]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+
+	// the summarizer shares the swapping group, loading it would unload
+	// local-model, so the prompt is compacted without a summary
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, gjson.Get(w.Body.String(), "request_body").String(), "latest question")
+	group := proxy.findGroupByModelName("summarizer")
+	assert.Equal(t, StateStopped, group.processes["summarizer"].CurrentState())
+	assert.Equal(t, StateReady, group.processes["local-model"].CurrentState())
+	for _, m := range proxy.metricsMonitor.getMetrics() {
+		assert.NotEqual(t, "summarizer", m.Model)
+	}
+}
+
+func TestProxyManager_LLMAssistedSummaryCache(t *testing.T) {
+	var summarizerInputs []string
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		summarizerInputs = append(summarizerInputs, gjson.GetBytes(b, "messages.1.content").String())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"choices":[{"message":{"role":"assistant","content":"SUMMARY-%d"}}]}`, len(summarizerInputs))
+	}))
+	defer peerServer.Close()
+
+	configStr := fmt.Sprintf(`
+logLevel: error
+peers:
+  test-peer:
+    proxy: %s
+    models:
+      - summarizer
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      policy: llm_assisted
+      keepTail: 2
+      summarizerModel: summarizer
+`, peerServer.URL, getSimpleResponderPath())
+
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	history := []string{
+		`{"role":"system","content":"sys"}`,
+		`{"role":"user","content":"q1"}`,
+		`{"role":"assistant","content":"a1"}`,
+		`{"role":"user","content":"q2"}`,
+		`{"role":"assistant","content":"a2"}`,
+	}
+	optimize := func(messages []string) string {
+		body := []byte(`{"model":"local-model","messages":[` + strings.Join(messages, ",") + `]}`)
+		out, _, err := proxy.applyPromptSizeControl("local-model", "/v1/chat/completions", body, "")
+		assert.NoError(t, err)
+		return string(out)
+	}
+
+	// first request summarizes q1..a1
+	out := optimize(history)
+	assert.Contains(t, out, "SUMMARY-1")
+	assert.Len(t, summarizerInputs, 1)
+
+	// identical history is served from cache
+	out = optimize(history)
+	assert.Contains(t, out, "SUMMARY-1")
+	assert.Len(t, summarizerInputs, 1)
+
+	// appended messages extend the cached summary with only the new messages
+	history = append(history, `{"role":"user","content":"q3"}`, `{"role":"assistant","content":"a3"}`)
+	out = optimize(history)
+	assert.Contains(t, out, "SUMMARY-2")
+	if assert.Len(t, summarizerInputs, 2) {
+		assert.Contains(t, summarizerInputs[1], "[EXISTING SUMMARY] SUMMARY-1")
+		assert.Contains(t, summarizerInputs[1], "q2")
+		assert.NotContains(t, summarizerInputs[1], "q1")
+	}
+
+	proxy.Lock()
+	snapshot := proxy.latestPromptOptimizations["local-model"]
+	proxy.Unlock()
+	assert.Contains(t, snapshot.Note, "summary cache extend")
+	if assert.NotNil(t, snapshot.SummaryCache) {
+		assert.Equal(t, 1, snapshot.SummaryCache.Hits)
+		assert.Equal(t, 1, snapshot.SummaryCache.Extends)
+		assert.Equal(t, 1, snapshot.SummaryCache.Misses)
+		assert.Equal(t, 2, snapshot.SummaryCache.Entries)
+	}
+
+	// previews leave the eviction order alone
+	lastUsed := func() map[string]time.Time {
+		proxy.summaryCache.Lock()
+		defer proxy.summaryCache.Unlock()
+		used := make(map[string]time.Time)
+		for key, entry := range proxy.summaryCache.entries["local-model"] {
+			used[key] = entry.lastUsed
+		}
+		return used
+	}
+	before := lastUsed()
+	body := []byte(`{"model":"local-model","messages":[` + strings.Join(history, ",") + `]}`)
+	_, err = proxy.optimizePrompt("local-model", "/v1/chat/completions", body, promptOptimizeOptions{dryRun: true})
+	assert.NoError(t, err)
+	assert.Len(t, summarizerInputs, 2)
+	assert.Equal(t, before, lastUsed())
+}
+
+func TestContextManager_AnthropicCropKeepsToolPairs(t *testing.T) {
+	tokenizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"error":"unsupported"}`))
+	}))
+	defer tokenizer.Close()
+
+	long := strings.Repeat("lorem ", 80)
+	body := []byte(`{"model":"m","max_tokens":100,"system":"You are helpful.",
+		"tools":[{"name":"read_file","description":"Read a file","input_schema":{"type":"object","properties":{"path":{"type":"string"}}}}],
+		"messages":[
+		{"role":"user","content":"first question ` + long + `"},
+		{"role":"assistant","content":[{"type":"text","text":"let me look"},{"type":"tool_use","id":"toolu_1","name":"read_file","input":{"path":"a.go"}}]},
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"` + long + `"}]},
+		{"role":"assistant","content":"a.go contains the handler"},
+		{"role":"user","content":"second question"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"toolu_2","name":"read_file","input":{"path":"b.go"}}]},
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_2","content":"package b"}]}
+	]}`)
+
+	chatReq, err := parseAnthropicChatRequest(body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "system", chatReq.Messages[0].Role)
+	assert.Len(t, chatReq.Tools, 1)
+
+	cm := NewContextManager("m", 300, SlidingWindow, testLogger, tokenizer.URL).WithMessageFormat(MessageFormatAnthropic)
+	cropped, err := cm.CropChatRequest(chatReq)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cropped.IsCropped())
+
+	out, err := writeAnthropicChatRequest(body, cropped.Messages)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "You are helpful.", gjson.GetBytes(out, "system").String())
+	assert.Equal(t, "read_file", gjson.GetBytes(out, "tools.0.name").String())
+
+	messages := gjson.GetBytes(out, "messages").Array()
+	if assert.NotEmpty(t, messages) {
+		assert.Equal(t, "user", messages[0].Get("role").String())
+	}
+	assert.Contains(t, string(out), "toolu_2")
+	for i, msg := range messages {
+		assert.NotEqual(t, "system", msg.Get("role").String())
+		for _, block := range msg.Get("content").Array() {
+			if block.Get("type").String() != "tool_result" {
+				continue
+			}
+			id := block.Get("tool_use_id").String()
+			if assert.Greater(t, i, 0, "tool_result %s has no preceding message", id) {
+				found := false
+				for _, prev := range messages[i-1].Get("content").Array() {
+					if prev.Get("type").String() == "tool_use" && prev.Get("id").String() == id {
+						found = true
+					}
+				}
+				assert.True(t, found, "tool_result %s separated from its tool_use", id)
+			}
+		}
+	}
+}
+
+func TestProxyManager_AnthropicMessagesCompaction(t *testing.T) {
+	configStr := fmt.Sprintf(`
+logLevel: error
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      policy: always
+`, getSimpleResponderPath())
+
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	body := []byte(`{"model":"local-model","system":[{"type":"text","text":"sys","cache_control":{"type":"ephemeral"}}],"messages":[
+		{"role":"user","content":"run the tests"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"bash","input":{"cmd":"go test"}}]},
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"ok\nok\nok\nok\nFAIL"}]}]}
+	]}`)
+
+	out, result, err := proxy.applyPromptSizeControl("local-model", "/v1/messages", body, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, result.Applied)
+	assert.Equal(t, "ephemeral", gjson.GetBytes(out, "system.0.cache_control.type").String())
+	assert.Equal(t, 3, len(gjson.GetBytes(out, "messages").Array()))
+	assert.Equal(t, "toolu_1", gjson.GetBytes(out, "messages.2.content.0.tool_use_id").String())
+	assert.Equal(t, "ok\n[repeated 3 more line(s) removed]\nFAIL", gjson.GetBytes(out, "messages.2.content.0.content.0.text").String())
+
+	// token counting requests are never rewritten
+	out, _, err = proxy.applyPromptSizeControl("local-model", "/v1/messages/count_tokens", body, "")
+	assert.NoError(t, err)
+	assert.Equal(t, string(body), string(out))
+}
+
+// TestProxyManager_PromptOptimizationPreservesUnknownFields checks that no
+// policy loses request or message fields the optimizer does not model
+func TestProxyManager_PromptOptimizationPreservesUnknownFields(t *testing.T) {
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"SUMMARY"}}]}`))
+	}))
+	defer peerServer.Close()
+
+	fixture, err := os.ReadFile(filepath.Join("testdata", "prompt_optimization", "chat_request_extra_fields.json"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	configStr := fmt.Sprintf(`
+logLevel: error
+peers:
+  test-peer:
+    proxy: %s
+    models:
+      - summarizer
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      keepTail: 3
+      summarizerModel: summarizer
+`, peerServer.URL, getSimpleResponderPath())
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	inputMessages := make(map[string]gjson.Result)
+	for _, msg := range gjson.GetBytes(fixture, "messages").Array() {
+		inputMessages[msg.Get("x_id").String()] = msg
+	}
+
+	policies := []PromptOptimizationPolicy{
+		PromptOptimizationOff,
+		PromptOptimizationLimitOnly,
+		PromptOptimizationAlways,
+		PromptOptimizationLLMAssist,
+	}
+	// 0 skips cropping, 4096 fits the request, 180 forces cropping
+	for _, ctxSize := range []int{0, 4096, 180} {
+		for _, policy := range policies {
+			name := fmt.Sprintf("%s/ctx=%d", policy, ctxSize)
+			proxy.Lock()
+			proxy.promptPolicies["local-model"] = policy
+			proxy.ctxSizes["local-model"] = ctxSize
+			proxy.Unlock()
+
+			out, result, err := proxy.applyPromptSizeControl("local-model", "/v1/chat/completions", fixture, "")
+			if !assert.NoError(t, err, name) {
+				continue
+			}
+			if ctxSize == 180 && policy != PromptOptimizationOff {
+				assert.True(t, result.Applied, name)
+				assert.Less(t, len(gjson.GetBytes(out, "messages").Array()), len(inputMessages), name)
+			}
+
+			gjson.ParseBytes(fixture).ForEach(func(key, value gjson.Result) bool {
+				if key.String() != "messages" {
+					assert.Equal(t, value.Raw, gjson.GetBytes(out, key.String()).Raw, "%s: field %s", name, key.String())
+				}
+				return true
+			})
+
+			for _, msg := range gjson.GetBytes(out, "messages").Array() {
+				original, ok := inputMessages[msg.Get("x_id").String()]
+				if !ok {
+					continue
+				}
+				for _, field := range []string{"role", "name", "tool_call_id", "reasoning_content", "tool_calls"} {
+					assert.JSONEq(t, orNull(original.Get(field).Raw), orNull(msg.Get(field).Raw), "%s: %s.%s", name, msg.Get("x_id").String(), field)
+				}
+			}
+
+			if policy == PromptOptimizationOff || (policy == PromptOptimizationLimitOnly && ctxSize != 180) {
+				assert.Equal(t, string(fixture), string(out), "%s: untouched requests must be byte-identical", name)
+			}
+		}
+	}
+}
+
+func orNull(raw string) string {
+	if raw == "" {
+		return "null"
+	}
+	return raw
+}
+
+func TestProxyManager_PromptOptimizationPreview(t *testing.T) {
+	summarizerCalls := 0
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		summarizerCalls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer peerServer.Close()
+
+	configStr := fmt.Sprintf(`
+logLevel: error
+peers:
+  test-peer:
+    proxy: %s
+    models:
+      - summarizer
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      keepTail: 2
+      summarizerModel: summarizer
+`, peerServer.URL, getSimpleResponderPath())
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	body := `{"model":"local-model","temperature":0.2,"messages":[
+		{"role":"system","content":"sys"},
+		{"role":"user","content":"` + strings.Repeat("error: connection refused by upstream database host\\n", 4) + `what failed?"},
+		{"role":"assistant","content":"the parser"},
+		{"role":"user","content":"fix it"},
+		{"role":"assistant","content":"done"},
+		{"role":"user","content":"thanks"}
+	]}`
+	preview := func(query string) (int, PromptOptimizationPreview) {
+		req := httptest.NewRequest(http.MethodPost, "/api/model/local-model/prompt-optimization/preview"+query, strings.NewReader(body))
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		var out PromptOptimizationPreview
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		}
+		return w.Code, out
+	}
+
+	code, out := preview("?policy=always")
+	if assert.Equal(t, http.StatusOK, code) {
+		assert.Equal(t, PromptOptimizationAlways, out.Policy)
+		assert.Equal(t, MessageFormatOpenAI, out.Format)
+		assert.True(t, out.Applied)
+		assert.Less(t, out.TokensAfter, out.TokensBefore)
+		assert.Equal(t, []PromptMessageChange{{Index: 1, Role: "user", Action: "compacted", LinesBefore: 5, LinesAfter: 3}}, out.Changes)
+		assert.Equal(t, 0.2, gjson.GetBytes(out.OptimizedBody, "temperature").Float())
+	}
+
+	code, out = preview("?policy=llm_assisted")
+	if assert.Equal(t, http.StatusOK, code) {
+		actions := make(map[int]string)
+		for _, change := range out.Changes {
+			actions[change.Index] = change.Action
+		}
+		assert.Equal(t, map[int]string{1: "summarized", 2: "summarized", 3: "summarized"}, actions)
+		assert.Contains(t, string(out.OptimizedBody), "would be summarized by summarizer")
+	}
+
+	code, _ = preview("?policy=bogus")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// a preview never forwards, summarizes or records anything
+	assert.Equal(t, 0, summarizerCalls)
+	assert.Nil(t, proxy.summaryCache.Stats("local-model"))
+	assert.Nil(t, proxy.tokenCounts.Stats("local-model"))
+	proxy.Lock()
+	_, hasSnapshot := proxy.latestPromptOptimizations["local-model"]
+	_, hasPolicy := proxy.promptPolicies["local-model"]
+	proxy.Unlock()
+	assert.False(t, hasSnapshot)
+	assert.False(t, hasPolicy)
+	assert.Equal(t, StateStopped, proxy.findGroupByModelName("local-model").processes["local-model"].CurrentState())
+}
+
+func TestProxyManager_PromptOptimizationHistory(t *testing.T) {
+	configStr := fmt.Sprintf(`
+logLevel: error
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      policy: always
+`, getSimpleResponderPath())
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	received := make(chan PromptOptimizationHistoryEntry, maxPromptOptimizationHistory+10)
+	defer event.On(func(e PromptOptimizationEvent) {
+		received <- e.Entry
+	})()
+
+	body := []byte(`{"model":"local-model","messages":[
+		{"role":"user","content":"` + strings.Repeat("warning: deprecated call in module loader\\n", 5) + `why?"},
+		{"role":"assistant","content":"old api"},
+		{"role":"user","content":"fix it"}
+	]}`)
+	for i := 0; i < maxPromptOptimizationHistory+5; i++ {
+		_, _, err := proxy.applyPromptSizeControl("local-model", "/v1/chat/completions", body, "")
+		assert.NoError(t, err)
+	}
+	// entries are added right away, without a ctx size nothing was counted
+	// while cropping and the counts are filled in in the background
+	proxy.Lock()
+	assert.Equal(t, uint64(maxPromptOptimizationHistory+5), proxy.promptOptimizationSeq)
+	proxy.Unlock()
+	assert.Eventually(t, func() bool {
+		proxy.Lock()
+		defer proxy.Unlock()
+		return !proxy.promptOptimizationCounting
+	}, 5*time.Second, 10*time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/model/local-model/prompt-optimization/history", nil)
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	if !assert.Equal(t, http.StatusOK, w.Code) {
+		return
+	}
+	var resp struct {
+		Model   string                           `json:"model"`
+		Entries []PromptOptimizationHistoryEntry `json:"entries"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "local-model", resp.Model)
+	if assert.Len(t, resp.Entries, maxPromptOptimizationHistory) {
+		last := resp.Entries[len(resp.Entries)-1]
+		assert.Equal(t, uint64(maxPromptOptimizationHistory+5), last.ID)
+		assert.Equal(t, uint64(6), resp.Entries[0].ID)
+		assert.Equal(t, PromptOptimizationAlways, last.Policy)
+		assert.Equal(t, []PromptMessageChange{{Index: 0, Role: "user", Action: "compacted", LinesBefore: 6, LinesAfter: 3}}, last.Changes)
+		assert.Greater(t, last.TokensBefore, last.TokensAfter)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/model/local-model/prompt-optimization/history?limit=2", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Entries, 2)
+
+	select {
+	case entry := <-received:
+		assert.Equal(t, "local-model", entry.Model)
+		assert.NotEmpty(t, entry.Changes)
+	case <-time.After(time.Second):
+		t.Fatal("no prompt optimization event received")
+	}
+
+	// an unchanged prompt is recorded without counting
+	_, _, err = proxy.applyPromptSizeControl("local-model", "/v1/chat/completions", body, PromptOptimizationOff)
+	assert.NoError(t, err)
+	proxy.Lock()
+	history := proxy.promptOptimizationHistory["local-model"]
+	last := history[len(history)-1]
+	counting := proxy.promptOptimizationCounting
+	proxy.Unlock()
+	assert.Equal(t, uint64(maxPromptOptimizationHistory+6), last.ID)
+	assert.False(t, last.Applied)
+	assert.Zero(t, last.TokensBefore)
+	assert.False(t, counting)
+}
+
+func TestProxyManager_PromptOptimizationRequestOverride(t *testing.T) {
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response":"from-peer"}`))
+	}))
+	defer peerServer.Close()
+
+	configStr := fmt.Sprintf(`
+logLevel: error
+apiKeys: [trusted, untrusted]
+promptOptimizationOverrideKeys: [trusted]
+peers:
+  test-peer:
+    proxy: %s
+    models:
+      - peer-model
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      policy: always
+      allowedOverrides: [off, limit_only]
+`, peerServer.URL, getSimpleResponderPath())
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	send := func(apiKey, header, body string) *TestResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		if header != "" {
+			req.Header.Set(PromptOptimizationHeader, header)
+		}
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	body := `{"model":"local-model","messages":[{"role":"user","content":"hi"}]}`
+
+	w := send("trusted", "", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "always", w.Header().Get("X-LlamaSwap-Prompt-Optimization-Policy"))
+
+	w = send("trusted", "OFF", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "off", w.Header().Get("X-LlamaSwap-Prompt-Optimization-Policy"))
+
+	// the body field works too and is never forwarded upstream
+	w = send("trusted", "", `{"model":"local-model","llamaswap_prompt_optimization":"limit_only","messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "limit_only", w.Header().Get("X-LlamaSwap-Prompt-Optimization-Policy"))
+	assert.NotContains(t, gjson.Get(w.Body.String(), "request_body").String(), "llamaswap_prompt_optimization")
+
+	// the runtime policy is untouched by per-request overrides
+	policy, source := proxy.resolvePromptOptimizationPolicy("local-model")
+	assert.Equal(t, PromptOptimizationAlways, policy)
+	assert.Equal(t, "config", source)
+
+	w = send("trusted", "smart", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = send("trusted", "llm_assisted", body)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = send("untrusted", "off", body)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// peer models are checked the same way
+	peerBody := `{"model":"peer-model","messages":[{"role":"user","content":"hi"}]}`
+	w = send("untrusted", "llm_assisted", peerBody)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = send("trusted", "llm_assisted", peerBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestProxyManager_PromptOptimizationPrunesTools(t *testing.T) {
+	configStr := fmt.Sprintf(`
+logLevel: error
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+`, getSimpleResponderPath())
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+	proxy.Lock()
+	proxy.ctxSizes["local-model"] = 400
+	proxy.Unlock()
+
+	verbose := strings.Repeat("This sentence explains the parameter in far more detail than needed. ", 20)
+	tools := make([]map[string]any, 0)
+	for _, name := range []string{"read_file", "write_file", "grep", "glob", "bash", "web_fetch", "web_search", "todo", "notebook", "task"} {
+		tools = append(tools, map[string]any{
+			"type": "function",
+			"function": map[string]any{
+				"name":        name,
+				"description": "Runs " + name + ". " + verbose,
+				"strict":      true,
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"description": map[string]any{"type": "string", "description": verbose},
+						"path":        map[string]any{"type": "string", "description": verbose, "examples": []string{"a.go"}},
+					},
+				},
+			},
+		})
+	}
+	req := map[string]any{
+		"model":       "local-model",
+		"max_tokens":  100,
+		"tools":       tools,
+		"tool_choice": map[string]any{"type": "function", "function": map[string]any{"name": "write_file"}},
+		"messages": []map[string]any{
+			{"role": "user", "content": "look at a.go"},
+			{"role": "assistant", "content": "", "tool_calls": []map[string]any{
+				{"id": "call_1", "type": "function", "function": map[string]any{"name": "read_file", "arguments": `{"path":"a.go"}`}},
+			}},
+			{"role": "tool", "tool_call_id": "call_1", "content": "package main"},
+			{"role": "user", "content": "now write it"},
+		},
+	}
+	body, _ := json.Marshal(req)
+
+	out, result, err := proxy.applyPromptSizeControl("local-model", "/v1/chat/completions", body, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, result.Applied)
+	assert.NotEmpty(t, result.PrunedTools)
+	assert.NotContains(t, result.PrunedTools, "read_file")
+	assert.NotContains(t, result.PrunedTools, "write_file")
+
+	outTools := gjson.GetBytes(out, "tools").Array()
+	assert.Len(t, outTools, len(tools)-len(result.PrunedTools))
+	for _, tool := range outTools {
+		assert.True(t, tool.Get("function.strict").Bool())
+		assert.Equal(t, "Runs "+tool.Get("function.name").String()+".", tool.Get("function.description").String())
+		props := tool.Get("function.parameters.properties")
+		assert.True(t, props.Get("description").Exists(), "property named description must survive")
+		assert.False(t, props.Get("description.description").Exists())
+		assert.False(t, props.Get("path.description").Exists())
+		assert.False(t, props.Get("path.examples").Exists())
+		assert.Equal(t, "string", props.Get("path.type").String())
+	}
+	assert.Len(t, gjson.GetBytes(out, "messages").Array(), 4)
+
+	proxy.Lock()
+	snapshot := proxy.latestPromptOptimizations["local-model"]
+	proxy.Unlock()
+	assert.Equal(t, result.PrunedTools, snapshot.PrunedTools)
+
+	// cropping counted the prompt, the entry is recorded without counting again
+	proxy.Lock()
+	history := proxy.promptOptimizationHistory["local-model"]
+	proxy.Unlock()
+	if assert.Len(t, history, 1) {
+		assert.Greater(t, history[0].TokensBefore, history[0].TokensAfter)
+		assert.Equal(t, result.PrunedTools, history[0].PrunedTools)
+	}
+}
+
+func TestProxyManager_PromptOptimizationPrefixStable(t *testing.T) {
+	configStr := fmt.Sprintf(`
+logLevel: error
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      policy: prefix_stable
+`, getSimpleResponderPath())
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+	proxy.Lock()
+	proxy.ctxSizes["local-model"] = 2000
+	proxy.Unlock()
+
+	messages := []map[string]any{{"role": "system", "content": "You are a coding agent."}}
+	send := func() ([]byte, PromptOptimizationResult) {
+		body, _ := json.Marshal(map[string]any{"model": "local-model", "max_tokens": 100, "messages": messages})
+		out, result, err := proxy.applyPromptSizeControl("local-model", "/v1/chat/completions", body, "")
+		assert.NoError(t, err)
+		return out, result
+	}
+	addTurn := func(i int) {
+		messages = append(messages,
+			map[string]any{"role": "user", "content": strings.Repeat(fmt.Sprintf("question %d ", i), 30)},
+			map[string]any{"role": "assistant", "content": strings.Repeat(fmt.Sprintf("answer %d ", i), 30)},
+		)
+	}
+
+	// while the conversation fits it is sent as it is
+	addTurn(0)
+	out, result := send()
+	assert.False(t, result.Applied)
+	assert.Nil(t, proxy.prefixCheckpoints.Stats("local-model"))
+
+	// the first overflow compacts to a checkpoint well below the limit
+	for i := 1; i < 40; i++ {
+		addTurn(i)
+	}
+	out, result = send()
+	assert.True(t, result.Applied)
+	assert.True(t, strings.HasPrefix(result.Note, "compacted to new prefix checkpoint"), result.Note)
+	checkpointMessages := gjson.GetBytes(out, "messages").Array()
+	assert.Less(t, len(checkpointMessages), len(messages))
+
+	// later turns reuse the checkpoint byte for byte and only append
+	for i := 40; i < 43; i++ {
+		addTurn(i)
+		out, result = send()
+		assert.True(t, result.Applied)
+		assert.Contains(t, result.Note, "reused prefix checkpoint")
+		sent := gjson.GetBytes(out, "messages").Array()
+		if assert.Greater(t, len(sent), len(checkpointMessages)) {
+			for j, msg := range checkpointMessages {
+				assert.Equal(t, msg.Raw, sent[j].Raw)
+			}
+			assert.Equal(t, messages[len(messages)-1]["content"], sent[len(sent)-1].Get("content").String())
+		}
+	}
+
+	proxy.handleTokenMetricsForPrefixCache(TokenMetricsEvent{Metrics: TokenMetrics{
+		Model: "local-model", PromptPolicy: "prefix_stable", CachedTokens: 900, InputTokens: 40,
+	}})
+	proxy.handleTokenMetricsForPrefixCache(TokenMetricsEvent{Metrics: TokenMetrics{
+		Model: "local-model", PromptPolicy: "limit_only", CachedTokens: 5, InputTokens: 5,
+	}})
+	stats := proxy.prefixCheckpoints.Stats("local-model")
+	if assert.NotNil(t, stats) {
+		assert.Equal(t, 1, stats.Checkpoints)
+		assert.Equal(t, 3, stats.Reuses)
+		assert.Equal(t, 900, stats.CachedTokens)
+		assert.Equal(t, 40, stats.ProcessedTokens)
+	}
+
+	// previews leave the eviction order alone
+	lastUsed := func() map[string]time.Time {
+		proxy.prefixCheckpoints.Lock()
+		defer proxy.prefixCheckpoints.Unlock()
+		used := make(map[string]time.Time)
+		for key, entry := range proxy.prefixCheckpoints.entries["local-model"] {
+			used[key] = entry.lastUsed
+		}
+		return used
+	}
+	before := lastUsed()
+	body, _ := json.Marshal(map[string]any{"model": "local-model", "max_tokens": 100, "messages": messages})
+	opt, err := proxy.optimizePrompt("local-model", "/v1/chat/completions", body, promptOptimizeOptions{dryRun: true})
+	if assert.NoError(t, err) {
+		assert.Contains(t, opt.result.Note, "reused prefix checkpoint")
+	}
+	assert.Equal(t, before, lastUsed())
+}
+
+func TestProxyManager_PromptOptimizationClampsMaxTokens(t *testing.T) {
+	configStr := fmt.Sprintf(`
+logLevel: error
+models:
+  clamping-model:
+    cmd: %s -port ${PORT} -silent -respond clamping-model
+    promptOptimization:
+      clampMaxTokens: true
+      minOutputTokens: 512
+  strict-model:
+    cmd: %s -port ${PORT} -silent -respond strict-model
+`, getSimpleResponderPath(), getSimpleResponderPath())
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+	// as detected from /props, a runtime override would rewrite the cmd
+	proxy.Lock()
+	proxy.upstreamCtxSizes["clamping-model"] = 4096
+	proxy.upstreamCtxSizes["strict-model"] = 4096
+	proxy.Unlock()
+
+	send := func(model string, prompt string) *TestResponseRecorder {
+		body, _ := json.Marshal(map[string]any{
+			"model":                 model,
+			"max_tokens":            32000,
+			"max_completion_tokens": 32000,
+			"messages": []map[string]any{
+				{"role": "user", "content": prompt},
+				{"role": "assistant", "content": "ok"},
+				{"role": "user", "content": "go on"},
+			},
+		})
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(body)))
+		return w
+	}
+
+	// a short prompt leaves most of the context for the reply
+	w := send("clamping-model", "hello")
+	assert.Equal(t, http.StatusOK, w.Code)
+	clamped := w.Header().Get(MaxTokensClampedHeader)
+	if assert.NotEmpty(t, clamped) {
+		assert.Greater(t, gjson.Parse(clamped).Int(), int64(4000))
+		sent := gjson.Get(w.Body.String(), "request_body").String()
+		assert.Equal(t, clamped, gjson.Get(sent, "max_tokens").String())
+		assert.Equal(t, clamped, gjson.Get(sent, "max_completion_tokens").String())
+	}
+
+	// a long prompt is cropped to keep minOutputTokens for the reply
+	w = send("clamping-model", strings.Repeat("context ", 3500))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "512", w.Header().Get(MaxTokensClampedHeader))
+	assert.Equal(t, "true", w.Header().Get("X-LlamaSwap-Prompt-Optimized"))
+
+	// without clampMaxTokens the request is still rejected
+	w = send("strict-model", "hello")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "max_tokens")
+	assert.Empty(t, w.Header().Get(MaxTokensClampedHeader))
+}
+
+func TestProxyManager_PromptOptimizationReportsTruncatedToolResults(t *testing.T) {
+	configStr := fmt.Sprintf(`
+logLevel: error
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    promptOptimization:
+      toolResultMaxTokens: 50
+      toolResultKeepRecent: 1
+`, getSimpleResponderPath())
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	output := strings.Repeat("line of build output\n", 100)
+	messages := []map[string]any{{"role": "user", "content": "build it"}}
+	for i := 0; i < 3; i++ {
+		messages = append(messages,
+			map[string]any{"role": "assistant", "content": "", "tool_calls": []map[string]any{
+				{"id": fmt.Sprintf("call_%d", i), "type": "function", "function": map[string]any{"name": "build", "arguments": "{}"}},
+			}},
+			map[string]any{"role": "tool", "tool_call_id": fmt.Sprintf("call_%d", i), "content": output},
+		)
+	}
+	body, _ := json.Marshal(map[string]any{"model": "local-model", "messages": messages})
+
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("X-LlamaSwap-Prompt-Optimized"))
+	assert.Equal(t, "2", w.Header().Get(ToolResultsTruncatedHeader))
+
+	proxy.Lock()
+	history := proxy.promptOptimizationHistory["local-model"]
+	proxy.Unlock()
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, 2, history[0].TruncatedToolResults)
+		assert.Contains(t, history[0].Note, "truncated 2 tool result(s)")
+	}
+}
+
+func TestProxyManager_OverflowTargetReroutes(t *testing.T) {
+	var received []map[string]any
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		received = append(received, req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"from peer"}}],"usage":{"prompt_tokens":3000,"completion_tokens":2}}`))
+	}))
+	defer peerServer.Close()
+
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(fmt.Sprintf(`
+logLevel: error
+peers:
+  big-peer:
+    proxy: %s
+    models:
+      - big-model
+    filters:
+      setParams:
+        temperature: 0.2
+models:
+  small-model:
+    cmd: %s -port ${PORT} -silent -respond small-model
+    promptOptimization:
+      overflowTarget: big-model
+`, peerServer.URL, getSimpleResponderPath())))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+	proxy.Lock()
+	proxy.upstreamCtxSizes["small-model"] = 1024
+	proxy.Unlock()
+
+	send := func(prompt string) *TestResponseRecorder {
+		body, _ := json.Marshal(map[string]any{
+			"model":      "small-model",
+			"max_tokens": 64,
+			"messages":   []map[string]any{{"role": "user", "content": prompt}},
+		})
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(body)))
+		return w
+	}
+
+	// a prompt that fits stays on the requested model
+	w := send("hello")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "small-model")
+	assert.Empty(t, w.Header().Get(OverflowFromHeader))
+	assert.Empty(t, received)
+
+	// a prompt that does not fit goes to the target with its filters,
+	// uncropped
+	prompt := strings.Repeat("context ", 2000)
+	w = send(prompt)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "from peer")
+	assert.Equal(t, "small-model", w.Header().Get(OverflowFromHeader))
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, "big-model", received[0]["model"])
+		assert.Equal(t, 0.2, received[0]["temperature"])
+		assert.Contains(t, fmt.Sprint(received[0]["messages"]), prompt)
+	}
+
+	metrics := proxy.metricsMonitor.getMetrics()
+	if assert.NotEmpty(t, metrics) {
+		last := metrics[len(metrics)-1]
+		assert.Equal(t, "big-model", last.Model)
+		assert.Equal(t, "small-model", last.OverflowFrom)
+	}
+}
+
+func TestProxyManager_PromptOptimizationTruncationMode(t *testing.T) {
+	configStr := fmt.Sprintf(`
+logLevel: error
+models:
+  local-model:
+    cmd: %s -port ${PORT} -silent -respond local-model
+    truncationMode: strict_error
+    promptOptimization:
+      policy: limit_only
+`, getSimpleResponderPath())
+	testConfig, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := New(testConfig)
+	defer proxy.StopProcesses(StopImmediately)
+
+	body := []byte(`{"model":"local-model","messages":[
+		{"role":"user","content":"` + strings.Repeat("lorem ipsum dolor sit amet ", 200) + `"},
+		{"role":"assistant","content":"ok"},
+		{"role":"user","content":"again"}
+	]}`)
+
+	// limit_only honors strict_error
+	_, err = proxy.optimizePrompt("local-model", "/v1/chat/completions", body, promptOptimizeOptions{ctxSize: 512, dryRun: true})
+	assert.ErrorContains(t, err, "prompt too long")
+
+	// the other policies always crop
+	opt, err := proxy.optimizePrompt("local-model", "/v1/chat/completions", body, promptOptimizeOptions{policy: PromptOptimizationAlways, ctxSize: 512, dryRun: true})
+	if assert.NoError(t, err) {
+		assert.True(t, opt.result.Applied)
+		assert.Less(t, len(opt.body), len(body))
+	}
+}
@@ -74,6 +74,8 @@ type ProxyManager struct {
 
 	// custom ctx-size per model (stored before loading)
 	ctxSizes map[string]int
+	// n_ctx reported by each running upstream's /props
+	upstreamCtxSizes map[string]int
 	// runtime fit-mode per model (stored before loading)
 	fitModes map[string]bool
 	// fit ctx behavior per model: "max" -> --ctx-size, "min" -> --fit-ctx
@@ -81,10 +83,36 @@ type ProxyManager struct {
 
 	// runtime prompt optimization policy per model
 	promptPolicies map[string]PromptOptimizationPolicy
+	// runtimeStateSaveMu orders saves of the overrides above so an older
+	// snapshot never lands on disk after a newer one
+	runtimeStateSaveMu sync.Mutex
 
 	// latest optimization snapshot for each model (for user visibility and reuse)
 	latestPromptOptimizations map[string]PromptOptimizationSnapshot
 
+	// bounded per-model history of optimizations with a structured diff
+	promptOptimizationHistory map[string][]PromptOptimizationHistoryEntry
+	promptOptimizationSeq     uint64
+	// entries waiting for their token counts, drained by one goroutine
+	promptOptimizationCounts   []promptOptimizationCount
+	promptOptimizationCounting bool
+
+	// llm_assisted summaries keyed by summarized message prefix
+	summaryCache *summaryCache
+	// prefix_stable checkpoints keyed by the original message prefix
+	prefixCheckpoints *prefixCheckpoints
+	// /tokenize counts per message and the calibrated word estimate
+	tokenCounts *tokenCountCache
+	// supervised processes of stdio MCP tools, keyed by tool ID
+	mcpStdio *mcpStdioServers
+	// reused sessions of HTTP MCP tools, keyed by tool ID
+	mcpHTTP *mcpHTTPSessions
+	// tools/list refreshes running in the background, keyed by tool ID. Only
+	// the latest refresh of a tool is stored.
+	mcpRefreshing map[string]uint64
+	mcpRefreshSeq uint64
+	mcpRefreshes  sync.WaitGroup
+
 	// absolute or relative path to active config file
 	configPath string
 
@@ -95,6 +123,9 @@ type ProxyManager struct {
 	ollamaLastRefresh time.Time
 	tools             []RuntimeTool
 	toolSettings      ToolRuntimeSettings
+	// toolsSaveMu orders saves of the tools file, refreshes save in the
+	// background
+	toolsSaveMu sync.Mutex
 
 	// in-memory activity prompt timeline for current user turn only
 	activityPromptPreviews       []ActivityPromptPreview
@@ -111,22 +142,72 @@ const (
 	PromptOptimizationLimitOnly PromptOptimizationPolicy = "limit_only"
 	PromptOptimizationAlways    PromptOptimizationPolicy = "always"
 	PromptOptimizationLLMAssist PromptOptimizationPolicy = "llm_assisted"
+	// PromptOptimizationPrefixStable compacts only in infrequent checkpoints
+	// and keeps the compacted prefix identical between requests, so the
+	// upstream can reuse its prompt cache
+	PromptOptimizationPrefixStable PromptOptimizationPolicy = "prefix_stable"
 )
 
+func isValidPromptOptimizationPolicy(policy PromptOptimizationPolicy) bool {
+	switch policy {
+	case PromptOptimizationOff, PromptOptimizationLimitOnly, PromptOptimizationAlways, PromptOptimizationLLMAssist, PromptOptimizationPrefixStable:
+		return true
+	default:
+		return false
+	}
+}
+
 type PromptOptimizationSnapshot struct {
-	Model         string                   `json:"model"`
-	Policy        PromptOptimizationPolicy `json:"policy"`
-	Applied       bool                     `json:"applied"`
-	UpdatedAt     string                   `json:"updatedAt"`
-	Note          string                   `json:"note"`
-	OriginalBody  string                   `json:"originalBody"`
-	OptimizedBody string                   `json:"optimizedBody"`
+	Model                string                   `json:"model"`
+	Policy               PromptOptimizationPolicy `json:"policy"`
+	Applied              bool                     `json:"applied"`
+	UpdatedAt            string                   `json:"updatedAt"`
+	Note                 string                   `json:"note"`
+	Retried              bool                     `json:"retried,omitempty"`
+	PrunedTools          []string                 `json:"prunedTools,omitempty"`
+	TruncatedToolResults int                      `json:"truncatedToolResults,omitempty"`
+	DedupedBlocks        int                      `json:"dedupedBlocks,omitempty"`
+	StrippedReasoning    int                      `json:"strippedReasoning,omitempty"`
+	OmittedImages        int                      `json:"omittedImages,omitempty"`
+	ClampedMaxTokens     int                      `json:"clampedMaxTokens,omitempty"`
+	OriginalBody         string                   `json:"originalBody"`
+	OptimizedBody        string                   `json:"optimizedBody"`
+	SummaryCache         *SummaryCacheStats       `json:"summaryCache,omitempty"`
+	PrefixCache          *PrefixCacheStats        `json:"prefixCache,omitempty"`
+	TokenCache           *TokenCountCacheStats    `json:"tokenCache,omitempty"`
 }
 
 type PromptOptimizationResult struct {
 	Policy  PromptOptimizationPolicy
 	Applied bool
 	Note    string
+	// Retried is set when the request is re-optimized after the upstream
+	// rejected it for exceeding the context size
+	Retried bool
+	// PrunedTools names the tool definitions dropped to fit the context
+	PrunedTools []string
+	// TruncatedToolResults counts tool results cut to their head and tail
+	TruncatedToolResults int
+	// DedupedBlocks counts repeated blocks replaced with a reference to
+	// their most recent copy
+	DedupedBlocks int
+	// StrippedReasoning counts assistant messages whose reasoning was removed
+	StrippedReasoning int
+	// OmittedImages counts images replaced to fit the context
+	OmittedImages int
+	// ClampedMaxTokens is the output limit the request was lowered to, 0
+	// when it was left alone
+	ClampedMaxTokens int
+}
+
+// addStep marks the result applied and appends note to its description
+func (r *PromptOptimizationResult) addStep(note string) {
+	if r.Applied {
+		r.Note += "; " + note
+	} else {
+		r.Note = note
+	}
+	r.Applied = true
 }
 
 type OllamaModel struct {
@@ -243,10 +324,18 @@ func New(proxyConfig config.Config) *ProxyManager {
 
 		peerProxy:                 peerProxy,
 		ctxSizes:                  make(map[string]int),
+		upstreamCtxSizes:          make(map[string]int),
 		fitModes:                  make(map[string]bool),
 		fitCtxModes:               make(map[string]string),
 		promptPolicies:            make(map[string]PromptOptimizationPolicy),
 		latestPromptOptimizations: make(map[string]PromptOptimizationSnapshot),
+		promptOptimizationHistory: make(map[string][]PromptOptimizationHistoryEntry),
+		summaryCache:              newSummaryCache(),
+		prefixCheckpoints:         newPrefixCheckpoints(),
+		tokenCounts:               newTokenCountCache(),
+		mcpStdio:                  newMCPStdioServers(proxyLogger),
+		mcpHTTP:                   newMCPHTTPSessions(),
+		mcpRefreshing:             make(map[string]uint64),
 		configPath:                "config.yaml",
 		ollamaEndpoint:            "http://127.0.0.1:11434",
 		ollamaClient:              &http.Client{Timeout: 20 * time.Second},
@@ -266,6 +355,14 @@ func New(proxyConfig config.Config) *ProxyManager {
 
 	pm.setupGinEngine()
 
+	stopCtxDetection := event.On(pm.handleProcessStateForCtxSize)
+	stopPrefixCacheStats := event.On(pm.handleTokenMetricsForPrefixCache)
+	go func() {
+		<-shutdownCtx.Done()
+		stopCtxDetection()
+		stopPrefixCacheStats()
+	}()
+
 	// run any startup hooks
 	if len(proxyConfig.Hooks.OnStartup.Preload) > 0 {
 		// do it in the background, don't block startup -- not sure if good idea yet
@@ -525,9 +622,38 @@ func (pm *ProxyManager) Shutdown() {
 		}(processGroup)
 	}
 	wg.Wait()
+	pm.mcpStdio.stopAll()
+	pm.mcpHTTP.closeAll()
 	pm.shutdownCancel()
 }
 
+// filterRequestBody applies the filters of a local or peer model to an
+// inference request body: stripParams first, then setParams
+func (pm *ProxyManager) filterRequestBody(modelID string, body []byte) ([]byte, error) {
+	var filters config.Filters
+	if modelConfig, ok := pm.config.Models[modelID]; ok {
+		filters = modelConfig.Filters.Filters
+	} else if pm.peerProxy != nil && pm.peerProxy.HasPeerModel(modelID) {
+		filters = pm.peerProxy.GetPeerFilters(modelID)
+	}
+
+	var err error
+	for _, param := range filters.SanitizedStripParams() {
+		pm.proxyLogger.Debugf("<%s> stripping param: %s", modelID, param)
+		if body, err = sjson.DeleteBytes(body, param); err != nil {
+			return nil, fmt.Errorf("error deleting parameter %s from request", param)
+		}
+	}
+	setParams, setParamKeys := filters.SanitizedSetParams()
+	for _, key := range setParamKeys {
+		pm.proxyLogger.Debugf("<%s> setting param: %s", modelID, key)
+		if body, err = sjson.SetBytes(body, key, setParams[key]); err != nil {
+			return nil, fmt.Errorf("error setting parameter %s in request", key)
+		}
+	}
+	return body, nil
+}
+
 func (pm *ProxyManager) swapProcessGroup(realModelName string) (*ProcessGroup, error) {
 	processGroup := pm.findGroupByModelName(realModelName)
 	if processGroup == nil {
@@ -913,6 +1039,12 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 	c.Set("compat_endpoint", string(norm.Endpoint))
 	c.Set("compat_canonical_model", norm.Canonical.Model)
 
+	requestPolicy, bodyBytes, err := requestPromptOptimizationPolicy(c.Request.Header, bodyBytes)
+	if err != nil {
+		pm.sendErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	requestedModel := gjson.GetBytes(bodyBytes, "model").String()
 	if requestedModel == "" {
 		if isResponsesEndpoint {
@@ -972,6 +1104,32 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 		}
 	}
 
+	// a prompt too large for the model goes to its overflowTarget, which is
+	// then routed and filtered like a request for that model
+	if found {
+		if target, ok := pm.overflowTarget(modelID, c.Request.URL.Path, bodyBytes); ok {
+			bodyBytes, err = sjson.SetBytes(bodyBytes, "model", target)
+			if err != nil {
+				pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error setting overflow target in JSON: %s", err.Error()))
+				return
+			}
+			c.Header(OverflowFromHeader, modelID)
+			requestedModel = target
+			modelID, found = pm.config.RealModelName(target)
+		}
+	}
+
+	// a policy override is authorized once for every branch, the context
+	// overflow retry around the handler uses it too
+	overrideModelID := requestedModel
+	if found {
+		overrideModelID = modelID
+	}
+	if err := pm.authorizePromptOptimizationOverride(c, overrideModelID, requestPolicy); err != nil {
+		pm.sendErrorResponse(c, http.StatusForbidden, err.Error())
+		return
+	}
+
 	if found {
 		processGroup, err := pm.swapProcessGroup(modelID)
 		if err != nil {
@@ -989,34 +1147,14 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 			}
 		}
 
-		// issue #174 strip parameters from the JSON body
-		stripParams, err := pm.config.Models[modelID].Filters.SanitizedStripParams()
-		if err != nil { // just log it and continue
-			pm.proxyLogger.Errorf("Error sanitizing strip params string: %s, %s", pm.config.Models[modelID].Filters.StripParams, err.Error())
-		} else {
-			for _, param := range stripParams {
-				pm.proxyLogger.Debugf("<%s> stripping param: %s", modelID, param)
-				bodyBytes, err = sjson.DeleteBytes(bodyBytes, param)
-				if err != nil {
-					pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error deleting parameter %s from request", param))
-					return
-				}
-			}
-		}
-
-		// issue #453 set/override parameters in the JSON body
-		setParams, setParamKeys := pm.config.Models[modelID].Filters.SanitizedSetParams()
-		for _, key := range setParamKeys {
-			pm.proxyLogger.Debugf("<%s> setting param: %s", modelID, key)
-			bodyBytes, err = sjson.SetBytes(bodyBytes, key, setParams[key])
-			if err != nil {
-				pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error setting parameter %s in request", key))
-				return
-			}
+		// issue #174 strip and issue #453 set/override parameters in the JSON body
+		if bodyBytes, err = pm.filterRequestBody(modelID, bodyBytes); err != nil {
+			pm.sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+			return
 		}
 
 		var optResult PromptOptimizationResult
-		if bodyBytes, optResult, err = pm.applyPromptSizeControl(modelID, bodyBytes); err != nil {
+		if bodyBytes, optResult, err = pm.applyPromptSizeControl(modelID, c.Request.URL.Path, bodyBytes, requestPolicy); err != nil {
 			pm.sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("context control rejected request: %s", err.Error()))
 			return
 		}
@@ -1026,6 +1164,12 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 		} else {
 			c.Header("X-LlamaSwap-Prompt-Optimized", "false")
 		}
+		if optResult.ClampedMaxTokens > 0 {
+			c.Header(MaxTokensClampedHeader, strconv.Itoa(optResult.ClampedMaxTokens))
+		}
+		if optResult.TruncatedToolResults > 0 {
+			c.Header(ToolResultsTruncatedHeader, strconv.Itoa(optResult.TruncatedToolResults))
+		}
 
 		pm.proxyLogger.Debugf("ProxyManager using local Process for model: %s", requestedModel)
 		nextHandler = processGroup.ProxyRequest
@@ -1034,28 +1178,9 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 		modelID = requestedModel
 
 		// issue #453 apply filters for peer requests
-		peerFilters := pm.peerProxy.GetPeerFilters(requestedModel)
-
-		// Apply stripParams - remove specified parameters from request
-		stripParams := peerFilters.SanitizedStripParams()
-		for _, param := range stripParams {
-			pm.proxyLogger.Debugf("<%s> stripping param: %s", requestedModel, param)
-			bodyBytes, err = sjson.DeleteBytes(bodyBytes, param)
-			if err != nil {
-				pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error stripping parameter %s from request", param))
-				return
-			}
-		}
-
-		// Apply setParams - set/override specified parameters in request
-		setParams, setParamKeys := peerFilters.SanitizedSetParams()
-		for _, key := range setParamKeys {
-			pm.proxyLogger.Debugf("<%s> setting param: %s", requestedModel, key)
-			bodyBytes, err = sjson.SetBytes(bodyBytes, key, setParams[key])
-			if err != nil {
-				pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error setting parameter %s in request", key))
-				return
-			}
+		if bodyBytes, err = pm.filterRequestBody(requestedModel, bodyBytes); err != nil {
+			pm.sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+			return
 		}
 
 		nextHandler = pm.peerProxy.ProxyRequest
@@ -1068,7 +1193,7 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 		}
 
 		var optResult PromptOptimizationResult
-		if bodyBytes, optResult, err = pm.applyPromptSizeControl(modelID, bodyBytes); err != nil {
+		if bodyBytes, optResult, err = pm.applyPromptSizeControl(modelID, c.Request.URL.Path, bodyBytes, requestPolicy); err != nil {
 			pm.sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("context control rejected request: %s", err.Error()))
 			return
 		}
@@ -1078,6 +1203,12 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 		} else {
 			c.Header("X-LlamaSwap-Prompt-Optimized", "false")
 		}
+		if optResult.ClampedMaxTokens > 0 {
+			c.Header(MaxTokensClampedHeader, strconv.Itoa(optResult.ClampedMaxTokens))
+		}
+		if optResult.TruncatedToolResults > 0 {
+			c.Header(ToolResultsTruncatedHeader, strconv.Itoa(optResult.TruncatedToolResults))
+		}
 
 		pm.proxyLogger.Debugf("ProxyManager using Ollama for model: %s", requestedModel)
 		nextHandler = pm.proxyOllamaRequest
@@ -1087,6 +1218,7 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 		pm.sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("could not find suitable inference handler for %s", requestedModel))
 		return
 	}
+	nextHandler = pm.retryOnContextOverflow(requestPolicy, nextHandler)
 
 	bridgeResponses := isResponsesEndpoint
 	responsesRequestedStream := false
@@ -2398,138 +2530,280 @@ func sourceDomainFromURL(raw string) string {
 	return strings.TrimSpace(u.Hostname())
 }
 
-func (pm *ProxyManager) applyPromptSizeControl(modelID string, bodyBytes []byte) ([]byte, PromptOptimizationResult, error) {
+// resolvePromptOptimizationPolicy returns the effective policy for a model and
+// where it came from: a runtime override, the config default, or the built-in
+// limit_only default.
+func (pm *ProxyManager) resolvePromptOptimizationPolicy(modelID string) (PromptOptimizationPolicy, string) {
 	pm.Lock()
-	ctxSize := pm.ctxSizes[modelID]
 	runtimePolicy, hasRuntimePolicy := pm.promptPolicies[modelID]
+	modelConfig, hasConfig := pm.config.Models[modelID]
 	pm.Unlock()
-	result := PromptOptimizationResult{
-		Policy:  PromptOptimizationLimitOnly,
-		Applied: false,
-		Note:    "no optimization",
+
+	if hasRuntimePolicy {
+		return runtimePolicy, "runtime"
+	}
+	if hasConfig && modelConfig.PromptOptimization.Policy != "" {
+		return PromptOptimizationPolicy(modelConfig.PromptOptimization.Policy), "config"
+	}
+	return PromptOptimizationLimitOnly, "default"
+}
+
+// applyPromptSizeControl optimizes the messages of an inference request for
+// modelID and records the outcome as the model's latest snapshot. A non-empty
+// requestPolicy replaces the model's policy for this request only.
+func (pm *ProxyManager) applyPromptSizeControl(modelID string, requestPath string, bodyBytes []byte, requestPolicy PromptOptimizationPolicy) ([]byte, PromptOptimizationResult, error) {
+	return pm.applyPromptSizeControlWith(modelID, requestPath, bodyBytes, promptOptimizeOptions{policy: requestPolicy})
+}
+
+func (pm *ProxyManager) applyPromptSizeControlWith(modelID string, requestPath string, bodyBytes []byte, opts promptOptimizeOptions) ([]byte, PromptOptimizationResult, error) {
+	opt, err := pm.optimizePrompt(modelID, requestPath, bodyBytes, opts)
+	if err != nil {
+		return nil, opt.result, err
 	}
+	if opt.evaluated {
+		pm.savePromptOptimizationSnapshot(modelID, opt.result, bodyBytes, opt.body)
+		pm.recordPromptOptimizationHistory(modelID, opt)
+	}
+	return opt.body, opt.result, nil
+}
+
+// optimizePrompt runs the prompt optimization pipeline for modelID without
+// recording a snapshot. requestPath selects the wire format: /v1/messages
+// requests are handled as Anthropic requests, everything else as chat
+// completions.
+func (pm *ProxyManager) optimizePrompt(modelID string, requestPath string, bodyBytes []byte, opts promptOptimizeOptions) (promptOptimization, error) {
+	ctxSize, _ := pm.effectiveCtxSize(modelID)
+	if opts.ctxSize > 0 {
+		ctxSize = opts.ctxSize
+	}
+	opt := promptOptimization{
+		body: bodyBytes,
+		result: PromptOptimizationResult{
+			Policy:  PromptOptimizationLimitOnly,
+			Applied: false,
+			Note:    "no optimization",
+			Retried: opts.retry,
+		},
+	}
+	result := &opt.result
 
 	if !gjson.GetBytes(bodyBytes, "messages").IsArray() {
-		return bodyBytes, result, nil
+		return opt, nil
+	}
+
+	format := MessageFormatOpenAI
+	if compat.Route(requestPath) == compat.EndpointMessages {
+		// token counting must see the prompt exactly as the client sends it
+		if strings.HasSuffix(requestPath, "/count_tokens") {
+			return opt, nil
+		}
+		format = MessageFormatAnthropic
 	}
 
 	var chatReq ChatRequest
-	if err := json.Unmarshal(bodyBytes, &chatReq); err != nil {
-		return nil, result, fmt.Errorf("invalid chat request JSON: %w", err)
+	var err error
+	compactMessages := CompactMessagesForLowVRAM
+	writeMessages := func(body []byte, messages []ChatMessage) ([]byte, error) {
+		return sjson.SetBytes(body, "messages", messages)
+	}
+	if format == MessageFormatAnthropic {
+		chatReq, err = parseAnthropicChatRequest(bodyBytes)
+		compactMessages = compactAnthropicMessages
+		writeMessages = writeAnthropicChatRequest
+	} else {
+		err = json.Unmarshal(bodyBytes, &chatReq)
+	}
+	if err != nil {
+		return opt, fmt.Errorf("invalid chat request JSON: %w", err)
+	}
+	for i := range chatReq.Messages {
+		chatReq.Messages[i].origin = i + 1
 	}
 
 	modelConfig, exists := pm.config.Models[modelID]
-	if !exists {
-		if !isOllamaModelID(modelID) {
-			return bodyBytes, result, nil
-		}
+	switch {
+	case exists:
+	case isOllamaModelID(modelID):
 		modelConfig = config.ModelConfig{
 			Proxy:          pm.ollamaEndpoint,
 			TruncationMode: string(SlidingWindow),
 		}
+	case opts.retry && pm.peerProxy != nil && pm.peerProxy.HasPeerModel(modelID):
+		// peers are only optimized after they rejected a prompt. Counting
+		// falls back to estimates when the peer does not serve /tokenize.
+		modelConfig = config.ModelConfig{
+			Proxy:          pm.peerProxy.GetPeerProxy(modelID),
+			TruncationMode: string(SlidingWindow),
+		}
+	default:
+		return opt, nil
 	}
 
-	policy := PromptOptimizationLimitOnly
-	if hasRuntimePolicy {
-		policy = runtimePolicy
+	policy := opts.policy
+	if policy == "" {
+		policy, _ = pm.resolvePromptOptimizationPolicy(modelID)
 	}
 	result.Policy = policy
+
+	opt.evaluated = true
+	opt.format = format
+	opt.original = ChatRequest{Messages: cloneMessages(chatReq.Messages), Tools: cloneTools(chatReq.Tools)}
+	opt.messages = chatReq.Messages
+	opt.tools = chatReq.Tools
+	// a dry run reads the shared cache through a copy so previews do not fill it
+	tokenCache := pm.tokenCounts
+	if opts.dryRun {
+		tokenCache = pm.tokenCounts.previewCopy()
+	}
+	// only limit_only honors the model's truncation mode, the other policies
+	// always crop
+	mode := SlidingWindow
+	if policy == PromptOptimizationLimitOnly && strings.ToLower(strings.TrimSpace(modelConfig.TruncationMode)) == string(StrictError) {
+		mode = StrictError
+	}
+	opt.cm = NewContextManager(modelID, ctxSize, mode, pm.proxyLogger, modelConfig.Proxy).
+		WithOptimizationConfig(modelConfig.PromptOptimization).
+		WithMessageFormat(format).
+		WithTokenCache(tokenCache)
+
 	if policy == PromptOptimizationOff {
 		result.Note = "optimization disabled"
-		pm.savePromptOptimizationSnapshot(modelID, policy, false, bodyBytes, bodyBytes, result.Note)
-		return bodyBytes, result, nil
+		return opt, nil
+	}
+	if policy == PromptOptimizationPrefixStable {
+		// the usual stages rewrite old messages on every request, which is
+		// exactly what prefix_stable avoids
+		err = pm.optimizePrefixStable(&opt, chatReq, modelConfig.PromptOptimization.EffectiveCheckpointPercent(), writeMessages, opts.dryRun)
+		return opt, err
 	}
 
-	mode := SlidingWindow
 	switch policy {
 	case PromptOptimizationAlways:
-		chatReq.Messages = CompactMessagesForLowVRAM(chatReq.Messages)
-		mode = SlidingWindow
+		chatReq.Messages = compactMessages(chatReq.Messages)
 		result.Applied = true
 		result.Note = "always compacted repeated content"
-	case PromptOptimizationLimitOnly:
-		switch strings.ToLower(strings.TrimSpace(modelConfig.TruncationMode)) {
-		case string(StrictError):
-			mode = StrictError
-		default:
-			mode = SlidingWindow
-		}
 	case PromptOptimizationLLMAssist:
-		assisted, assistedErr := pm.optimizeMessagesWithLLM(modelConfig, chatReq)
+		assisted, cacheOutcome, assistedErr := pm.optimizeMessagesWithLLM(modelID, modelConfig, chatReq, format, opts.dryRun)
 		if assistedErr != nil {
 			pm.proxyLogger.Warnf("<%s> LLM-assisted optimization failed, falling back to compact mode: %v", modelID, assistedErr)
-			assisted.Messages = CompactMessagesForLowVRAM(chatReq.Messages)
+			assisted.Messages = compactMessages(chatReq.Messages)
 		}
 		chatReq = assisted
-		mode = SlidingWindow
 		result.Applied = true
 		result.Note = "llm-assisted compression applied"
-	default:
-		mode = SlidingWindow
+		if cacheOutcome != "" {
+			result.Note += fmt.Sprintf(" (summary cache %s)", cacheOutcome)
+		}
+	}
+	if messages, stripped := opt.cm.stripHistoricalReasoning(chatReq.Messages); stripped > 0 {
+		chatReq.Messages = messages
+		result.StrippedReasoning = stripped
+		result.addStep(fmt.Sprintf("stripped reasoning from %d message(s)", stripped))
+	}
+	if messages, truncated := opt.cm.truncateToolResults(chatReq.Messages); truncated > 0 {
+		chatReq.Messages = messages
+		result.TruncatedToolResults = truncated
+		result.addStep(fmt.Sprintf("truncated %d tool result(s)", truncated))
+	}
+	// deduplication runs on truncated results so a reference never points
+	// at a copy that is cut afterwards. limit_only leaves a prompt that fits
+	// alone, cropping dedupes it when it does not.
+	if policy != PromptOptimizationLimitOnly {
+		if messages, deduped := dedupeRepeatedBlocks(chatReq.Messages); deduped > 0 {
+			chatReq.Messages = messages
+			result.DedupedBlocks = deduped
+			result.addStep(fmt.Sprintf("deduplicated %d repeated block(s)", deduped))
+		}
 	}
+	opt.messages = chatReq.Messages
 
+	// only messages (and tools when they change) are patched into the
+	// original body so fields the optimizer does not model pass through
 	if ctxSize <= 0 {
-		if policy != PromptOptimizationAlways {
-			updatedBody, err := json.Marshal(chatReq)
+		if result.Applied {
+			opt.body, err = writeMessages(bodyBytes, chatReq.Messages)
 			if err != nil {
-				return nil, result, fmt.Errorf("failed to serialize optimized chat request: %w", err)
+				return opt, fmt.Errorf("failed to update chat messages: %w", err)
 			}
-			changed := !bytes.Equal(updatedBody, bodyBytes)
-			result.Applied = result.Applied || changed
-			if !result.Applied {
-				result.Note = "no context limit configured"
-			}
-			pm.savePromptOptimizationSnapshot(modelID, policy, result.Applied, bodyBytes, updatedBody, result.Note)
-			return updatedBody, result, nil
+		} else {
+			result.Note = "no context limit configured"
 		}
-		updatedBody, err := sjson.SetBytes(bodyBytes, "messages", chatReq.Messages)
+		return opt, nil
+	}
+
+	if requested := requestedOutputTokens(bodyBytes); opt.cm.clampMaxTokens && requested > 0 {
+		promptTokens, err := opt.cm.CountChatTokens(chatReq.Messages, chatReq.Tools)
 		if err != nil {
-			return nil, result, fmt.Errorf("failed to update chat messages: %w", err)
+			return opt, fmt.Errorf("failed to count tokens: %w", err)
+		}
+		if clamped := opt.cm.clampOutputTokens(requested, promptTokens); clamped < requested {
+			if err := clampRequestMaxTokens(&opt, requested, clamped); err != nil {
+				return opt, err
+			}
+			bodyBytes = opt.body
+			chatReq.MaxTokens = clamped
 		}
-		changed := !bytes.Equal(updatedBody, bodyBytes)
-		result.Applied = result.Applied || changed
-		pm.savePromptOptimizationSnapshot(modelID, policy, result.Applied, bodyBytes, updatedBody, result.Note)
-		return updatedBody, result, nil
 	}
 
-	cm := NewContextManager(modelID, ctxSize, mode, pm.proxyLogger, modelConfig.Proxy)
-	cropped, err := cm.CropChatRequest(chatReq)
+	// every stage above that rewrites the prompt marks the result applied
+	unchanged := !result.Applied
+	cropped, err := opt.cm.CropChatRequest(chatReq)
 	if err != nil {
-		return nil, result, err
+		return opt, err
+	}
+	opt.messages = cropped.Messages
+	opt.tools = cropped.Tools
+	if unchanged {
+		opt.tokensBefore = cropped.TokensBefore
+		opt.tokensAfter = cropped.TokensAfter
+		opt.tokensCounted = true
+	}
+
+	if !result.Applied && !cropped.IsCropped() && !cropped.ToolsChanged() && cropped.DedupedBlocks == 0 {
+		return opt, nil
 	}
 
-	updatedBody := bodyBytes
-	updatedBody, err = sjson.SetBytes(updatedBody, "messages", cropped.Messages)
+	opt.body, err = writeMessages(bodyBytes, cropped.Messages)
 	if err != nil {
-		return nil, result, fmt.Errorf("failed to update chat messages: %w", err)
+		return opt, fmt.Errorf("failed to update chat messages: %w", err)
 	}
 
-	if len(chatReq.Tools) > 0 || len(cropped.Tools) > 0 {
-		updatedBody, err = sjson.SetBytes(updatedBody, "tools", cropped.Tools)
+	if cropped.ToolsChanged() {
+		opt.body, err = writeToolPruning(opt.body, format, cropped.ToolsStripped, cropped.PrunedTools)
 		if err != nil {
-			return nil, result, fmt.Errorf("failed to update chat tools: %w", err)
+			return opt, fmt.Errorf("failed to update chat tools: %w", err)
 		}
+		result.PrunedTools = cropped.PrunedTools
 	}
 
-	if cropped.IsCropped() || !bytes.Equal(updatedBody, bodyBytes) {
-		result.Applied = true
-		if result.Note == "no optimization" {
-			result.Note = "cropped to context limit"
-		}
+	result.Applied = true
+	if result.Note == "no optimization" {
+		result.Note = "cropped to context limit"
+	}
+	if cropped.DedupedBlocks > 0 {
+		result.DedupedBlocks += cropped.DedupedBlocks
+		result.Note += fmt.Sprintf("; deduplicated %d repeated block(s)", cropped.DedupedBlocks)
+	}
+	if cropped.OmittedImages > 0 {
+		result.OmittedImages = cropped.OmittedImages
+		result.Note += fmt.Sprintf("; omitted %d image(s)", cropped.OmittedImages)
+	}
+	if len(cropped.PrunedTools) > 0 {
+		result.Note += fmt.Sprintf("; pruned %d tool(s)", len(cropped.PrunedTools))
+	} else if cropped.ToolsStripped {
+		result.Note += "; stripped tool docs"
+	}
+	if !opts.dryRun {
 		pm.proxyLogger.Infof("<%s> Prompt was compacted to fit ctx-size=%d using mode=%s", modelID, ctxSize, mode)
 	}
-
-	pm.savePromptOptimizationSnapshot(modelID, policy, result.Applied, bodyBytes, updatedBody, result.Note)
-	return updatedBody, result, nil
+	return opt, nil
 }
 
 func (pm *ProxyManager) savePromptOptimizationSnapshot(
 	modelID string,
-	policy PromptOptimizationPolicy,
-	applied bool,
+	result PromptOptimizationResult,
 	originalBody []byte,
 	optimizedBody []byte,
-	note string,
 ) {
 	const maxSnapshotBytes = 2 * 1024 * 1024
 	toSafeString := func(data []byte) string {
@@ -2540,13 +2814,23 @@ func (pm *ProxyManager) savePromptOptimizationSnapshot(
 	}
 
 	snapshot := PromptOptimizationSnapshot{
-		Model:         modelID,
-		Policy:        policy,
-		Applied:       applied,
-		UpdatedAt:     time.Now().UTC().Format(time.RFC3339),
-		Note:          note,
-		OriginalBody:  toSafeString(originalBody),
-		OptimizedBody: toSafeString(optimizedBody),
+		Model:                modelID,
+		Policy:               result.Policy,
+		Applied:              result.Applied,
+		UpdatedAt:            time.Now().UTC().Format(time.RFC3339),
+		Note:                 result.Note,
+		Retried:              result.Retried,
+		PrunedTools:          result.PrunedTools,
+		TruncatedToolResults: result.TruncatedToolResults,
+		DedupedBlocks:        result.DedupedBlocks,
+		StrippedReasoning:    result.StrippedReasoning,
+		OmittedImages:        result.OmittedImages,
+		ClampedMaxTokens:     result.ClampedMaxTokens,
+		OriginalBody:         toSafeString(originalBody),
+		OptimizedBody:        toSafeString(optimizedBody),
+		SummaryCache:         pm.summaryCache.Stats(modelID),
+		PrefixCache:          pm.prefixCheckpoints.Stats(modelID),
+		TokenCache:           pm.tokenCounts.Stats(modelID),
 	}
 
 	pm.Lock()
@@ -2554,56 +2838,137 @@ func (pm *ProxyManager) savePromptOptimizationSnapshot(
 	pm.Unlock()
 }
 
-func (pm *ProxyManager) optimizeMessagesWithLLM(modelConfig config.ModelConfig, req ChatRequest) (ChatRequest, error) {
+// optimizeMessagesWithLLM replaces the middle of the conversation with a
+// summary. A dry run never calls the summarizer: it reuses a cached summary
+// or inserts a placeholder, and leaves the cache counters untouched.
+func (pm *ProxyManager) optimizeMessagesWithLLM(modelID string, modelConfig config.ModelConfig, req ChatRequest, format MessageFormat, dryRun bool) (ChatRequest, summaryCacheOutcome, error) {
 	if len(req.Messages) < 4 {
-		return req, nil
+		return req, "", nil
 	}
 
-	keepTail := 4
+	optCfg := modelConfig.PromptOptimization
+	keepTail := optCfg.EffectiveKeepTail()
 	if keepTail > len(req.Messages) {
 		keepTail = len(req.Messages)
 	}
 	middleEnd := len(req.Messages) - keepTail
 	if middleEnd <= 1 {
-		return req, nil
+		return req, "", nil
 	}
 
 	keepPrefix := 0
 	if req.Messages[0].Role == "system" {
 		keepPrefix = 1
 	}
+	// never start the kept tail with tool results whose call gets summarized
+	for middleEnd > keepPrefix && !isSafeTailStart(req.Messages[middleEnd], format) {
+		middleEnd--
+	}
+	if middleEnd <= keepPrefix {
+		return req, "", nil
+	}
 	middle := req.Messages[keepPrefix:middleEnd]
 	if len(middle) == 0 {
-		return req, nil
+		return req, "", nil
 	}
 
-	var b strings.Builder
+	// reuse the summary of an identical prefix, or extend the summary of a
+	// shorter prefix with only the newly appended messages
+	prefixHashes := summaryPrefixHashes(middle)
+	summary, covered := pm.summaryCache.lookup(modelID, prefixHashes, dryRun)
+	outcome := summaryCacheHit
+	if covered < len(middle) {
+		outcome = summaryCacheMiss
+		if covered > 0 {
+			outcome = summaryCacheExtend
+		}
+	}
+	switch {
+	case dryRun:
+		if outcome != summaryCacheHit {
+			summary = fmt.Sprintf("[preview: %d message(s) would be summarized by %s]", len(middle), pm.summarizerModelFor(modelID))
+		}
+	case outcome != summaryCacheHit:
+		summaryInput := buildSummaryInput(summary, middle[covered:], optCfg.EffectiveSummaryMaxInputChars())
+		if strings.TrimSpace(summaryInput) == "" {
+			return req, "", nil
+		}
+
+		var err error
+		summary, err = pm.requestSummary(modelID, optCfg, summaryInput)
+		if err != nil {
+			return req, "", err
+		}
+		pm.summaryCache.store(modelID, prefixHashes[len(middle)], summary)
+	}
+	if !dryRun {
+		pm.summaryCache.record(modelID, outcome)
+	}
+
+	newMessages := make([]ChatMessage, 0, keepPrefix+1+keepTail)
+	if keepPrefix == 1 {
+		newMessages = append(newMessages, req.Messages[0])
+	}
+	summarized := make([]int, 0, len(middle))
 	for _, m := range middle {
+		summarized = append(summarized, m.origin)
+	}
+	newMessages = append(newMessages, ChatMessage{
+		Role:       "system",
+		Content:    "LLM-assisted context summary:\n" + summary,
+		summarizes: summarized,
+	})
+	newMessages = append(newMessages, req.Messages[middleEnd:]...)
+
+	req.Messages = newMessages
+	return req, outcome, nil
+}
+
+// isSafeTailStart reports whether the kept tail may begin at msg. Anthropic
+// conversations must also start with a user turn.
+func isSafeTailStart(msg ChatMessage, format MessageFormat) bool {
+	if msg.Role == "tool" || len(toolResultIDs(msg)) > 0 {
+		return false
+	}
+	return format != MessageFormatAnthropic || msg.Role == "user"
+}
+
+// buildSummaryInput renders messages for the summarizer. When a previous
+// summary exists it is included so the summarizer only merges new messages.
+func buildSummaryInput(previousSummary string, messages []ChatMessage, maxInputChars int) string {
+	var b strings.Builder
+	hasMessages := false
+	if previousSummary != "" {
+		b.WriteString("[EXISTING SUMMARY] ")
+		b.WriteString(previousSummary)
+		b.WriteString("\n\nMerge the following new messages into the existing summary.\n\n")
+	}
+	for _, m := range messages {
 		contentText := chatContentToText(m.Content)
 		if strings.TrimSpace(contentText) == "" {
 			continue
 		}
+		hasMessages = true
 		b.WriteString("[")
 		b.WriteString(strings.ToUpper(m.Role))
 		b.WriteString("] ")
 		b.WriteString(contentText)
 		b.WriteString("\n\n")
-		if b.Len() > 12000 {
+		if b.Len() > maxInputChars {
 			break
 		}
 	}
-
-	summaryInput := b.String()
-	if strings.TrimSpace(summaryInput) == "" {
-		return req, nil
+	if !hasMessages {
+		return ""
 	}
+	return b.String()
+}
 
-	upstreamModelName := strings.TrimSpace(modelConfig.UseModelName)
-	if upstreamModelName == "" {
-		upstreamModelName = strings.TrimSpace(req.Model)
-	}
-	if upstreamModelName == "" {
-		upstreamModelName = "model"
+// requestSummary sends summaryInput to the summarizer model for modelID
+func (pm *ProxyManager) requestSummary(modelID string, optCfg config.PromptOptimizationConfig, summaryInput string) (string, error) {
+	summarizerID, upstreamModelName, handler, err := pm.resolveSummarizerTarget(modelID, pm.summarizerModelFor(modelID))
+	if err != nil {
+		return "", err
 	}
 
 	llmReq := map[string]any{
@@ -2611,56 +2976,91 @@ func (pm *ProxyManager) optimizeMessagesWithLLM(modelConfig config.ModelConfig,
 		"messages": []map[string]any{
 			{
 				"role":    "system",
-				"content": "Summarize the following chat history for coding continuity. Keep requirements, constraints, file paths, decisions, TODOs, open questions. Be concise. Do not add new facts.",
+				"content": optCfg.EffectiveSummaryPrompt(),
 			},
 			{
 				"role":    "user",
 				"content": summaryInput,
 			},
 		},
-		"max_tokens":  512,
+		"max_tokens":  optCfg.EffectiveSummaryMaxTokens(),
 		"temperature": 0,
 		"stream":      false,
 	}
 
 	reqBytes, err := json.Marshal(llmReq)
 	if err != nil {
-		return req, err
+		return "", err
 	}
-
-	url := strings.TrimSuffix(modelConfig.Proxy, "/") + "/v1/chat/completions"
-	resp, err := http.Post(url, "application/json", bytes.NewReader(reqBytes))
-	if err != nil {
-		return req, err
+	if reqBytes, err = pm.filterRequestBody(summarizerID, reqBytes); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(resp.Body)
-		return req, fmt.Errorf("llm assistant upstream status %d: %s", resp.StatusCode, string(body))
+	// go through the regular inference handlers so the call is swap aware,
+	// respects concurrency limits and shows up in metrics and activity
+	orig, err := http.NewRequestWithContext(pm.shutdownCtx, http.MethodPost, "/v1/chat/completions", nil)
+	if err != nil {
+		return "", err
 	}
-
-	body, err := io.ReadAll(resp.Body)
+	orig.Header.Set("User-Agent", "llama-swap-summarizer")
+	body, statusCode, err := pm.invokeInferenceOnce(summarizerID, handler, orig, reqBytes)
 	if err != nil {
-		return req, err
+		return "", err
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return "", fmt.Errorf("llm assistant %s status %d: %s", summarizerID, statusCode, truncateForLog(string(body), 2000))
 	}
 	summary := strings.TrimSpace(gjson.GetBytes(body, "choices.0.message.content").String())
 	if summary == "" {
-		return req, fmt.Errorf("llm assistant returned empty summary")
+		return "", fmt.Errorf("llm assistant returned empty summary")
 	}
+	return summary, nil
+}
 
-	newMessages := make([]ChatMessage, 0, keepPrefix+1+keepTail)
-	if keepPrefix == 1 {
-		newMessages = append(newMessages, req.Messages[0])
+// summarizerModelFor returns the model that summarizes history for modelID:
+// the per-model summarizerModel, then the global one, then modelID itself.
+func (pm *ProxyManager) summarizerModelFor(modelID string) string {
+	if modelConfig, ok := pm.config.Models[modelID]; ok && modelConfig.PromptOptimization.SummarizerModel != "" {
+		return modelConfig.PromptOptimization.SummarizerModel
 	}
-	newMessages = append(newMessages, ChatMessage{
-		Role:    "system",
-		Content: "LLM-assisted context summary:\n" + summary,
-	})
-	newMessages = append(newMessages, req.Messages[middleEnd:]...)
+	if pm.config.SummarizerModel != "" {
+		return pm.config.SummarizerModel
+	}
+	return modelID
+}
 
-	req.Messages = newMessages
-	return req, nil
+// resolveSummarizerTarget finds the handler for a summarizer model the same
+// way proxyInferenceHandler does: local process group, peer, then ollama.
+// It returns the model ID used for metrics and the name sent upstream. A
+// local summarizer other than modelID must already be loaded, starting it
+// in the middle of the request could unload modelID.
+func (pm *ProxyManager) resolveSummarizerTarget(modelID string, requestedModel string) (string, string, func(modelID string, w http.ResponseWriter, r *http.Request) error, error) {
+	if summarizerID, found := pm.config.RealModelName(requestedModel); found {
+		var processGroup *ProcessGroup
+		if summarizerID == modelID {
+			var err error
+			if processGroup, err = pm.swapProcessGroup(summarizerID); err != nil {
+				return "", "", nil, fmt.Errorf("error swapping process group for summarizer %s: %w", summarizerID, err)
+			}
+		} else {
+			processGroup = pm.findGroupByModelName(summarizerID)
+			if processGroup == nil || !processGroup.IsServing(summarizerID) {
+				return "", "", nil, fmt.Errorf("summarizer %s is not loaded and is not started during a request for %s", summarizerID, modelID)
+			}
+		}
+		upstreamName := summarizerID
+		if useModelName := strings.TrimSpace(pm.config.Models[summarizerID].UseModelName); useModelName != "" {
+			upstreamName = useModelName
+		}
+		return summarizerID, upstreamName, processGroup.ProxyRequest, nil
+	}
+	if pm.peerProxy != nil && pm.peerProxy.HasPeerModel(requestedModel) {
+		return requestedModel, requestedModel, pm.peerProxy.ProxyRequest, nil
+	}
+	if ollamaModel, exists := pm.GetOllamaModelByID(requestedModel); exists {
+		return ollamaModel.ID, ollamaModel.Name, pm.proxyOllamaRequest, nil
+	}
+	return "", "", nil, fmt.Errorf("summarizer model %s not found", requestedModel)
 }
 
 func (pm *ProxyManager) SetConfigPath(configPath string) {
@@ -2668,6 +3068,7 @@ func (pm *ProxyManager) SetConfigPath(configPath string) {
 	pm.configPath = strings.TrimSpace(configPath)
 	pm.Unlock()
 	pm.loadToolsFromDisk()
+	pm.loadRuntimeStateFromDisk()
 }
 
 func (pm *ProxyManager) proxyOAIPostFormHandler(c *gin.Context) {
@@ -2859,6 +3260,9 @@ func (pm *ProxyManager) compatibilityMode() string {
 	return mode
 }
 
+// apiKeyContextKey holds the API key a request authenticated with
+const apiKeyContextKey = "api_key"
+
 // apiKeyAuth returns a middleware that validates API keys if configured.
 // Returns a pass-through handler if no API keys are configured.
 func (pm *ProxyManager) apiKeyAuth() gin.HandlerFunc {
@@ -2912,6 +3316,9 @@ func (pm *ProxyManager) apiKeyAuth() gin.HandlerFunc {
 			return
 		}
 
+		// remembered for checks that depend on which key was used
+		c.Set(apiKeyContextKey, providedKey)
+
 		// Strip auth headers to prevent leakage to upstream
 		c.Request.Header.Del("Authorization")
 		c.Request.Header.Del("x-api-key")
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os/exec"
 	"runtime"
@@ -51,6 +52,7 @@ func addApiHandlers(pm *ProxyManager) {
 		apiGroup.POST("/tools", pm.apiCreateTool)
 		apiGroup.PUT("/tools/:id", pm.apiUpdateTool)
 		apiGroup.DELETE("/tools/:id", pm.apiDeleteTool)
+		apiGroup.POST("/tools/:id/refresh", pm.apiRefreshTool)
 		apiGroup.GET("/tools/settings", pm.apiGetToolSettings)
 		apiGroup.PUT("/tools/settings", pm.apiSetToolSettings)
 		apiGroup.GET("/events", pm.apiSendEvents)
@@ -72,6 +74,9 @@ func addApiHandlers(pm *ProxyManager) {
 	ctxSizeGroup.POST("/:model/prompt-optimization", pm.apiSetPromptOptimization)
 	ctxSizeGroup.GET("/:model/prompt-optimization", pm.apiGetPromptOptimization)
 	ctxSizeGroup.GET("/:model/prompt-optimization/latest", pm.apiGetLatestPromptOptimization)
+	ctxSizeGroup.POST("/:model/prompt-optimization/preview", pm.apiPreviewPromptOptimization)
+	ctxSizeGroup.GET("/:model/prompt-optimization/history", pm.apiGetPromptOptimizationHistory)
+	ctxSizeGroup.POST("/:model/reset", pm.apiResetModelRuntimeState)
 }
 
 func (pm *ProxyManager) apiUnloadAllModels(c *gin.Context) {
@@ -337,6 +342,8 @@ const (
 	msgTypeModelStatus messageType = "modelStatus"
 	msgTypeLogData     messageType = "logData"
 	msgTypeMetrics     messageType = "metrics"
+
+	msgTypePromptOptimization messageType = "promptOptimization"
 )
 
 type messageEnvelope struct {
@@ -423,6 +430,21 @@ func (pm *ProxyManager) apiSendEvents(c *gin.Context) {
 		sendMetrics([]TokenMetrics{e.Metrics})
 	})()
 
+	/**
+	 * Send prompt optimization history entries
+	 */
+	defer event.On(func(e PromptOptimizationEvent) {
+		jsonData, err := json.Marshal(e.Entry)
+		if err == nil {
+			select {
+			case sendBuffer <- messageEnvelope{Type: msgTypePromptOptimization, Data: string(jsonData)}:
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+	})()
+
 	// send initial batch of data
 	sendLogData("proxy", pm.proxyLogger.GetHistory())
 	sendLogData("upstream", pm.upstreamLogger.GetHistory())
@@ -532,13 +554,16 @@ func (pm *ProxyManager) reloadConfigFromDisk(stopModels bool) error {
 		}
 	}
 
-	// Soft restart clears runtime overrides when requested.
+	// Soft restart drops in-memory state and re-reads the persisted runtime
+	// overrides so UI tuning survives the restart.
 	if stopModels {
-		pm.ctxSizes = make(map[string]int)
-		pm.fitModes = make(map[string]bool)
-		pm.fitCtxModes = make(map[string]string)
-		pm.promptPolicies = make(map[string]PromptOptimizationPolicy)
+		pm.loadRuntimeStateLocked()
 		pm.latestPromptOptimizations = make(map[string]PromptOptimizationSnapshot)
+		pm.promptOptimizationHistory = make(map[string][]PromptOptimizationHistoryEntry)
+		pm.upstreamCtxSizes = make(map[string]int)
+		pm.summaryCache.Reset()
+		pm.prefixCheckpoints.Reset()
+		pm.tokenCounts.Reset()
 		pm.activityPromptPreviews = pm.activityPromptPreviews[:0]
 		pm.activityCurrentUserSignature = ""
 		pm.activityCurrentTurn = 0
@@ -586,6 +611,10 @@ func (pm *ProxyManager) apiListTools(c *gin.Context) {
 	tools := append([]RuntimeTool(nil), pm.tools...)
 	for i := range tools {
 		tools[i] = normalizeRuntimeTool(tools[i])
+		if status, ok := pm.mcpSessionStatus(tools[i]); ok {
+			tools[i].Session = &status
+		}
+		tools[i].RemoteToolsRefreshing = pm.isRefreshingMCPRemoteTools(tools[i].ID)
 	}
 	c.JSON(http.StatusOK, tools)
 }
@@ -623,8 +652,8 @@ func (pm *ProxyManager) apiCreateTool(c *gin.Context) {
 		req.ID = fmt.Sprintf("tool_%d", time.Now().UnixNano())
 	}
 	req = normalizeRuntimeTool(req)
-	if req.Name == "" || req.Endpoint == "" {
-		pm.sendErrorResponse(c, http.StatusBadRequest, "name and endpoint are required")
+	if req.Name == "" || !req.hasTarget() {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "name and endpoint (or command for stdio) are required")
 		return
 	}
 	if req.Type != RuntimeToolHTTP && req.Type != RuntimeToolMCP {
@@ -632,7 +661,7 @@ func (pm *ProxyManager) apiCreateTool(c *gin.Context) {
 		return
 	}
 	settings := pm.getToolRuntimeSettings()
-	if err := validateToolEndpoint(req.Endpoint, settings); err != nil {
+	if err := pm.validateToolTarget(req, settings); err != nil {
 		pm.sendErrorResponse(c, http.StatusBadRequest, err.Error())
 		return
 	}
@@ -652,7 +681,9 @@ func (pm *ProxyManager) apiCreateTool(c *gin.Context) {
 		pm.sendErrorResponse(c, http.StatusInternalServerError, "failed to save tools: "+err.Error())
 		return
 	}
-	c.JSON(http.StatusOK, req)
+	// the server is contacted, and a stdio server started, only once the
+	// tool is stored
+	c.JSON(http.StatusOK, pm.refreshMCPRemoteToolsAsync(req))
 }
 
 func (pm *ProxyManager) apiUpdateTool(c *gin.Context) {
@@ -668,8 +699,8 @@ func (pm *ProxyManager) apiUpdateTool(c *gin.Context) {
 	}
 	req.ID = id
 	req = normalizeRuntimeTool(req)
-	if req.Name == "" || req.Endpoint == "" {
-		pm.sendErrorResponse(c, http.StatusBadRequest, "name and endpoint are required")
+	if req.Name == "" || !req.hasTarget() {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "name and endpoint (or command for stdio) are required")
 		return
 	}
 	if req.Type != RuntimeToolHTTP && req.Type != RuntimeToolMCP {
@@ -677,30 +708,112 @@ func (pm *ProxyManager) apiUpdateTool(c *gin.Context) {
 		return
 	}
 	settings := pm.getToolRuntimeSettings()
-	if err := validateToolEndpoint(req.Endpoint, settings); err != nil {
+	if err := pm.validateToolTarget(req, settings); err != nil {
 		pm.sendErrorResponse(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	pm.Lock()
-	updated := false
-	for i, t := range pm.tools {
+	var stored RuntimeTool
+	found := false
+	for _, t := range pm.tools {
 		if t.ID == id {
-			pm.tools[i] = req
-			updated = true
+			stored = t
+			found = true
 			break
 		}
 	}
 	pm.Unlock()
-	if !updated {
+	if !found {
 		pm.sendErrorResponse(c, http.StatusNotFound, "tool not found")
 		return
 	}
+	// remote tool definitions come from the server, only their disabled
+	// flags from the request
+	req.RemoteTools = mergeRemoteToolFlags(stored, req)
+	if !pm.replaceStoredTool(req) {
+		pm.sendErrorResponse(c, http.StatusNotFound, "tool not found")
+		return
+	}
+	// a tool moved to another transport releases the one it used
+	if !req.isStdio() {
+		pm.mcpStdio.stop(id)
+	}
+	if req.Type != RuntimeToolMCP || req.isStdio() {
+		pm.mcpHTTP.close(id)
+	}
 	if err := pm.saveToolsToDisk(); err != nil {
 		pm.sendErrorResponse(c, http.StatusInternalServerError, "failed to save tools: "+err.Error())
 		return
 	}
-	c.JSON(http.StatusOK, req)
+	c.JSON(http.StatusOK, pm.refreshMCPRemoteToolsAsync(req))
+}
+
+// mergeRemoteToolFlags returns the cached remote tools of stored with the
+// disabled flags of an update request. The cache is dropped when the
+// endpoint or the stdio command changes.
+func mergeRemoteToolFlags(stored RuntimeTool, req RuntimeTool) []MCPRemoteTool {
+	if stored.Endpoint != req.Endpoint || !mcpStdioSpecOf(stored).equal(mcpStdioSpecOf(req)) {
+		return nil
+	}
+	disabled := make(map[string]bool, len(req.RemoteTools))
+	for _, t := range req.RemoteTools {
+		disabled[t.Name] = t.Disabled
+	}
+	merged := append([]MCPRemoteTool(nil), stored.RemoteTools...)
+	for i := range merged {
+		if flag, ok := disabled[merged[i].Name]; ok {
+			merged[i].Disabled = flag
+		}
+	}
+	return merged
+}
+
+// replaceStoredTool stores tool over the entry with its ID. A tool deleted
+// in the meantime stays deleted and its session or process is released.
+func (pm *ProxyManager) replaceStoredTool(tool RuntimeTool) bool {
+	pm.Lock()
+	for i, t := range pm.tools {
+		if t.ID == tool.ID {
+			pm.tools[i] = tool
+			pm.Unlock()
+			return true
+		}
+	}
+	pm.Unlock()
+	pm.mcpStdio.stop(tool.ID)
+	pm.mcpHTTP.close(tool.ID)
+	return false
+}
+
+// apiRefreshTool re-reads the tool list of an MCP server in the background
+func (pm *ProxyManager) apiRefreshTool(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	pm.Lock()
+	var tool RuntimeTool
+	found := false
+	for _, t := range pm.tools {
+		if t.ID == id {
+			tool = t
+			found = true
+			break
+		}
+	}
+	pm.Unlock()
+	if !found {
+		pm.sendErrorResponse(c, http.StatusNotFound, "tool not found")
+		return
+	}
+	tool = normalizeRuntimeTool(tool)
+	if tool.Type != RuntimeToolMCP {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "only mcp tools can be refreshed")
+		return
+	}
+	if err := pm.validateToolTarget(tool, pm.getToolRuntimeSettings()); err != nil {
+		pm.sendErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, pm.refreshMCPRemoteToolsAsync(tool))
 }
 
 func (pm *ProxyManager) apiDeleteTool(c *gin.Context) {
@@ -725,6 +838,8 @@ func (pm *ProxyManager) apiDeleteTool(c *gin.Context) {
 		pm.sendErrorResponse(c, http.StatusNotFound, "tool not found")
 		return
 	}
+	pm.mcpStdio.stop(id)
+	pm.mcpHTTP.close(id)
 	if err := pm.saveToolsToDisk(); err != nil {
 		pm.sendErrorResponse(c, http.StatusInternalServerError, "failed to save tools: "+err.Error())
 		return
@@ -770,9 +885,13 @@ func (pm *ProxyManager) apiSetCtxSize(c *gin.Context) {
 	}
 
 	pm.Lock()
-	defer pm.Unlock()
-
 	pm.ctxSizes[modelName] = req.CtxSize
+	pm.Unlock()
+
+	if err := pm.saveRuntimeStateToDisk(); err != nil {
+		pm.sendErrorResponse(c, http.StatusInternalServerError, "failed to save runtime state: "+err.Error())
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"msg": "ctxSize set successfully", "model": modelName, "ctxSize": req.CtxSize})
 }
 
@@ -793,16 +912,8 @@ func (pm *ProxyManager) apiGetCtxSize(c *gin.Context) {
 		return
 	}
 
-	pm.Lock()
-	defer pm.Unlock()
-
-	ctxSize, found := pm.ctxSizes[modelName]
-	if !found {
-		c.JSON(http.StatusOK, gin.H{"model": modelName, "ctxSize": 0})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"model": modelName, "ctxSize": ctxSize})
+	ctxSize, source := pm.effectiveCtxSize(modelName)
+	c.JSON(http.StatusOK, gin.H{"model": modelName, "ctxSize": ctxSize, "source": source})
 }
 
 func (pm *ProxyManager) apiSetFitMode(c *gin.Context) {
@@ -841,6 +952,11 @@ func (pm *ProxyManager) apiSetFitMode(c *gin.Context) {
 	pm.fitCtxModes[modelName] = mode
 	pm.Unlock()
 
+	if err := pm.saveRuntimeStateToDisk(); err != nil {
+		pm.sendErrorResponse(c, http.StatusInternalServerError, "failed to save runtime state: "+err.Error())
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"msg": "fit mode set successfully", "model": modelName, "fit": req.Fit, "mode": mode})
 }
 
@@ -906,10 +1022,8 @@ func (pm *ProxyManager) apiSetPromptOptimization(c *gin.Context) {
 		return
 	}
 
-	switch req.Policy {
-	case PromptOptimizationOff, PromptOptimizationLimitOnly, PromptOptimizationAlways, PromptOptimizationLLMAssist:
-	default:
-		pm.sendErrorResponse(c, http.StatusBadRequest, "policy must be one of: off, limit_only, always, llm_assisted")
+	if !isValidPromptOptimizationPolicy(req.Policy) {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "policy must be one of: off, limit_only, always, llm_assisted, prefix_stable")
 		return
 	}
 
@@ -917,6 +1031,11 @@ func (pm *ProxyManager) apiSetPromptOptimization(c *gin.Context) {
 	pm.promptPolicies[modelName] = req.Policy
 	pm.Unlock()
 
+	if err := pm.saveRuntimeStateToDisk(); err != nil {
+		pm.sendErrorResponse(c, http.StatusInternalServerError, "failed to save runtime state: "+err.Error())
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"msg":    "prompt optimization policy set successfully",
 		"model":  modelName,
@@ -943,17 +1062,12 @@ func (pm *ProxyManager) apiGetPromptOptimization(c *gin.Context) {
 		}
 	}
 
-	pm.Lock()
-	policy, hasRuntimePolicy := pm.promptPolicies[modelName]
-	pm.Unlock()
-
-	if !hasRuntimePolicy {
-		policy = PromptOptimizationLimitOnly
-	}
+	policy, source := pm.resolvePromptOptimizationPolicy(modelName)
 
 	c.JSON(http.StatusOK, gin.H{
 		"model":  modelName,
 		"policy": policy,
+		"source": source,
 	})
 }
 
@@ -983,7 +1097,171 @@ func (pm *ProxyManager) apiGetLatestPromptOptimization(c *gin.Context) {
 		pm.sendErrorResponse(c, http.StatusNotFound, "no optimization snapshot found")
 		return
 	}
+	// cache counters arrive with the response, after the snapshot was taken
+	if stats := pm.prefixCheckpoints.Stats(modelName); stats != nil {
+		snapshot.PrefixCache = stats
+	}
+	snapshot.TokenCache = pm.tokenCounts.Stats(modelName)
 
 	c.JSON(http.StatusOK, snapshot)
 }
 
+// apiGetPromptOptimizationHistory returns the recorded optimizations for a
+// model, oldest first. ?limit=N returns only the N most recent entries.
+func (pm *ProxyManager) apiGetPromptOptimizationHistory(c *gin.Context) {
+	requestedModel := strings.TrimSpace(c.Param("model"))
+	if requestedModel == "" {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "model name required")
+		return
+	}
+
+	modelName, found := pm.config.RealModelName(requestedModel)
+	if !found {
+		if ollamaModel, exists := pm.GetOllamaModelByID(requestedModel); exists {
+			modelName = ollamaModel.ID
+			found = true
+		}
+		if !found {
+			pm.sendErrorResponse(c, http.StatusNotFound, "model not found")
+			return
+		}
+	}
+
+	limit := 0
+	if raw := strings.TrimSpace(c.Query("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			pm.sendErrorResponse(c, http.StatusBadRequest, "limit must be a non-negative integer")
+			return
+		}
+		limit = n
+	}
+
+	pm.Lock()
+	entries := append([]PromptOptimizationHistoryEntry{}, pm.promptOptimizationHistory[modelName]...)
+	pm.Unlock()
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"model":   modelName,
+		"entries": entries,
+	})
+}
+
+// apiPreviewPromptOptimization runs prompt optimization on a chat or messages
+// body without forwarding it. Only /tokenize is called upstream; llm_assisted
+// uses a cached summary or a placeholder instead of calling the summarizer.
+// The optional ?policy= overrides the model's policy and ?format=openai or
+// ?format=anthropic overrides detection of the body format.
+func (pm *ProxyManager) apiPreviewPromptOptimization(c *gin.Context) {
+	requestedModel := strings.TrimSpace(c.Param("model"))
+	if requestedModel == "" {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "model name required")
+		return
+	}
+
+	modelName, found := pm.config.RealModelName(requestedModel)
+	if !found {
+		if ollamaModel, exists := pm.GetOllamaModelByID(requestedModel); exists {
+			modelName = ollamaModel.ID
+			found = true
+		}
+		if !found {
+			pm.sendErrorResponse(c, http.StatusNotFound, "model not found")
+			return
+		}
+	}
+
+	policy := PromptOptimizationPolicy(strings.ToLower(strings.TrimSpace(c.Query("policy"))))
+	if policy != "" && !isValidPromptOptimizationPolicy(policy) {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "policy must be one of: off, limit_only, always, llm_assisted, prefix_stable")
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil || !json.Valid(body) {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	format := MessageFormat(strings.ToLower(strings.TrimSpace(c.Query("format"))))
+	switch format {
+	case "":
+		format = detectMessageFormat(body)
+	case MessageFormatOpenAI, MessageFormatAnthropic:
+	default:
+		pm.sendErrorResponse(c, http.StatusBadRequest, "format must be one of: openai, anthropic")
+		return
+	}
+	requestPath := "/v1/chat/completions"
+	if format == MessageFormatAnthropic {
+		requestPath = "/v1/messages"
+	}
+
+	opt, err := pm.optimizePrompt(modelName, requestPath, body, promptOptimizeOptions{policy: policy, dryRun: true})
+	if err != nil {
+		pm.sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("context control rejected request: %s", err.Error()))
+		return
+	}
+	if !opt.evaluated {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "request body must contain a messages array")
+		return
+	}
+
+	tokensBefore, tokensAfter, err := opt.countTokens()
+	if err != nil {
+		pm.sendErrorResponse(c, http.StatusInternalServerError, "failed to count tokens: "+err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, PromptOptimizationPreview{
+		Model:                modelName,
+		Policy:               opt.result.Policy,
+		Format:               opt.format,
+		Applied:              opt.result.Applied,
+		Note:                 opt.result.Note,
+		TokensBefore:         tokensBefore,
+		TokensAfter:          tokensAfter,
+		Changes:              diffPromptMessages(opt.original.Messages, opt.messages),
+		PrunedTools:          opt.result.PrunedTools,
+		TruncatedToolResults: opt.result.TruncatedToolResults,
+		OptimizedBody:        opt.body,
+	})
+}
+
+// apiResetModelRuntimeState drops every runtime override for a model so it
+// falls back to the values from config.yaml.
+func (pm *ProxyManager) apiResetModelRuntimeState(c *gin.Context) {
+	requestedModel := strings.TrimSpace(c.Param("model"))
+	if requestedModel == "" {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "model name required")
+		return
+	}
+
+	modelName, found := pm.config.RealModelName(requestedModel)
+	if !found {
+		if ollamaModel, exists := pm.GetOllamaModelByID(requestedModel); exists {
+			modelName = ollamaModel.ID
+			found = true
+		}
+		if !found {
+			pm.sendErrorResponse(c, http.StatusNotFound, "model not found")
+			return
+		}
+	}
+
+	pm.Lock()
+	delete(pm.ctxSizes, modelName)
+	delete(pm.fitModes, modelName)
+	delete(pm.fitCtxModes, modelName)
+	delete(pm.promptPolicies, modelName)
+	pm.Unlock()
+
+	if err := pm.saveRuntimeStateToDisk(); err != nil {
+		pm.sendErrorResponse(c, http.StatusInternalServerError, "failed to save runtime state: "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"msg": "runtime overrides reset to config defaults", "model": modelName})
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runtimeStateDiskState is the on-disk form of the per-model overrides set
+// through /api/model/:model/*. It lives next to tools.json so that tuning done
+// in the UI survives restarts and config reloads.
+type runtimeStateDiskState struct {
+	CtxSizes       map[string]int                      `json:"ctxSizes,omitempty"`
+	FitModes       map[string]bool                     `json:"fitModes,omitempty"`
+	FitCtxModes    map[string]string                   `json:"fitCtxModes,omitempty"`
+	PromptPolicies map[string]PromptOptimizationPolicy `json:"promptPolicies,omitempty"`
+}
+
+func (pm *ProxyManager) runtimeStateFilePath() string {
+	cfg := strings.TrimSpace(pm.configPath)
+	if cfg == "" {
+		return "runtime-state.json"
+	}
+	return filepath.Join(filepath.Dir(cfg), "runtime-state.json")
+}
+
+// loadRuntimeStateFromDisk is called by SetConfigPath, the state file lives
+// next to the config file and is not read before its path is known.
+func (pm *ProxyManager) loadRuntimeStateFromDisk() {
+	pm.Lock()
+	defer pm.Unlock()
+	pm.loadRuntimeStateLocked()
+}
+
+// loadRuntimeStateLocked replaces the in-memory overrides with the persisted
+// ones. A missing file resets to empty maps. pm must be locked.
+func (pm *ProxyManager) loadRuntimeStateLocked() {
+	pm.ctxSizes = make(map[string]int)
+	pm.fitModes = make(map[string]bool)
+	pm.fitCtxModes = make(map[string]string)
+	pm.promptPolicies = make(map[string]PromptOptimizationPolicy)
+
+	path := pm.runtimeStateFilePath()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var state runtimeStateDiskState
+	if err := json.Unmarshal(b, &state); err != nil {
+		pm.proxyLogger.Warnf("failed to parse runtime state file %s: %v", path, err)
+		return
+	}
+
+	for model, ctxSize := range state.CtxSizes {
+		if ctxSize > 0 {
+			pm.ctxSizes[model] = ctxSize
+		}
+	}
+	for model, fit := range state.FitModes {
+		pm.fitModes[model] = fit
+	}
+	for model, mode := range state.FitCtxModes {
+		if mode == "max" || mode == "min" {
+			pm.fitCtxModes[model] = mode
+		}
+	}
+	for model, policy := range state.PromptPolicies {
+		if isValidPromptOptimizationPolicy(policy) {
+			pm.promptPolicies[model] = policy
+		}
+	}
+}
+
+// saveRuntimeStateToDisk writes the current overrides. Saves run one at a
+// time from snapshot to rename, so the file always ends up with the latest
+// snapshot.
+func (pm *ProxyManager) saveRuntimeStateToDisk() error {
+	pm.runtimeStateSaveMu.Lock()
+	defer pm.runtimeStateSaveMu.Unlock()
+
+	pm.Lock()
+	path := pm.runtimeStateFilePath()
+	state := runtimeStateDiskState{
+		CtxSizes:       make(map[string]int, len(pm.ctxSizes)),
+		FitModes:       make(map[string]bool, len(pm.fitModes)),
+		FitCtxModes:    make(map[string]string, len(pm.fitCtxModes)),
+		PromptPolicies: make(map[string]PromptOptimizationPolicy, len(pm.promptPolicies)),
+	}
+	for k, v := range pm.ctxSizes {
+		state.CtxSizes[k] = v
+	}
+	for k, v := range pm.fitModes {
+		state.FitModes[k] = v
+	}
+	for k, v := range pm.fitCtxModes {
+		state.FitCtxModes[k] = v
+	}
+	for k, v := range pm.promptPolicies {
+		state.PromptPolicies[k] = v
+	}
+	pm.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o644)
+}
+
+// writeFileAtomic writes data to a temp file in the target directory and
+// renames it into place so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRuntimeStateTestProxy(t *testing.T, dir string) *ProxyManager {
+	t.Helper()
+	cfg := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+		},
+		LogLevel: "error",
+	})
+	pm := New(cfg)
+	pm.SetConfigPath(filepath.Join(dir, "config.yaml"))
+	return pm
+}
+
+func TestProxyManager_RuntimeStatePersistsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	pm := newRuntimeStateTestProxy(t, dir)
+
+	for path, body := range map[string]string{
+		"/api/model/model1/ctxsize":             `{"ctxSize":16384}`,
+		"/api/model/model1/fit":                 `{"fit":true,"mode":"min"}`,
+		"/api/model/model1/prompt-optimization": `{"policy":"always"}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		w := CreateTestResponseRecorder()
+		pm.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+	pm.Shutdown()
+
+	_, err := os.Stat(filepath.Join(dir, "runtime-state.json"))
+	assert.NoError(t, err)
+
+	restarted := newRuntimeStateTestProxy(t, dir)
+	defer restarted.Shutdown()
+	assert.Equal(t, 16384, restarted.ctxSizes["model1"])
+	assert.Equal(t, true, restarted.fitModes["model1"])
+	assert.Equal(t, "min", restarted.fitCtxModes["model1"])
+	assert.Equal(t, PromptOptimizationAlways, restarted.promptPolicies["model1"])
+}
+
+func TestProxyManager_RuntimeStateReset(t *testing.T) {
+	dir := t.TempDir()
+	pm := newRuntimeStateTestProxy(t, dir)
+	defer pm.Shutdown()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/model/model1/ctxsize", bytes.NewBufferString(`{"ctxSize":4096}`))
+	w := CreateTestResponseRecorder()
+	pm.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/model/model1/reset", nil)
+	w = CreateTestResponseRecorder()
+	pm.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	pm.Lock()
+	_, hasCtx := pm.ctxSizes["model1"]
+	pm.Unlock()
+	assert.False(t, hasCtx)
+
+	restarted := newRuntimeStateTestProxy(t, dir)
+	defer restarted.Shutdown()
+	_, hasCtx = restarted.ctxSizes["model1"]
+	assert.False(t, hasCtx)
+}
+
+func TestProxyManager_RuntimeStateWaitsForConfigPath(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "runtime-state.json"), []byte(`{"ctxSizes":{"model1":2048}}`), 0o644))
+	t.Chdir(dir)
+
+	pm := New(config.AddDefaultGroupToConfig(config.Config{
+		Models:   map[string]config.ModelConfig{"model1": getTestSimpleResponderConfig("model1")},
+		LogLevel: "error",
+	}))
+	defer pm.Shutdown()
+	_, hasCtx := pm.ctxSizes["model1"]
+	assert.False(t, hasCtx, "state in the working directory must not be read before the config path is set")
+}
+
+func TestProxyManager_RuntimeStateConcurrentSaves(t *testing.T) {
+	dir := t.TempDir()
+	pm := newRuntimeStateTestProxy(t, dir)
+	defer pm.Shutdown()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(ctxSize int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/model/model1/ctxsize", bytes.NewBufferString(fmt.Sprintf(`{"ctxSize":%d}`, ctxSize)))
+			w := CreateTestResponseRecorder()
+			pm.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}(i * 1024)
+	}
+	wg.Wait()
+
+	pm.Lock()
+	want := pm.ctxSizes["model1"]
+	pm.Unlock()
+
+	restarted := newRuntimeStateTestProxy(t, dir)
+	defer restarted.Shutdown()
+	assert.Equal(t, want, restarted.ctxSizes["model1"])
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const maxSummaryCacheEntriesPerModel = 32
+
+type summaryCacheOutcome string
+
+const (
+	summaryCacheHit    summaryCacheOutcome = "hit"
+	summaryCacheExtend summaryCacheOutcome = "extend"
+	summaryCacheMiss   summaryCacheOutcome = "miss"
+)
+
+// SummaryCacheStats reports how often llm_assisted summaries were reused
+type SummaryCacheStats struct {
+	Hits    int `json:"hits"`
+	Extends int `json:"extends"`
+	Misses  int `json:"misses"`
+	Entries int `json:"entries"`
+}
+
+type summaryCacheEntry struct {
+	summary  string
+	lastUsed time.Time
+}
+
+// summaryCache stores llm_assisted summaries keyed by a chained hash of the
+// summarized message prefix. Agent loops re-send the same history with a few
+// messages appended, so a request either matches a cached prefix exactly or
+// can extend the summary of a shorter cached prefix.
+type summaryCache struct {
+	sync.Mutex
+	entries map[string]map[string]summaryCacheEntry
+	stats   map[string]SummaryCacheStats
+}
+
+func newSummaryCache() *summaryCache {
+	return &summaryCache{
+		entries: make(map[string]map[string]summaryCacheEntry),
+		stats:   make(map[string]SummaryCacheStats),
+	}
+}
+
+// summaryPrefixHashes returns len(messages)+1 hashes where hashes[k] covers
+// messages[:k]. Each hash chains the previous one so prefixes share work.
+func summaryPrefixHashes(messages []ChatMessage) []string {
+	hashes := make([]string, 0, len(messages)+1)
+	prev := ""
+	hashes = append(hashes, prev)
+	for _, msg := range messages {
+		encoded, _ := json.Marshal(msg)
+		h := sha256.New()
+		h.Write([]byte(prev))
+		h.Write(encoded)
+		prev = hex.EncodeToString(h.Sum(nil))
+		hashes = append(hashes, prev)
+	}
+	return hashes
+}
+
+// lookup finds the longest cached prefix. It returns the cached summary and
+// how many messages it covers, or 0 when nothing is cached. A dry run
+// leaves the entry's eviction order alone.
+func (sc *summaryCache) lookup(modelID string, prefixHashes []string, dryRun bool) (string, int) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	modelEntries := sc.entries[modelID]
+	for k := len(prefixHashes) - 1; k > 0; k-- {
+		if entry, ok := modelEntries[prefixHashes[k]]; ok {
+			if !dryRun {
+				entry.lastUsed = time.Now()
+				modelEntries[prefixHashes[k]] = entry
+			}
+			return entry.summary, k
+		}
+	}
+	return "", 0
+}
+
+func (sc *summaryCache) store(modelID string, prefixHash string, summary string) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	modelEntries, ok := sc.entries[modelID]
+	if !ok {
+		modelEntries = make(map[string]summaryCacheEntry)
+		sc.entries[modelID] = modelEntries
+	}
+	modelEntries[prefixHash] = summaryCacheEntry{summary: summary, lastUsed: time.Now()}
+
+	for len(modelEntries) > maxSummaryCacheEntriesPerModel {
+		oldestKey := ""
+		var oldest time.Time
+		for key, entry := range modelEntries {
+			if oldestKey == "" || entry.lastUsed.Before(oldest) {
+				oldestKey = key
+				oldest = entry.lastUsed
+			}
+		}
+		delete(modelEntries, oldestKey)
+	}
+}
+
+func (sc *summaryCache) record(modelID string, outcome summaryCacheOutcome) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	stats := sc.stats[modelID]
+	switch outcome {
+	case summaryCacheHit:
+		stats.Hits++
+	case summaryCacheExtend:
+		stats.Extends++
+	case summaryCacheMiss:
+		stats.Misses++
+	}
+	sc.stats[modelID] = stats
+}
+
+// Stats returns the counters for a model, or nil if llm_assisted never ran
+func (sc *summaryCache) Stats(modelID string) *SummaryCacheStats {
+	sc.Lock()
+	defer sc.Unlock()
+
+	stats, ok := sc.stats[modelID]
+	if !ok {
+		return nil
+	}
+	stats.Entries = len(sc.entries[modelID])
+	return &stats
+}
+
+func (sc *summaryCache) Reset() {
+	sc.Lock()
+	defer sc.Unlock()
+	sc.entries = make(map[string]map[string]summaryCacheEntry)
+	sc.stats = make(map[string]SummaryCacheStats)
+}
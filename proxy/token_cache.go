@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+)
+
+const (
+	maxTokenCountEntriesPerModel = 8192
+	// defaultTokensPerKiloWord is the word based estimate used until a model
+	// is calibrated, ~1.3 tokens per word
+	defaultTokensPerKiloWord = 1300
+	// minCalibrationWords of tokenized text are needed before the observed
+	// ratio replaces the default
+	minCalibrationWords = 500
+	// maxCalibrationWords bounds the calibration window. Past it both sums are
+	// halved so the ratio follows the text a model currently sees.
+	maxCalibrationWords = 1 << 20
+)
+
+// TokenCountCacheStats reports how many message token counts were served from
+// the cache and the calibrated word estimate of a model
+type TokenCountCacheStats struct {
+	Hits    int `json:"hits"`
+	Misses  int `json:"misses"`
+	Entries int `json:"entries"`
+	// TokensPerKiloWord is the fallback estimate learned from /tokenize, 0
+	// until enough text was tokenized
+	TokensPerKiloWord int `json:"tokensPerKiloWord,omitempty"`
+}
+
+type tokenCountEntry struct {
+	tokens   int
+	lastUsed uint64
+}
+
+type tokenCalibration struct {
+	words  int
+	tokens int
+}
+
+// tokenCountCache stores /tokenize results per message, keyed by model and
+// a hash of the counted text. Agent loops re-send the same history on every
+// turn, so only the messages appended since need to be tokenized.
+type tokenCountCache struct {
+	sync.Mutex
+	entries     map[string]map[string]tokenCountEntry
+	calibration map[string]tokenCalibration
+	stats       map[string]TokenCountCacheStats
+	clock       uint64
+	// pending holds the keys being tokenized in the background, so a part
+	// sent again before its count is stored is not tokenized twice
+	pending map[string]map[string]bool
+	fills   sync.WaitGroup
+	// parent is the shared cache a preview copy reads through to
+	parent *tokenCountCache
+}
+
+func newTokenCountCache() *tokenCountCache {
+	return &tokenCountCache{
+		entries:     make(map[string]map[string]tokenCountEntry),
+		calibration: make(map[string]tokenCalibration),
+		stats:       make(map[string]TokenCountCacheStats),
+		pending:     make(map[string]map[string]bool),
+	}
+}
+
+func tokenCountKey(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+func (tc *tokenCountCache) get(modelID string, key string) (int, bool) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	entry, ok := tc.entries[modelID][key]
+	if !ok {
+		if tc.parent != nil {
+			return tc.parent.peek(modelID, key)
+		}
+		return 0, false
+	}
+	tc.clock++
+	entry.lastUsed = tc.clock
+	tc.entries[modelID][key] = entry
+	return entry.tokens, true
+}
+
+// peek returns a cached count without marking it used
+func (tc *tokenCountCache) peek(modelID string, key string) (int, bool) {
+	tc.Lock()
+	defer tc.Unlock()
+	entry, ok := tc.entries[modelID][key]
+	return entry.tokens, ok
+}
+
+func (tc *tokenCountCache) store(modelID string, key string, tokens int) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	modelEntries, ok := tc.entries[modelID]
+	if !ok {
+		modelEntries = make(map[string]tokenCountEntry)
+		tc.entries[modelID] = modelEntries
+	}
+	tc.clock++
+	modelEntries[key] = tokenCountEntry{tokens: tokens, lastUsed: tc.clock}
+
+	if len(modelEntries) <= maxTokenCountEntriesPerModel {
+		return
+	}
+	// evict the least recently used quarter at once so a full cache does not
+	// scan on every store
+	keys := make([]string, 0, len(modelEntries))
+	for k := range modelEntries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return modelEntries[keys[i]].lastUsed < modelEntries[keys[j]].lastUsed
+	})
+	for _, k := range keys[:len(keys)/4] {
+		delete(modelEntries, k)
+	}
+}
+
+// fill runs tokenize in the background with the keys of missing that are not
+// being tokenized already
+func (tc *tokenCountCache) fill(modelID string, missing map[string]int, tokenize func(missing map[string]int)) {
+	if tc.parent != nil {
+		// a preview copy is dropped after one request
+		return
+	}
+	tc.Lock()
+	pending, ok := tc.pending[modelID]
+	if !ok {
+		pending = make(map[string]bool)
+		tc.pending[modelID] = pending
+	}
+	claimed := make(map[string]int, len(missing))
+	for key, i := range missing {
+		if !pending[key] {
+			pending[key] = true
+			claimed[key] = i
+		}
+	}
+	tc.Unlock()
+	if len(claimed) == 0 {
+		return
+	}
+
+	tc.fills.Add(1)
+	go func() {
+		defer tc.fills.Done()
+		tokenize(claimed)
+		tc.Lock()
+		for key := range claimed {
+			delete(pending, key)
+		}
+		tc.Unlock()
+	}()
+}
+
+// wait blocks until the background tokenization started so far is done
+func (tc *tokenCountCache) wait() {
+	tc.fills.Wait()
+}
+
+// calibrate records the words and tokens of text counted by /tokenize
+func (tc *tokenCountCache) calibrate(modelID string, words, tokens int) {
+	if words <= 0 || tokens <= 0 {
+		return
+	}
+	tc.Lock()
+	defer tc.Unlock()
+
+	c := tc.calibration[modelID]
+	c.words += words
+	c.tokens += tokens
+	for c.words > maxCalibrationWords {
+		c.words /= 2
+		c.tokens /= 2
+	}
+	tc.calibration[modelID] = c
+}
+
+// tokensPerKiloWord returns the observed tokens per 1000 words of a model, or
+// 0 while too little text was tokenized
+func (tc *tokenCountCache) tokensPerKiloWord(modelID string) int {
+	tc.Lock()
+	defer tc.Unlock()
+	return tc.tokensPerKiloWordLocked(modelID)
+}
+
+func (tc *tokenCountCache) tokensPerKiloWordLocked(modelID string) int {
+	c := tc.calibration[modelID]
+	if c.words < minCalibrationWords {
+		return 0
+	}
+	return c.tokens * 1000 / c.words
+}
+
+func (tc *tokenCountCache) record(modelID string, hits, misses int) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	stats := tc.stats[modelID]
+	stats.Hits += hits
+	stats.Misses += misses
+	tc.stats[modelID] = stats
+}
+
+// Stats returns the counters for a model, or nil if nothing was counted
+func (tc *tokenCountCache) Stats(modelID string) *TokenCountCacheStats {
+	tc.Lock()
+	defer tc.Unlock()
+
+	stats, ok := tc.stats[modelID]
+	if !ok {
+		return nil
+	}
+	stats.Entries = len(tc.entries[modelID])
+	stats.TokensPerKiloWord = tc.tokensPerKiloWordLocked(modelID)
+	return &stats
+}
+
+// previewCopy returns a cache that reads the counts and calibration of tc
+// without writing to it or changing its eviction order, so counts made with
+// it match tc while the counts it stores stay in the copy
+func (tc *tokenCountCache) previewCopy() *tokenCountCache {
+	tc.Lock()
+	defer tc.Unlock()
+	c := newTokenCountCache()
+	c.parent = tc
+	for modelID, calibration := range tc.calibration {
+		c.calibration[modelID] = calibration
+	}
+	return c
+}
+
+func (tc *tokenCountCache) Reset() {
+	tc.Lock()
+	defer tc.Unlock()
+	tc.entries = make(map[string]map[string]tokenCountEntry)
+	tc.calibration = make(map[string]tokenCalibration)
+	tc.stats = make(map[string]TokenCountCacheStats)
+}
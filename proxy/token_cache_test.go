@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextManager_TokenCountCache(t *testing.T) {
+	var calls atomic.Int32
+	// two tokens per word, so calibration can be told from the default
+	tokenizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req struct {
+			Content string `json:"content"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		fmt.Fprintf(w, `{"count":%d}`, 2*len(strings.Fields(req.Content)))
+	}))
+	defer tokenizer.Close()
+
+	cache := newTokenCountCache()
+	newCM := func(modelID string) *ContextManager {
+		return NewContextManager(modelID, 0, SlidingWindow, testLogger, tokenizer.URL).WithTokenCache(cache)
+	}
+	words := func(n int) string { return strings.TrimSpace(strings.Repeat("word ", n)) }
+
+	messages := []ChatMessage{
+		{Role: "system", Content: words(9)},
+		{Role: "user", Content: words(299)},
+	}
+	// each part is "[ROLE]: " plus the words, and one separator per part
+	want := 2*10 + 2*300 + 2
+
+	// the uncached messages are counted with one call and tokenized one by
+	// one in the background
+	tokens, err := newCM("m").CountChatTokens(messages, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, want, tokens)
+	cache.wait()
+	assert.Equal(t, int32(3), calls.Load())
+
+	// the history is cached, only the appended messages are tokenized
+	messages = append(messages,
+		ChatMessage{Role: "assistant", Content: words(199)},
+		ChatMessage{Role: "user", Content: words(4)},
+	)
+	want += 2*200 + 2*5 + 2
+	tokens, err = newCM("m").CountChatTokens(messages, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, want, tokens)
+	cache.wait()
+	assert.Equal(t, int32(6), calls.Load())
+
+	tokens, err = newCM("m").CountChatTokens(messages, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, want, tokens)
+	cache.wait()
+	assert.Equal(t, int32(6), calls.Load())
+
+	// counts are kept per model
+	_, err = newCM("other").CountChatTokens(messages, nil)
+	assert.NoError(t, err)
+	cache.wait()
+	assert.Equal(t, int32(11), calls.Load())
+
+	stats := cache.Stats("m")
+	if assert.NotNil(t, stats) {
+		assert.Equal(t, 6, stats.Hits)
+		assert.Equal(t, 4, stats.Misses)
+		assert.Equal(t, 4, stats.Entries)
+		assert.Equal(t, 2000, stats.TokensPerKiloWord)
+	}
+
+	// without /tokenize, cached messages keep their exact count and new
+	// ones are estimated at the calibrated ratio
+	tokenizer.Close()
+	messages = append(messages, ChatMessage{Role: "user", Content: words(99)})
+	tokens, err = newCM("m").CountChatTokens(messages, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, want+2*100+1, tokens)
+
+	// an uncalibrated model falls back to ~1.3 tokens per word
+	tokens, err = newCM("new").CountChatTokens([]ChatMessage{{Role: "user", Content: words(99)}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 130+1, tokens)
+}
+
+func TestTokenCountCache_PreviewCopy(t *testing.T) {
+	cache := newTokenCountCache()
+	cache.store("m", "old", 10)
+	cache.store("m", "new", 20)
+	cache.calibrate("m", 1000, 2000)
+
+	preview := cache.previewCopy()
+	assert.Equal(t, 2000, preview.tokensPerKiloWord("m"))
+
+	// counts of the shared cache are read without marking them used
+	tokens, ok := preview.get("m", "old")
+	assert.True(t, ok)
+	assert.Equal(t, 10, tokens)
+	assert.Less(t, cache.entries["m"]["old"].lastUsed, cache.entries["m"]["new"].lastUsed)
+
+	// counts stored in the copy stay there
+	preview.store("m", "preview", 30)
+	preview.calibrate("m", 1000, 1000)
+	tokens, ok = preview.get("m", "preview")
+	assert.True(t, ok)
+	assert.Equal(t, 30, tokens)
+	_, ok = cache.get("m", "preview")
+	assert.False(t, ok)
+	assert.Equal(t, 2000, cache.tokensPerKiloWord("m"))
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -27,6 +28,10 @@ const (
 	ToolPolicyAlways   RuntimeToolPolicy = "always"
 	ToolPolicyWatchdog RuntimeToolPolicy = "watchdog"
 	ToolPolicyNever    RuntimeToolPolicy = "never"
+
+	// MCPTransportStdio runs an MCP server as a child process and speaks
+	// JSON-RPC over its stdin and stdout
+	MCPTransportStdio = "stdio"
 )
 
 type ToolRuntimeSettings struct {
@@ -52,6 +57,23 @@ type RuntimeTool struct {
 	Policy          RuntimeToolPolicy `json:"policy,omitempty"` // auto|always|watchdog|never
 	RequireApproval bool              `json:"requireApproval,omitempty"`
 	TimeoutSeconds  int               `json:"timeoutSeconds,omitempty"`
+	// Transport is "stdio" for MCP servers started from Command, Args, Env
+	// and WorkDir. Everything else reaches Endpoint over HTTP.
+	Transport string   `json:"transport,omitempty"`
+	Command   string   `json:"command,omitempty"`
+	Args      []string `json:"args,omitempty"`
+	Env       []string `json:"env,omitempty"` // KEY=VALUE
+	WorkDir   string   `json:"workDir,omitempty"`
+	// RemoteTools caches the tools/list result of an MCP server, refreshed
+	// in the background when the tool is created, updated or refreshed
+	RemoteTools      []MCPRemoteTool `json:"remoteTools,omitempty"`
+	RemoteToolsError string          `json:"remoteToolsError,omitempty"`
+	// RemoteToolsRefreshing is set in API responses while a refresh runs,
+	// it is not stored
+	RemoteToolsRefreshing bool `json:"remoteToolsRefreshing,omitempty"`
+	// Session reports the MCP session or stdio process of the tool in
+	// /api/tools, it is not stored
+	Session *MCPSessionStatus `json:"session,omitempty"`
 }
 
 type ToolApprovalCall struct {
@@ -125,6 +147,24 @@ func normalizeRuntimeTool(t RuntimeTool) RuntimeTool {
 	t.Endpoint = strings.TrimSpace(t.Endpoint)
 	t.Description = strings.TrimSpace(t.Description)
 	t.RemoteName = strings.TrimSpace(t.RemoteName)
+	t.Session = nil
+	t.RemoteToolsRefreshing = false
+	if t.Type != RuntimeToolMCP {
+		t.RemoteTools = nil
+		t.RemoteToolsError = ""
+	}
+	if t.Type == RuntimeToolMCP && strings.EqualFold(strings.TrimSpace(t.Transport), MCPTransportStdio) {
+		t.Transport = MCPTransportStdio
+		t.Command = strings.TrimSpace(t.Command)
+		t.WorkDir = strings.TrimSpace(t.WorkDir)
+		t.Env = slices.DeleteFunc(t.Env, func(kv string) bool { return strings.TrimSpace(kv) == "" })
+	} else {
+		t.Transport = ""
+		t.Command = ""
+		t.Args = nil
+		t.Env = nil
+		t.WorkDir = ""
+	}
 	switch strings.ToLower(strings.TrimSpace(string(t.Policy))) {
 	case string(ToolPolicyAlways):
 		t.Policy = ToolPolicyAlways
@@ -189,6 +229,8 @@ func (pm *ProxyManager) loadToolsFromDisk() {
 }
 
 func (pm *ProxyManager) saveToolsToDisk() error {
+	pm.toolsSaveMu.Lock()
+	defer pm.toolsSaveMu.Unlock()
 	path := pm.toolsFilePath()
 	pm.Lock()
 	toolsCopy := append([]RuntimeTool(nil), pm.tools...)
@@ -222,7 +264,7 @@ func (pm *ProxyManager) getEnabledTools() []RuntimeTool {
 	}
 	for _, t := range pm.tools {
 		t = normalizeRuntimeTool(t)
-		if t.Enabled && t.Policy != ToolPolicyNever && t.Name != "" && t.Endpoint != "" {
+		if t.Enabled && t.Policy != ToolPolicyNever && t.Name != "" && t.hasTarget() && (!t.isStdio() || pm.config.AllowStdioTools) {
 			out = append(out, t)
 		}
 	}
@@ -230,26 +272,50 @@ func (pm *ProxyManager) getEnabledTools() []RuntimeTool {
 }
 
 func (pm *ProxyManager) toolByName(name string) (RuntimeTool, bool) {
+	name = strings.TrimSpace(name)
 	pm.Lock()
-	defer pm.Unlock()
 	if !pm.toolSettings.Enabled {
+		pm.Unlock()
 		return RuntimeTool{}, false
 	}
 	for _, t := range pm.tools {
 		t = normalizeRuntimeTool(t)
-		if t.Enabled && t.Policy != ToolPolicyNever && strings.EqualFold(t.Name, strings.TrimSpace(name)) {
+		if t.Enabled && t.Policy != ToolPolicyNever && strings.EqualFold(t.Name, name) {
+			pm.Unlock()
 			return t, true
 		}
 	}
+	pm.Unlock()
+
+	// remote MCP tools are called by their exposed function name
+	for _, fn := range pm.exposedRemoteFunctions(pm.getEnabledTools()) {
+		if strings.EqualFold(fn.name, name) {
+			return fn.tool, true
+		}
+	}
 	return RuntimeTool{}, false
 }
 
 func (pm *ProxyManager) toolSchemas() []map[string]any {
 	tools := pm.getEnabledTools()
+	remoteFunctions := pm.exposedRemoteFunctions(tools)
 	result := make([]map[string]any, 0, len(tools))
-	for _, t := range tools {
+	for i, t := range tools {
+		if t.exposesRemoteTools() {
+			for _, fn := range remoteFunctions {
+				if fn.index == i {
+					result = append(result, remoteFunctionSchema(fn))
+				}
+			}
+			continue
+		}
 		description := strings.TrimSpace(t.Description)
-		if description == "" {
+		if remote, ok := t.remoteTool(t.RemoteName); ok && description == "" {
+			description = remote.Description
+		}
+		if description == "" && t.isStdio() {
+			description = fmt.Sprintf("MCP server: %s", t.Command)
+		} else if description == "" {
 			description = fmt.Sprintf("Tool endpoint: %s", t.Endpoint)
 		}
 		parameters := toolParametersSchema(t)
@@ -284,6 +350,9 @@ func toolParametersSchema(t RuntimeTool) map[string]any {
 	// - fixed remoteName: pass arguments directly
 	// - gateway mode: caller provides remote tool name and arguments object
 	if strings.TrimSpace(t.RemoteName) != "" {
+		if remote, ok := t.remoteTool(t.RemoteName); ok {
+			return remoteToolParameters(remote)
+		}
 		return map[string]any{
 			"type":                 "object",
 			"additionalProperties": true,
@@ -325,7 +394,7 @@ func (pm *ProxyManager) executeToolCall(toolName string, args map[string]any, he
 	if required, headerName := toolApprovalRequired(tool, settings, headers); required {
 		return "", fmt.Errorf("tool %s requires approval header %s=true", toolName, headerName)
 	}
-	if err := validateToolEndpoint(tool.Endpoint, settings); err != nil {
+	if err := pm.validateToolTarget(tool, settings); err != nil {
 		return "", err
 	}
 
@@ -558,32 +627,22 @@ func (pm *ProxyManager) executeMCPTool(tool RuntimeTool, args map[string]any, ti
 	if err != nil {
 		return "", err
 	}
+	if remote, ok := tool.remoteTool(remoteName); ok && remote.Disabled {
+		return "", fmt.Errorf("mcp tool %s is disabled", remoteName)
+	}
 
-	client := &http.Client{Timeout: time.Duration(timeoutSeconds) * time.Second}
-	sessionID, err := mcpInitializeSession(client, tool.Endpoint)
+	call, err := pm.mcpSession(tool, timeoutSeconds)
 	if err != nil {
 		return "", err
 	}
-
-	reqBody := map[string]any{
-		"jsonrpc": "2.0",
-		"id":      1,
-		"method":  "tools/call",
-		"params": map[string]any{
-			"name":      remoteName,
-			"arguments": callArgs,
-		},
-	}
-	body, err := mcpPostJSONRPC(client, tool.Endpoint, sessionID, reqBody)
+	payload, err := call("tools/call", map[string]any{
+		"name":      remoteName,
+		"arguments": callArgs,
+	})
 	if err != nil {
 		return "", err
 	}
 
-	payload := extractMCPPayload(body)
-	if len(payload) == 0 {
-		payload = body
-	}
-
 	if txt := gjson.GetBytes(payload, "result.content.0.text").String(); strings.TrimSpace(txt) != "" {
 		return txt, nil
 	}
@@ -652,19 +711,25 @@ func resolveMCPCall(tool RuntimeTool, args map[string]any) (string, map[string]a
 	return remoteName, callArgs, nil
 }
 
+// mcpInitializeParams are the params of the initialize request sent to
+// every MCP server
+func mcpInitializeParams() map[string]any {
+	return map[string]any{
+		"protocolVersion": "2025-06-18",
+		"capabilities":    map[string]any{},
+		"clientInfo": map[string]any{
+			"name":    "tbg-ollama-swap",
+			"version": "1.0.0",
+		},
+	}
+}
+
 func mcpInitializeSession(client *http.Client, endpoint string) (string, error) {
 	initReq := map[string]any{
 		"jsonrpc": "2.0",
 		"id":      1,
 		"method":  "initialize",
-		"params": map[string]any{
-			"protocolVersion": "2025-06-18",
-			"capabilities":    map[string]any{},
-			"clientInfo": map[string]any{
-				"name":    "tbg-ollama-swap",
-				"version": "1.0.0",
-			},
-		},
+		"params":  mcpInitializeParams(),
 	}
 	initBody, err := json.Marshal(initReq)
 	if err != nil {
@@ -728,11 +793,21 @@ func mcpPostJSONRPC(client *http.Client, endpoint string, sessionID string, reqB
 		return nil, err
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("mcp status %d: %s", resp.StatusCode, string(body))
+		return nil, &mcpStatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 	return body, nil
 }
 
+// mcpStatusError is a non 2xx response of an MCP server
+type mcpStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *mcpStatusError) Error() string {
+	return fmt.Sprintf("mcp status %d: %s", e.StatusCode, e.Body)
+}
+
 func extractMCPPayload(raw []byte) []byte {
 	body := bytes.TrimSpace(raw)
 	if len(body) == 0 {
@@ -793,6 +868,35 @@ func validateToolEndpoint(endpoint string, settings ToolRuntimeSettings) error {
 	return nil
 }
 
+// validateToolTarget checks what a tool calls. Stdio MCP servers run a
+// command on this host and need allowStdioTools in the config file, HTTP
+// endpoints are checked by validateToolEndpoint.
+func (pm *ProxyManager) validateToolTarget(tool RuntimeTool, settings ToolRuntimeSettings) error {
+	if tool.isStdio() {
+		if !pm.config.AllowStdioTools {
+			return fmt.Errorf("stdio tools are disabled, set allowStdioTools in the config file to enable them")
+		}
+		if tool.Command == "" {
+			return fmt.Errorf("stdio tool requires a command")
+		}
+		return nil
+	}
+	return validateToolEndpoint(tool.Endpoint, settings)
+}
+
+// isStdio reports whether a tool is an MCP server run as a child process
+func (t RuntimeTool) isStdio() bool {
+	return t.Type == RuntimeToolMCP && t.Transport == MCPTransportStdio
+}
+
+// hasTarget reports whether a tool has an endpoint or, for stdio, a command
+func (t RuntimeTool) hasTarget() bool {
+	if t.isStdio() {
+		return t.Command != ""
+	}
+	return t.Endpoint != ""
+}
+
 func extractLastUserMessageText(body []byte) string {
 	msgs := gjson.GetBytes(body, "messages")
 	if !msgs.IsArray() {
@@ -851,10 +955,24 @@ func (pm *ProxyManager) forcedToolName(body []byte) string {
 	if len(tools) == 0 {
 		return ""
 	}
-	for _, t := range tools {
-		if t.Policy == ToolPolicyAlways {
+	remoteFunctions := pm.exposedRemoteFunctions(tools)
+	for i, t := range tools {
+		if t.Policy != ToolPolicyAlways {
+			continue
+		}
+		if !t.exposesRemoteTools() {
 			return t.Name
 		}
+		// an MCP server exposed as several functions cannot be forced
+		var names []string
+		for _, fn := range remoteFunctions {
+			if fn.index == i {
+				names = append(names, fn.name)
+			}
+		}
+		if len(names) == 1 {
+			return names[0]
+		}
 	}
 	if settings.WebSearchMode != "force" {
 		return ""
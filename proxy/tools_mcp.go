@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// MCPRemoteTool is a tool an MCP server reported in tools/list. Disabled
+// tools are neither exposed to the model nor callable through the server.
+type MCPRemoteTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"inputSchema,omitempty"`
+	Disabled    bool           `json:"disabled,omitempty"`
+}
+
+// maxMCPListPages bounds tools/list pagination against servers that keep
+// returning a cursor
+const maxMCPListPages = 20
+
+// maxToolFunctionName is the longest function name OpenAI compatible APIs
+// accept
+const maxToolFunctionName = 64
+
+// mcpCallFunc sends a JSON-RPC request to an initialized MCP session and
+// returns the JSON-RPC response
+type mcpCallFunc func(method string, params map[string]any) ([]byte, error)
+
+// mcpSession returns the session of an MCP tool. HTTP sessions are reused
+// across calls, stdio servers are started on first use and keep running.
+func (pm *ProxyManager) mcpSession(tool RuntimeTool, timeoutSeconds int) (mcpCallFunc, error) {
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	if tool.isStdio() {
+		if !pm.config.AllowStdioTools {
+			return nil, fmt.Errorf("stdio tools are disabled, set allowStdioTools in the config file to enable them")
+		}
+		server, err := pm.mcpStdio.server(tool)
+		if err != nil {
+			return nil, err
+		}
+		return func(method string, params map[string]any) ([]byte, error) {
+			return server.call(method, params, timeout)
+		}, nil
+	}
+
+	session := pm.mcpHTTP.session(tool)
+	return func(method string, params map[string]any) ([]byte, error) {
+		return session.call(method, params, timeout)
+	}, nil
+}
+
+// mcpListTools calls tools/list on an initialized session, following
+// pagination cursors
+func mcpListTools(call mcpCallFunc) ([]MCPRemoteTool, error) {
+	var tools []MCPRemoteTool
+	cursor := ""
+	for page := 0; page < maxMCPListPages; page++ {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		payload, err := call("tools/list", params)
+		if err != nil {
+			return nil, err
+		}
+		if errMsg := strings.TrimSpace(gjson.GetBytes(payload, "error.message").String()); errMsg != "" {
+			return nil, fmt.Errorf("mcp error: %s", errMsg)
+		}
+		var result struct {
+			Tools      []MCPRemoteTool `json:"tools"`
+			NextCursor string          `json:"nextCursor"`
+		}
+		if err := json.Unmarshal([]byte(gjson.GetBytes(payload, "result").Raw), &result); err != nil {
+			return nil, fmt.Errorf("invalid tools/list response: %w", err)
+		}
+		for _, t := range result.Tools {
+			t.Name = strings.TrimSpace(t.Name)
+			t.Description = strings.TrimSpace(t.Description)
+			t.Disabled = false
+			if t.Name != "" {
+				tools = append(tools, t)
+			}
+		}
+		cursor = result.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	return tools, nil
+}
+
+// refreshMCPRemoteTools calls tools/list on the server of an MCP tool and
+// caches the result on the tool. Remote tools keep their disabled flag from
+// previous. When the server cannot be reached, previous stays cached and the
+// error is recorded.
+func (pm *ProxyManager) refreshMCPRemoteTools(tool RuntimeTool, previous []MCPRemoteTool) RuntimeTool {
+	if tool.Type != RuntimeToolMCP {
+		tool.RemoteTools = nil
+		tool.RemoteToolsError = ""
+		return tool
+	}
+
+	timeout := tool.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = 30
+	}
+	call, err := pm.mcpSession(tool, timeout)
+	var listed []MCPRemoteTool
+	if err == nil {
+		listed, err = mcpListTools(call)
+	}
+	if err != nil {
+		pm.proxyLogger.Warnf("tool %s: mcp tools/list failed: %v", tool.Name, err)
+		tool.RemoteTools = previous
+		tool.RemoteToolsError = err.Error()
+		return tool
+	}
+
+	disabled := make(map[string]bool, len(previous))
+	for _, t := range previous {
+		disabled[t.Name] = t.Disabled
+	}
+	for i := range listed {
+		listed[i].Disabled = disabled[listed[i].Name]
+	}
+	pm.proxyLogger.Infof("tool %s: mcp server lists %d tool(s)", tool.Name, len(listed))
+	tool.RemoteTools = listed
+	tool.RemoteToolsError = ""
+	return tool
+}
+
+// refreshMCPRemoteToolsAsync refreshes the remote tools of a stored MCP tool
+// in the background, tools/list can take as long as the tool's timeout. The
+// result is stored and saved unless the tool was deleted or refreshed again
+// in the meantime. The returned tool is marked as refreshing.
+func (pm *ProxyManager) refreshMCPRemoteToolsAsync(tool RuntimeTool) RuntimeTool {
+	if tool.Type != RuntimeToolMCP {
+		// a tool that is no longer an MCP tool drops a refresh still running
+		pm.Lock()
+		delete(pm.mcpRefreshing, tool.ID)
+		pm.Unlock()
+		return tool
+	}
+
+	pm.Lock()
+	pm.mcpRefreshSeq++
+	seq := pm.mcpRefreshSeq
+	pm.mcpRefreshing[tool.ID] = seq
+	pm.Unlock()
+
+	pm.mcpRefreshes.Add(1)
+	go func(tool RuntimeTool) {
+		defer pm.mcpRefreshes.Done()
+		refreshed := pm.refreshMCPRemoteTools(tool, tool.RemoteTools)
+
+		pm.Lock()
+		if pm.mcpRefreshing[tool.ID] != seq {
+			pm.Unlock()
+			return
+		}
+		delete(pm.mcpRefreshing, tool.ID)
+		i := slices.IndexFunc(pm.tools, func(t RuntimeTool) bool { return t.ID == tool.ID })
+		if i < 0 {
+			pm.Unlock()
+			// the refresh may have opened a session or started a process
+			pm.mcpStdio.stop(tool.ID)
+			pm.mcpHTTP.close(tool.ID)
+			return
+		}
+		pm.tools[i].RemoteTools = refreshed.RemoteTools
+		pm.tools[i].RemoteToolsError = refreshed.RemoteToolsError
+		pm.Unlock()
+
+		if err := pm.saveToolsToDisk(); err != nil {
+			pm.proxyLogger.Warnf("tool %s: failed to save tools: %v", tool.Name, err)
+		}
+	}(tool)
+
+	tool.RemoteToolsRefreshing = true
+	return tool
+}
+
+// isRefreshingMCPRemoteTools reports whether a refresh of the tool runs, pm
+// must be locked
+func (pm *ProxyManager) isRefreshingMCPRemoteTools(toolID string) bool {
+	_, ok := pm.mcpRefreshing[toolID]
+	return ok
+}
+
+// remoteTool returns the cached definition of a remote tool
+func (t RuntimeTool) remoteTool(name string) (MCPRemoteTool, bool) {
+	for _, remote := range t.RemoteTools {
+		if remote.Name == name {
+			return remote, true
+		}
+	}
+	return MCPRemoteTool{}, false
+}
+
+// exposesRemoteTools reports whether an MCP tool is offered to the model as
+// one function per remote tool instead of a single gateway function
+func (t RuntimeTool) exposesRemoteTools() bool {
+	return t.Type == RuntimeToolMCP && t.RemoteName == "" && len(t.RemoteTools) > 0
+}
+
+// mcpExposedFunction is a remote tool offered to the model as its own
+// function. tool is the server tool with RemoteName set, index its position
+// in the tool list the function was named from.
+type mcpExposedFunction struct {
+	name   string
+	index  int
+	tool   RuntimeTool
+	remote MCPRemoteTool
+}
+
+// exposedRemoteFunctions names the functions the enabled remote tools of
+// tools are exposed as. Tool names are taken first. A function name that is
+// already taken gets a hash suffix, and a remote tool whose name still
+// collides is not exposed rather than shadowing another function.
+func (pm *ProxyManager) exposedRemoteFunctions(tools []RuntimeTool) []mcpExposedFunction {
+	taken := make(map[string]bool, len(tools))
+	for _, t := range tools {
+		taken[strings.ToLower(t.Name)] = true
+	}
+	var out []mcpExposedFunction
+	for i, t := range tools {
+		if !t.exposesRemoteTools() {
+			continue
+		}
+		for _, remote := range t.RemoteTools {
+			if remote.Disabled {
+				continue
+			}
+			name := mcpFunctionName(t.Name, remote.Name)
+			if taken[strings.ToLower(name)] {
+				name = hashSuffixedFunctionName(name, t.Name, remote.Name)
+			}
+			if taken[strings.ToLower(name)] {
+				pm.proxyLogger.Debugf("tool %s: remote tool %s is not exposed, function name %s is taken", t.Name, remote.Name, name)
+				continue
+			}
+			taken[strings.ToLower(name)] = true
+			fn := t
+			fn.RemoteName = remote.Name
+			out = append(out, mcpExposedFunction{name: name, index: i, tool: fn, remote: remote})
+		}
+	}
+	return out
+}
+
+// mcpFunctionName names the function a remote tool is exposed as: the server
+// tool name and the remote name joined by "__", limited to the characters
+// and length function names allow. A name that is too long is cut and gets
+// a hash suffix, so names with a long shared prefix stay apart.
+func mcpFunctionName(server string, remote string) string {
+	sanitize := func(s string) string {
+		var b strings.Builder
+		for _, r := range s {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+				b.WriteRune(r)
+			default:
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+	name := sanitize(server) + "__" + sanitize(remote)
+	if len(name) > maxToolFunctionName {
+		name = hashSuffixedFunctionName(name, server, remote)
+	}
+	return name
+}
+
+// hashSuffixedFunctionName appends "_" and 8 hex characters of a hash of the
+// unsanitized server and remote names to name, cutting name to fit
+func hashSuffixedFunctionName(name string, server string, remote string) string {
+	sum := sha256.Sum256([]byte(server + "\x00" + remote))
+	suffix := "_" + hex.EncodeToString(sum[:4])
+	return name[:min(len(name), maxToolFunctionName-len(suffix))] + suffix
+}
+
+// remoteFunctionSchema returns the function schema of an exposed remote tool
+func remoteFunctionSchema(fn mcpExposedFunction) map[string]any {
+	description := fn.remote.Description
+	if description == "" {
+		description = fmt.Sprintf("MCP tool %s on %s", fn.remote.Name, fn.tool.Name)
+	}
+	return map[string]any{
+		"type": "function",
+		"function": map[string]any{
+			"name":        fn.name,
+			"description": description,
+			"parameters":  remoteToolParameters(fn.remote),
+		},
+	}
+}
+
+// remoteToolParameters returns the input schema of a remote tool, or an
+// empty object schema when the server did not send one
+func remoteToolParameters(remote MCPRemoteTool) map[string]any {
+	if len(remote.InputSchema) == 0 {
+		return map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+	return remote.InputSchema
+}
+
+// mcpSessionStatus returns the session health of an MCP tool that has been
+// used since the proxy started
+func (pm *ProxyManager) mcpSessionStatus(tool RuntimeTool) (MCPSessionStatus, bool) {
+	if tool.Type != RuntimeToolMCP {
+		return MCPSessionStatus{}, false
+	}
+	if tool.isStdio() {
+		return pm.mcpStdio.status(tool.ID)
+	}
+	return pm.mcpHTTP.status(tool.ID)
+}
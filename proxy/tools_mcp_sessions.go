@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mcpSessionCloseTimeout bounds the DELETE that ends a session
+const mcpSessionCloseTimeout = 5 * time.Second
+
+// MCPSessionStatus is the health of the session an MCP tool keeps with its
+// server. For stdio tools it describes the server process.
+type MCPSessionStatus struct {
+	Active    bool   `json:"active"`
+	SessionID string `json:"sessionId,omitempty"`
+	// StartedAt is when the current session was initialized or the current
+	// process started
+	StartedAt  time.Time `json:"startedAt,omitzero"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitzero"`
+	Calls      int       `json:"calls"`
+	// Restarts counts re-initialized sessions or restarted processes
+	Restarts  int    `json:"restarts"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// mcpHTTPSession is the session a streamable HTTP MCP tool reuses across
+// calls. It is initialized on first use and again when the server no longer
+// knows it.
+type mcpHTTPSession struct {
+	endpoint string
+
+	// initMu serializes initialization so concurrent calls share one session
+	initMu sync.Mutex
+
+	mu         sync.Mutex
+	sessionID  string
+	nextID     int
+	startedAt  time.Time
+	lastUsedAt time.Time
+	calls      int
+	restarts   int
+	lastErr    error
+}
+
+// call sends a request on the session. A request the server rejects
+// because it does not know the session is sent again on a new one.
+func (s *mcpHTTPSession) call(method string, params map[string]any, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
+	for attempt := 0; ; attempt++ {
+		sessionID, err := s.ensure(client)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.nextID++
+		id := s.nextID
+		s.calls++
+		s.lastUsedAt = time.Now()
+		s.mu.Unlock()
+
+		body, err := mcpPostJSONRPC(client, s.endpoint, sessionID, map[string]any{
+			"jsonrpc": "2.0",
+			"id":      id,
+			"method":  method,
+			"params":  params,
+		})
+		if err != nil {
+			expired := isMCPSessionExpired(err)
+			s.fail(sessionID, err, expired)
+			if expired && attempt == 0 {
+				continue
+			}
+			return nil, err
+		}
+		if payload := extractMCPPayload(body); len(payload) > 0 {
+			return payload, nil
+		}
+		return body, nil
+	}
+}
+
+// ensure returns the current session id, initializing a session when there
+// is none
+func (s *mcpHTTPSession) ensure(client *http.Client) (string, error) {
+	s.initMu.Lock()
+	defer s.initMu.Unlock()
+	s.mu.Lock()
+	sessionID := s.sessionID
+	s.mu.Unlock()
+	if sessionID != "" {
+		return sessionID, nil
+	}
+
+	sessionID, err := mcpInitializeSession(client, s.endpoint)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.lastErr = err
+		return "", err
+	}
+	if !s.startedAt.IsZero() {
+		s.restarts++
+	}
+	s.sessionID = sessionID
+	s.nextID = 1
+	s.startedAt = time.Now()
+	s.lastErr = nil
+	return sessionID, nil
+}
+
+// fail records a failed request. An expired session is dropped so the next
+// call initializes a new one.
+func (s *mcpHTTPSession) fail(sessionID string, err error, expired bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+	if expired && s.sessionID == sessionID {
+		s.sessionID = ""
+	}
+}
+
+// close ends the session on the server. Servers that do not support
+// ending sessions answer 405, which is fine.
+func (s *mcpHTTPSession) close() {
+	s.initMu.Lock()
+	defer s.initMu.Unlock()
+	s.mu.Lock()
+	sessionID := s.sessionID
+	s.sessionID = ""
+	s.mu.Unlock()
+	if sessionID == "" {
+		return
+	}
+	client := &http.Client{Timeout: mcpSessionCloseTimeout}
+	if err := mcpDeleteSession(client, s.endpoint, sessionID); err != nil {
+		s.mu.Lock()
+		s.lastErr = err
+		s.mu.Unlock()
+	}
+}
+
+func (s *mcpHTTPSession) status() MCPSessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := MCPSessionStatus{
+		Active:     s.sessionID != "",
+		SessionID:  s.sessionID,
+		StartedAt:  s.startedAt,
+		LastUsedAt: s.lastUsedAt,
+		Calls:      s.calls,
+		Restarts:   s.restarts,
+	}
+	if s.lastErr != nil {
+		status.LastError = s.lastErr.Error()
+	}
+	return status
+}
+
+// isMCPSessionExpired reports whether a server rejected a request because it
+// does not know its session. The spec answers 404, servers built on the SDK
+// examples answer 400 with a message about the session id.
+func isMCPSessionExpired(err error) bool {
+	var statusErr *mcpStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusNotFound:
+		return true
+	case http.StatusBadRequest:
+		return strings.Contains(strings.ToLower(statusErr.Body), "session")
+	}
+	return false
+}
+
+func mcpDeleteSession(client *http.Client, endpoint string, sessionID string) error {
+	req, err := http.NewRequest(http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("mcp-session-id", sessionID)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("mcp session delete status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// mcpHTTPSessions holds the sessions of HTTP MCP tools by tool ID
+type mcpHTTPSessions struct {
+	sync.Mutex
+	sessions map[string]*mcpHTTPSession
+}
+
+func newMCPHTTPSessions() *mcpHTTPSessions {
+	return &mcpHTTPSessions{sessions: make(map[string]*mcpHTTPSession)}
+}
+
+// session returns the session of a tool. A tool whose endpoint changed gets
+// a new session and the old one is closed.
+func (m *mcpHTTPSessions) session(tool RuntimeTool) *mcpHTTPSession {
+	m.Lock()
+	existing, ok := m.sessions[tool.ID]
+	if ok && existing.endpoint == tool.Endpoint {
+		m.Unlock()
+		return existing
+	}
+	session := &mcpHTTPSession{endpoint: tool.Endpoint}
+	m.sessions[tool.ID] = session
+	m.Unlock()
+
+	if ok {
+		existing.close()
+	}
+	return session
+}
+
+// status returns the session health of a tool, if it has a session
+func (m *mcpHTTPSessions) status(toolID string) (MCPSessionStatus, bool) {
+	m.Lock()
+	session, ok := m.sessions[toolID]
+	m.Unlock()
+	if !ok {
+		return MCPSessionStatus{}, false
+	}
+	return session.status(), true
+}
+
+// close ends the session of a tool, if it has one
+func (m *mcpHTTPSessions) close(toolID string) {
+	m.Lock()
+	session, ok := m.sessions[toolID]
+	delete(m.sessions, toolID)
+	m.Unlock()
+	if ok {
+		session.close()
+	}
+}
+
+// closeAll ends every session
+func (m *mcpHTTPSessions) closeAll() {
+	m.Lock()
+	sessions := m.sessions
+	m.sessions = make(map[string]*mcpHTTPSession)
+	m.Unlock()
+
+	var wg sync.WaitGroup
+	for _, session := range sessions {
+		wg.Add(1)
+		go func(session *mcpHTTPSession) {
+			defer wg.Done()
+			session.close()
+		}(session)
+	}
+	wg.Wait()
+}
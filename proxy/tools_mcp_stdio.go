@@ -0,0 +1,543 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// mcpStdioInitTimeout bounds the initialize handshake of a new process
+	mcpStdioInitTimeout = 30 * time.Second
+	// mcpStdioStopTimeout is how long a server may take to exit after its
+	// stdin is closed before it is killed
+	mcpStdioStopTimeout = 3 * time.Second
+	// a server that crashes is restarted after a backoff that doubles from
+	// mcpStdioMinBackoff up to mcpStdioMaxBackoff. A process that ran for
+	// mcpStdioStableRun resets it.
+	mcpStdioMinBackoff = time.Second
+	mcpStdioMaxBackoff = 30 * time.Second
+	mcpStdioStableRun  = time.Minute
+	// after mcpStdioMaxFailures failed runs in a row the server is left
+	// stopped until the next call starts it again
+	mcpStdioMaxFailures = 5
+)
+
+var errMCPStdioStopped = errors.New("mcp stdio server stopped")
+
+// mcpStdioSpec is what a stdio server is started from. A tool whose spec
+// changes gets a new process.
+type mcpStdioSpec struct {
+	command string
+	args    []string
+	env     []string
+	workDir string
+}
+
+func mcpStdioSpecOf(tool RuntimeTool) mcpStdioSpec {
+	return mcpStdioSpec{
+		command: tool.Command,
+		args:    tool.Args,
+		env:     tool.Env,
+		workDir: tool.WorkDir,
+	}
+}
+
+func (s mcpStdioSpec) equal(other mcpStdioSpec) bool {
+	return s.command == other.command && slices.Equal(s.args, other.args) &&
+		slices.Equal(s.env, other.env) && s.workDir == other.workDir
+}
+
+type mcpStdioResult struct {
+	payload []byte
+	err     error
+}
+
+// mcpStdioServer supervises the process of one stdio MCP server. It is
+// started on first use, initialized once per process and restarted with a
+// backoff when it exits. A server that keeps failing is given up on until
+// the next call. Requests are written to stdin as single lines of JSON and
+// matched to the responses on stdout by id.
+type mcpStdioServer struct {
+	toolName   string
+	spec       mcpStdioSpec
+	logger     *LogMonitor
+	minBackoff time.Duration
+
+	stop chan struct{}
+
+	writeMu sync.Mutex
+
+	mu    sync.Mutex
+	stdin io.WriteCloser
+	// supervising is set while a supervise goroutine runs, done is closed
+	// when it returns
+	supervising bool
+	done        chan struct{}
+	running     bool
+	// changed is closed and replaced whenever running changes
+	changed    chan struct{}
+	pending    map[int64]chan mcpStdioResult
+	nextID     int64
+	startedAt  time.Time
+	lastUsedAt time.Time
+	calls      int
+	restarts   int
+	lastErr    error
+}
+
+func newMCPStdioServer(toolName string, spec mcpStdioSpec, logger *LogMonitor) *mcpStdioServer {
+	return &mcpStdioServer{
+		toolName:   toolName,
+		spec:       spec,
+		logger:     logger,
+		minBackoff: mcpStdioMinBackoff,
+		stop:       make(chan struct{}),
+		changed:    make(chan struct{}),
+		pending:    make(map[int64]chan mcpStdioResult),
+	}
+}
+
+// call sends a request once the server is running and waits for its
+// response
+func (s *mcpStdioServer) call(method string, params map[string]any, timeout time.Duration) ([]byte, error) {
+	s.ensureSupervised()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		running, supervising, changed, lastErr := s.running, s.supervising, s.changed, s.lastErr
+		s.mu.Unlock()
+		if running {
+			break
+		}
+		if !supervising {
+			select {
+			case <-s.stop:
+				return nil, errMCPStdioStopped
+			default:
+			}
+			return nil, fmt.Errorf("mcp stdio server %s is not running: %w", s.toolName, lastErr)
+		}
+		select {
+		case <-changed:
+		case <-s.stop:
+			return nil, errMCPStdioStopped
+		case <-deadline.C:
+			if lastErr != nil {
+				return nil, fmt.Errorf("mcp stdio server %s is not running: %w", s.toolName, lastErr)
+			}
+			return nil, fmt.Errorf("mcp stdio server %s did not start within %s", s.toolName, timeout)
+		}
+	}
+	s.mu.Lock()
+	s.calls++
+	s.lastUsedAt = time.Now()
+	s.mu.Unlock()
+	return s.request(method, params, deadline.C)
+}
+
+// request writes a request and waits for the response, the process exiting
+// or the deadline
+func (s *mcpStdioServer) request(method string, params map[string]any, deadline <-chan time.Time) ([]byte, error) {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	result := make(chan mcpStdioResult, 1)
+	s.pending[id] = result
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+	}()
+
+	if err := s.send(map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params}); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-result:
+		return r.payload, r.err
+	case <-deadline:
+		return nil, fmt.Errorf("mcp stdio server %s: %s timed out", s.toolName, method)
+	case <-s.stop:
+		return nil, errMCPStdioStopped
+	}
+}
+
+func (s *mcpStdioServer) send(msg map[string]any) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	stdin := s.stdin
+	s.mu.Unlock()
+	if stdin == nil {
+		return fmt.Errorf("mcp stdio server %s is not running", s.toolName)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err = stdin.Write(append(line, '\n'))
+	return err
+}
+
+// ensureSupervised starts a supervise goroutine unless one is running or the
+// server was shut down
+func (s *mcpStdioServer) ensureSupervised() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.supervising {
+		return
+	}
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+	s.supervising = true
+	s.done = make(chan struct{})
+	go s.supervise(s.done)
+}
+
+// supervise runs the server until it is stopped, restarting it when it
+// exits. After mcpStdioMaxFailures failed runs in a row it gives up.
+func (s *mcpStdioServer) supervise(done chan struct{}) {
+	defer close(done)
+	backoff := s.minBackoff
+	failures := 0
+	for {
+		started := time.Now()
+		err := s.runOnce()
+		select {
+		case <-s.stop:
+			s.stopSupervising(nil)
+			return
+		default:
+		}
+
+		if time.Since(started) >= mcpStdioStableRun {
+			backoff = s.minBackoff
+			failures = 0
+		}
+		failures++
+		if failures >= mcpStdioMaxFailures {
+			s.logger.Warnf("tool %s: mcp stdio server failed %d times in a row: %v (restarting on next call)", s.toolName, failures, err)
+			s.stopSupervising(err)
+			return
+		}
+		s.mu.Lock()
+		s.restarts++
+		s.lastErr = err
+		s.mu.Unlock()
+		s.logger.Warnf("tool %s: mcp stdio server exited: %v (restarting in %s)", s.toolName, err, backoff)
+
+		select {
+		case <-s.stop:
+			s.stopSupervising(nil)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, mcpStdioMaxBackoff)
+	}
+}
+
+// stopSupervising records that no supervise goroutine runs anymore and wakes
+// the calls waiting for the server to start
+func (s *mcpStdioServer) stopSupervising(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.supervising = false
+	if err != nil {
+		s.lastErr = err
+	}
+	s.notifyLocked()
+}
+
+// runOnce starts a process, initializes it and waits until it exits or the
+// server is stopped
+func (s *mcpStdioServer) runOnce() error {
+	cmd := exec.Command(s.spec.command, s.spec.args...)
+	cmd.Dir = s.spec.workDir
+	cmd.Env = append(os.Environ(), s.spec.env...)
+	setProcAttributes(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", s.spec.command, err)
+	}
+	s.logger.Infof("tool %s: started mcp stdio server %s (pid %d)", s.toolName, s.spec.command, cmd.Process.Pid)
+
+	s.mu.Lock()
+	s.stdin = stdin
+	s.mu.Unlock()
+
+	go s.logStderr(stderr)
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		s.readResponses(stdout)
+	}()
+
+	err = s.initialize()
+	if err == nil {
+		s.setRunning(true)
+		select {
+		case <-exited:
+		case <-s.stop:
+		}
+	}
+
+	// closing stdin asks the server to exit, it is killed if it does not
+	stdin.Close()
+	select {
+	case <-exited:
+	case <-time.After(mcpStdioStopTimeout):
+		cmd.Process.Kill()
+		<-exited
+	}
+	waitErr := cmd.Wait()
+
+	s.setRunning(false)
+	s.mu.Lock()
+	s.stdin = nil
+	for id, result := range s.pending {
+		delete(s.pending, id)
+		deliverMCPStdioResult(result, mcpStdioResult{err: fmt.Errorf("mcp stdio server %s exited", s.toolName)})
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if waitErr != nil {
+		return waitErr
+	}
+	return errors.New("process exited")
+}
+
+func (s *mcpStdioServer) initialize() error {
+	deadline := time.NewTimer(mcpStdioInitTimeout)
+	defer deadline.Stop()
+	payload, err := s.request("initialize", mcpInitializeParams(), deadline.C)
+	if err != nil {
+		return err
+	}
+	if errMsg := strings.TrimSpace(gjson.GetBytes(payload, "error.message").String()); errMsg != "" {
+		return fmt.Errorf("mcp initialize: %s", errMsg)
+	}
+	return s.send(map[string]any{"jsonrpc": "2.0", "method": "notifications/initialized", "params": map[string]any{}})
+}
+
+func (s *mcpStdioServer) setRunning(running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running == running {
+		return
+	}
+	s.running = running
+	if running {
+		s.startedAt = time.Now()
+		s.lastErr = nil
+	}
+	s.notifyLocked()
+}
+
+// notifyLocked wakes everyone waiting on changed
+func (s *mcpStdioServer) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// readResponses dispatches the messages a server writes to stdout until it
+// closes it. Server requests are answered here: ping with an empty result,
+// anything else as not supported.
+func (s *mcpStdioServer) readResponses(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if msg := strings.TrimSpace(string(line)); msg != "" {
+			s.dispatch([]byte(msg))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *mcpStdioServer) dispatch(msg []byte) {
+	if !gjson.ValidBytes(msg) {
+		s.logger.Debugf("tool %s: mcp stdio server wrote non JSON output: %s", s.toolName, truncateForLog(string(msg), 500))
+		return
+	}
+	id := gjson.GetBytes(msg, "id")
+	method := gjson.GetBytes(msg, "method").String()
+	switch {
+	case method != "" && id.Exists():
+		reply := map[string]any{"jsonrpc": "2.0", "id": id.Value()}
+		if method == "ping" {
+			reply["result"] = map[string]any{}
+		} else {
+			reply["error"] = map[string]any{"code": -32601, "message": "method not supported: " + method}
+		}
+		if err := s.send(reply); err != nil {
+			s.logger.Debugf("tool %s: failed to answer %s: %v", s.toolName, method, err)
+		}
+	case method != "":
+		// notifications such as logging or list changes are not used
+	case id.Exists():
+		s.mu.Lock()
+		result, ok := s.pending[id.Int()]
+		delete(s.pending, id.Int())
+		s.mu.Unlock()
+		if ok {
+			deliverMCPStdioResult(result, mcpStdioResult{payload: msg})
+		}
+	}
+}
+
+// deliverMCPStdioResult hands a result to a waiting request. A request that
+// gave up no longer reads its channel, the result is dropped then.
+func deliverMCPStdioResult(ch chan mcpStdioResult, r mcpStdioResult) {
+	select {
+	case ch <- r:
+	default:
+	}
+}
+
+func (s *mcpStdioServer) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		s.logger.Debugf("tool %s: %s", s.toolName, scanner.Text())
+	}
+}
+
+func (s *mcpStdioServer) status() MCPSessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := MCPSessionStatus{
+		Active:     s.running,
+		LastUsedAt: s.lastUsedAt,
+		Calls:      s.calls,
+		Restarts:   s.restarts,
+	}
+	if s.running {
+		status.StartedAt = s.startedAt
+	}
+	if s.lastErr != nil {
+		status.LastError = s.lastErr.Error()
+	}
+	return status
+}
+
+// shutdown stops the server and waits for its process to exit
+func (s *mcpStdioServer) shutdown() {
+	s.mu.Lock()
+	close(s.stop)
+	done := s.done
+	s.mu.Unlock()
+	// a server that was never started has nothing to wait for
+	if done != nil {
+		<-done
+	}
+}
+
+// mcpStdioServers holds the stdio servers of the tool runtime by tool ID
+type mcpStdioServers struct {
+	sync.Mutex
+	servers map[string]*mcpStdioServer
+	closed  bool
+	logger  *LogMonitor
+}
+
+func newMCPStdioServers(logger *LogMonitor) *mcpStdioServers {
+	return &mcpStdioServers{servers: make(map[string]*mcpStdioServer), logger: logger}
+}
+
+// server returns the server of a stdio tool. A tool whose command, args, env
+// or working directory changed gets a new server and the old one is stopped.
+func (m *mcpStdioServers) server(tool RuntimeTool) (*mcpStdioServer, error) {
+	spec := mcpStdioSpecOf(tool)
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return nil, errMCPStdioStopped
+	}
+	existing, ok := m.servers[tool.ID]
+	if ok && existing.spec.equal(spec) {
+		m.Unlock()
+		return existing, nil
+	}
+	server := newMCPStdioServer(tool.Name, spec, m.logger)
+	m.servers[tool.ID] = server
+	m.Unlock()
+
+	if ok {
+		existing.shutdown()
+	}
+	return server, nil
+}
+
+// status returns the process health of a tool, if it has a server
+func (m *mcpStdioServers) status(toolID string) (MCPSessionStatus, bool) {
+	m.Lock()
+	server, ok := m.servers[toolID]
+	m.Unlock()
+	if !ok {
+		return MCPSessionStatus{}, false
+	}
+	return server.status(), true
+}
+
+// stop shuts down the server of a tool, if it has one
+func (m *mcpStdioServers) stop(toolID string) {
+	m.Lock()
+	server, ok := m.servers[toolID]
+	delete(m.servers, toolID)
+	m.Unlock()
+	if ok {
+		server.shutdown()
+	}
+}
+
+// stopAll shuts down every server. No new servers are started after it.
+func (m *mcpStdioServers) stopAll() {
+	m.Lock()
+	servers := m.servers
+	m.servers = make(map[string]*mcpStdioServer)
+	m.closed = true
+	m.Unlock()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *mcpStdioServer) {
+			defer wg.Done()
+			server.shutdown()
+		}(server)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,444 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ltamann/tbg-ollama-swap-prompt-optimizer/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMCPServer is a streamable HTTP MCP server with two tools, navigate and
+// click, listed on two pages. tools/call echoes the tool name and arguments.
+// Requests on sessions it does not know are answered with 404.
+type fakeMCPServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	sessions int
+	live     map[string]bool
+	deleted  []string
+	methods  []string
+}
+
+// expireSessions forgets every session, as a restarted server would
+func (f *fakeMCPServer) expireSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.live = map[string]bool{}
+}
+
+func (f *fakeMCPServer) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, m := range f.methods {
+		if m == method {
+			n++
+		}
+	}
+	return n
+}
+
+func newFakeMCPServer(t *testing.T) *fakeMCPServer {
+	t.Helper()
+	f := &fakeMCPServer{live: map[string]bool{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.Header.Get("mcp-session-id")
+		if r.Method == http.MethodDelete {
+			f.mu.Lock()
+			f.deleted = append(f.deleted, sessionID)
+			delete(f.live, sessionID)
+			f.mu.Unlock()
+			return
+		}
+
+		var req struct {
+			ID     any            `json:"id"`
+			Method string         `json:"method"`
+			Params map[string]any `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		f.methods = append(f.methods, req.Method)
+		if req.Method == "initialize" {
+			f.sessions++
+			sessionID = fmt.Sprintf("session-%d", f.sessions)
+			f.live[sessionID] = true
+			w.Header().Set("mcp-session-id", sessionID)
+		}
+		known := f.live[sessionID]
+		f.mu.Unlock()
+		if !known {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+
+		var result any
+		switch req.Method {
+		case "initialize":
+			result = map[string]any{"protocolVersion": "2025-06-18", "capabilities": map[string]any{"tools": map[string]any{}}}
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case "tools/list":
+			if req.Params["cursor"] == nil {
+				result = map[string]any{
+					"tools": []any{map[string]any{
+						"name":        "navigate",
+						"description": "Open a URL",
+						"inputSchema": map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"url": map[string]any{"type": "string"}},
+							"required":   []any{"url"},
+						},
+					}},
+					"nextCursor": "page2",
+				}
+			} else {
+				result = map[string]any{"tools": []any{map[string]any{"name": "click"}}}
+			}
+		case "tools/call":
+			args, _ := json.Marshal(req.Params["arguments"])
+			result = map[string]any{"content": []any{map[string]any{"type": "text", "text": fmt.Sprintf("%v %s", req.Params["name"], args)}}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newToolsTestProxy(t *testing.T) *ProxyManager {
+	t.Helper()
+	pm := New(config.AddDefaultGroupToConfig(config.Config{HealthCheckTimeout: 15, LogLevel: "error"}))
+	pm.SetConfigPath(filepath.Join(t.TempDir(), "config.yaml"))
+	t.Cleanup(pm.Shutdown)
+	return pm
+}
+
+func sendToolsAPI(pm *ProxyManager, method string, path string, body any) (*TestResponseRecorder, RuntimeTool) {
+	encoded, _ := json.Marshal(body)
+	w := CreateTestResponseRecorder()
+	pm.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(encoded)))
+	var tool RuntimeTool
+	json.Unmarshal(w.Body.Bytes(), &tool)
+	return w, tool
+}
+
+// waitToolRefresh waits for the background tools/list refreshes and returns
+// the stored tool as /api/tools lists it
+func waitToolRefresh(t *testing.T, pm *ProxyManager, id string) RuntimeTool {
+	t.Helper()
+	pm.mcpRefreshes.Wait()
+	w := CreateTestResponseRecorder()
+	pm.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/tools", nil))
+	var tools []RuntimeTool
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tools))
+	for _, tool := range tools {
+		if tool.ID == id {
+			assert.False(t, tool.RemoteToolsRefreshing)
+			return tool
+		}
+	}
+	t.Fatalf("tool %s not found", id)
+	return RuntimeTool{}
+}
+
+func toolSchemaNames(schemas []map[string]any) []string {
+	names := make([]string, 0, len(schemas))
+	for _, s := range schemas {
+		fn, _ := s["function"].(map[string]any)
+		name, _ := fn["name"].(string)
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestProxyManager_MCPToolDiscovery(t *testing.T) {
+	server := newFakeMCPServer(t)
+	pm := newToolsTestProxy(t)
+
+	// the tool is saved right away and tools/list runs in the background
+	w, tool := sendToolsAPI(pm, http.MethodPost, "/api/tools", map[string]any{
+		"id": "browser", "name": "browser", "type": "mcp", "endpoint": server.URL, "enabled": true,
+	})
+	if !assert.Equal(t, http.StatusOK, w.Code, w.Body.String()) {
+		return
+	}
+	assert.True(t, tool.RemoteToolsRefreshing)
+	tool = waitToolRefresh(t, pm, "browser")
+	assert.Empty(t, tool.RemoteToolsError)
+	if assert.Len(t, tool.RemoteTools, 2) {
+		assert.Equal(t, "navigate", tool.RemoteTools[0].Name)
+		assert.Equal(t, "click", tool.RemoteTools[1].Name)
+	}
+
+	// every remote tool is its own function with its own schema
+	schemas := pm.toolSchemas()
+	assert.Equal(t, []string{"browser__navigate", "browser__click"}, toolSchemaNames(schemas))
+	fn := schemas[0]["function"].(map[string]any)
+	assert.Equal(t, "Open a URL", fn["description"])
+	assert.Equal(t, []any{"url"}, fn["parameters"].(map[string]any)["required"])
+
+	out, err := pm.executeToolCall("browser__navigate", map[string]any{"url": "http://example.test"}, http.Header{})
+	assert.NoError(t, err)
+	assert.Equal(t, `navigate {"url":"http://example.test"}`, out)
+
+	// disabling a remote tool hides it and blocks calls through the server
+	tool.RemoteTools[1].Disabled = true
+	w, _ = sendToolsAPI(pm, http.MethodPut, "/api/tools/browser", tool)
+	if !assert.Equal(t, http.StatusOK, w.Code, w.Body.String()) {
+		return
+	}
+	tool = waitToolRefresh(t, pm, "browser")
+	assert.True(t, tool.RemoteTools[1].Disabled)
+	assert.Equal(t, []string{"browser__navigate"}, toolSchemaNames(pm.toolSchemas()))
+	_, err = pm.executeToolCall("browser__click", map[string]any{}, http.Header{})
+	assert.ErrorContains(t, err, "not found")
+	_, err = pm.executeToolCall("browser", map[string]any{"name": "click"}, http.Header{})
+	assert.ErrorContains(t, err, "mcp tool click is disabled")
+
+	// a refresh re-reads the list and keeps the flags
+	w, _ = sendToolsAPI(pm, http.MethodPost, "/api/tools/browser/refresh", nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	tool = waitToolRefresh(t, pm, "browser")
+	if assert.Len(t, tool.RemoteTools, 2) {
+		assert.True(t, tool.RemoteTools[1].Disabled)
+	}
+
+	// an unreachable server keeps the cached list and reports the error
+	server.Close()
+	w, _ = sendToolsAPI(pm, http.MethodPost, "/api/tools/browser/refresh", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	tool = waitToolRefresh(t, pm, "browser")
+	assert.Len(t, tool.RemoteTools, 2)
+	assert.NotEmpty(t, tool.RemoteToolsError)
+}
+
+func TestProxyManager_MCPFunctionNameCollisions(t *testing.T) {
+	pm := newToolsTestProxy(t)
+	long := strings.Repeat("browser_", 8)
+	pm.Lock()
+	pm.tools = []RuntimeTool{
+		{ID: "plain", Name: "srv__a_b", Type: RuntimeToolHTTP, Endpoint: "http://localhost/x", Enabled: true},
+		{ID: "srv", Name: "srv", Type: RuntimeToolMCP, Endpoint: "http://localhost/mcp", Enabled: true,
+			RemoteTools: []MCPRemoteTool{{Name: "a.b"}, {Name: "a_b"}, {Name: long + "navigate"}, {Name: long + "click"}}},
+	}
+	pm.Unlock()
+
+	names := toolSchemaNames(pm.toolSchemas())
+	if !assert.Len(t, names, 5) {
+		return
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		assert.LessOrEqual(t, len(name), maxToolFunctionName)
+		assert.False(t, seen[name], "duplicate function name %s", name)
+		seen[name] = true
+	}
+
+	// every function routes to its own remote tool
+	for i, remote := range []string{"a.b", "a_b", long + "navigate", long + "click"} {
+		tool, ok := pm.toolByName(names[i+1])
+		if assert.True(t, ok, names[i+1]) {
+			assert.Equal(t, remote, tool.RemoteName)
+		}
+	}
+	tool, ok := pm.toolByName("srv__a_b")
+	assert.True(t, ok)
+	assert.Equal(t, RuntimeToolHTTP, tool.Type)
+}
+
+func TestProxyManager_MCPSessionReuse(t *testing.T) {
+	server := newFakeMCPServer(t)
+	pm := newToolsTestProxy(t)
+
+	w, _ := sendToolsAPI(pm, http.MethodPost, "/api/tools", map[string]any{
+		"id": "browser", "name": "browser", "type": "mcp", "endpoint": server.URL, "enabled": true,
+	})
+	if !assert.Equal(t, http.StatusOK, w.Code, w.Body.String()) {
+		return
+	}
+	waitToolRefresh(t, pm, "browser")
+
+	// tools/list and both calls share the session
+	for i := 0; i < 2; i++ {
+		_, err := pm.executeToolCall("browser__navigate", map[string]any{"url": "http://example.test"}, http.Header{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, server.count("initialize"))
+	assert.Equal(t, 2, server.count("tools/call"))
+
+	listSession := func() *MCPSessionStatus {
+		w := CreateTestResponseRecorder()
+		pm.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/tools", nil))
+		var tools []RuntimeTool
+		json.Unmarshal(w.Body.Bytes(), &tools)
+		if len(tools) != 1 {
+			return nil
+		}
+		return tools[0].Session
+	}
+	status := listSession()
+	if assert.NotNil(t, status) {
+		assert.True(t, status.Active)
+		assert.Equal(t, "session-1", status.SessionID)
+		assert.Equal(t, 4, status.Calls)
+		assert.Equal(t, 0, status.Restarts)
+	}
+
+	// a server that lost the session gets a new one and the call is retried
+	server.expireSessions()
+	out, err := pm.executeToolCall("browser__navigate", map[string]any{"url": "http://example.test"}, http.Header{})
+	assert.NoError(t, err)
+	assert.Equal(t, `navigate {"url":"http://example.test"}`, out)
+	status = listSession()
+	if assert.NotNil(t, status) {
+		assert.Equal(t, "session-2", status.SessionID)
+		assert.Equal(t, 1, status.Restarts)
+	}
+
+	// the session is ended on shutdown
+	pm.Shutdown()
+	server.mu.Lock()
+	assert.Equal(t, []string{"session-2"}, server.deleted)
+	server.mu.Unlock()
+}
+
+// fakeMCPStdioServerEnv makes the test binary run runFakeMCPStdioServer
+const fakeMCPStdioServerEnv = "FAKE_MCP_STDIO_SERVER"
+
+// runFakeMCPStdioServer is a stdio MCP server with the tools echo and crash.
+// echo returns FAKE_MCP_PREFIX, the arguments and the pid, crash exits.
+func runFakeMCPStdioServer() {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var req struct {
+			ID     any            `json:"id"`
+			Method string         `json:"method"`
+			Params map[string]any `json:"params"`
+		}
+		if json.Unmarshal(line, &req) != nil || req.ID == nil {
+			continue
+		}
+		var result any
+		switch req.Method {
+		case "initialize":
+			result = map[string]any{"protocolVersion": "2025-06-18", "capabilities": map[string]any{"tools": map[string]any{}}}
+		case "tools/list":
+			result = map[string]any{"tools": []any{
+				map[string]any{"name": "echo", "description": "Echo the arguments"},
+				map[string]any{"name": "crash"},
+			}}
+		case "tools/call":
+			if req.Params["name"] == "crash" {
+				os.Exit(1)
+			}
+			args, _ := json.Marshal(req.Params["arguments"])
+			text := fmt.Sprintf("%s %s pid=%d", os.Getenv("FAKE_MCP_PREFIX"), args, os.Getpid())
+			result = map[string]any{"content": []any{map[string]any{"type": "text", "text": text}}}
+		}
+		out, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+		fmt.Println(string(out))
+	}
+}
+
+func TestProxyManager_MCPStdioTool(t *testing.T) {
+	pm := newToolsTestProxy(t)
+	stdioTool := map[string]any{
+		"id": "local", "name": "local", "type": "mcp", "enabled": true,
+		"transport": "stdio", "command": os.Args[0],
+		"env": []string{fakeMCPStdioServerEnv + "=1", "FAKE_MCP_PREFIX=hello"},
+	}
+
+	// stdio tools are off unless the config file allows them
+	w, _ := sendToolsAPI(pm, http.MethodPost, "/api/tools", stdioTool)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "allowStdioTools")
+	_, started := pm.mcpStdio.status("local")
+	assert.False(t, started)
+
+	pm.config.AllowStdioTools = true
+	w, _ = sendToolsAPI(pm, http.MethodPost, "/api/tools", stdioTool)
+	if !assert.Equal(t, http.StatusOK, w.Code, w.Body.String()) {
+		return
+	}
+	tool := waitToolRefresh(t, pm, "local")
+	assert.Empty(t, tool.RemoteToolsError)
+	assert.Equal(t, []string{"local__echo", "local__crash"}, toolSchemaNames(pm.toolSchemas()))
+
+	out, err := pm.executeToolCall("local__echo", map[string]any{"n": 1}, http.Header{})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, `hello {"n":1} pid=`), out)
+	firstPid := out[strings.Index(out, "pid="):]
+
+	// calls share the running process
+	out, err = pm.executeToolCall("local__echo", map[string]any{"n": 2}, http.Header{})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, firstPid), out)
+
+	// a crashed server fails the call in flight and is restarted
+	_, err = pm.executeToolCall("local__crash", map[string]any{}, http.Header{})
+	assert.ErrorContains(t, err, "exited")
+	out, err = pm.executeToolCall("local__echo", map[string]any{"n": 3}, http.Header{})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, `hello {"n":3} pid=`), out)
+	assert.False(t, strings.HasSuffix(out, firstPid), out)
+	status, ok := pm.mcpSessionStatus(tool)
+	if assert.True(t, ok) {
+		assert.True(t, status.Active)
+		assert.Equal(t, 1, status.Restarts)
+	}
+
+	// a rejected duplicate does not replace the running server
+	stdioTool["env"] = []string{fakeMCPStdioServerEnv + "=1", "FAKE_MCP_PREFIX=other"}
+	w, _ = sendToolsAPI(pm, http.MethodPost, "/api/tools", stdioTool)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	status, _ = pm.mcpStdio.status("local")
+	assert.Equal(t, 1, status.Restarts)
+
+	// stdio tools need a command
+	w, _ = sendToolsAPI(pm, http.MethodPost, "/api/tools", map[string]any{
+		"name": "broken", "type": "mcp", "transport": "stdio",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestMCPStdioServer_GivesUpAfterRepeatedFailures(t *testing.T) {
+	server := newMCPStdioServer("local", mcpStdioSpec{command: filepath.Join(t.TempDir(), "missing")}, testLogger)
+	server.minBackoff = time.Millisecond
+	defer server.shutdown()
+
+	// the supervisor stops restarting and the waiting call fails right away
+	start := time.Now()
+	_, err := server.call("tools/list", map[string]any{}, 10*time.Second)
+	assert.ErrorContains(t, err, "is not running")
+	assert.Less(t, time.Since(start), 5*time.Second)
+	status := server.status()
+	assert.False(t, status.Active)
+	assert.Equal(t, mcpStdioMaxFailures-1, status.Restarts)
+	assert.NotEmpty(t, status.LastError)
+
+	// the next call starts it again
+	server.spec = mcpStdioSpec{command: os.Args[0], env: []string{fakeMCPStdioServerEnv + "=1"}}
+	payload, err := server.call("tools/list", map[string]any{}, 10*time.Second)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(payload), "echo")
+	}
+	assert.True(t, server.status().Active)
+}
@@ -35,6 +35,9 @@ export interface Metrics {
   tokens_per_second: number;
   duration_ms: number;
   has_capture: boolean;
+  context_retried?: boolean;
+  prompt_policy?: string;
+  overflow_from?: string;
 }
 
 export interface ReqRespCapture {
@@ -66,7 +69,7 @@ export interface LogData {
 }
 
 export interface APIEventEnvelope {
-  type: "modelStatus" | "logData" | "metrics";
+  type: "modelStatus" | "logData" | "metrics" | "promptOptimization";
   data: string;
 }
 
@@ -277,7 +277,7 @@ export async function setModelFitMode(model: string, fit: boolean, mode: "max" |
   }
 }
 
-export type PromptOptimizationPolicy = "off" | "limit_only" | "always" | "llm_assisted";
+export type PromptOptimizationPolicy = "off" | "limit_only" | "always" | "llm_assisted" | "prefix_stable";
 export interface PromptOptimizationSnapshot {
   model: string;
   policy: PromptOptimizationPolicy | "llm_assisted";
@@ -301,6 +301,32 @@ export interface RuntimeTool {
   policy?: RuntimeToolPolicy;
   requireApproval?: boolean;
   timeoutSeconds?: number;
+  transport?: "stdio";
+  command?: string;
+  args?: string[];
+  env?: string[];
+  workDir?: string;
+  remoteTools?: MCPRemoteTool[];
+  remoteToolsError?: string;
+  remoteToolsRefreshing?: boolean;
+  session?: MCPSessionStatus;
+}
+
+export interface MCPSessionStatus {
+  active: boolean;
+  sessionId?: string;
+  startedAt?: string;
+  lastUsedAt?: string;
+  calls: number;
+  restarts: number;
+  lastError?: string;
+}
+
+export interface MCPRemoteTool {
+  name: string;
+  description?: string;
+  inputSchema?: Record<string, unknown>;
+  disabled?: boolean;
 }
 
 export interface ToolRuntimeSettings {
@@ -322,7 +348,7 @@ export async function getPromptOptimizationPolicy(model: string): Promise<Prompt
       throw new Error(`Failed to fetch prompt optimization policy for ${model}: ${response.status}`);
     }
     const data = (await response.json()) as { policy?: PromptOptimizationPolicy };
-    if (data.policy === "off" || data.policy === "always" || data.policy === "limit_only" || data.policy === "llm_assisted") {
+    if (data.policy === "off" || data.policy === "always" || data.policy === "limit_only" || data.policy === "llm_assisted" || data.policy === "prefix_stable") {
       return data.policy;
     }
     return "limit_only";
@@ -457,6 +483,16 @@ export async function updateTool(tool: RuntimeTool): Promise<RuntimeTool> {
   return (await response.json()) as RuntimeTool;
 }
 
+export async function refreshTool(id: string): Promise<RuntimeTool> {
+  const response = await fetch(`/api/tools/${encodeURIComponent(id)}/refresh`, {
+    method: "POST",
+  });
+  if (!response.ok) {
+    throw new Error(`Failed to refresh tool: ${response.status}`);
+  }
+  return (await response.json()) as RuntimeTool;
+}
+
 export async function deleteTool(id: string): Promise<void> {
   const response = await fetch(`/api/tools/${encodeURIComponent(id)}`, {
     method: "DELETE",